@@ -0,0 +1,86 @@
+// Package app bundles the nats connection, mongo client and logger used by a
+// service, so several services can run in one process.
+package app
+
+import (
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/db"
+	"github.com/vavas/go_services/gnats"
+	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/transport"
+)
+
+// App is the runtime of a service.
+type App struct {
+	Name  string
+	NATS  *gnats.Conn
+	Mongo *db.Client
+	// Transport carries the service messages, by default over NATS.
+	Transport transport.Transport
+	Logger    *zap.Logger
+}
+
+var defaultApp = &App{
+	NATS:      gnats.Default(),
+	Mongo:     db.Default(),
+	Transport: transport.NewNATS(gnats.Default()),
+}
+
+// New returns an App with its own, not yet connected, nats connection and
+// mongo client.
+func New(name string) *App {
+	log := logger.New(name)
+
+	conn := gnats.New()
+	conn.Logger = log
+
+	return &App{
+		Name:      name,
+		NATS:      conn,
+		Mongo:     &db.Client{Logger: log},
+		Transport: transport.NewNATS(conn),
+		Logger:    log,
+	}
+}
+
+// NewWithTransport returns an App whose messages go through t instead of
+// NATS, e.g. a shared transport.Memory in tests.
+func NewWithTransport(name string, t transport.Transport) *App {
+	a := New(name)
+	a.Transport = t
+	return a
+}
+
+// Default returns the App backed by the package level gnats, db and logger
+// globals. It is used by the functions that don't take an App.
+func Default() *App {
+	return defaultApp
+}
+
+// Log returns the logger of the app, falling back to logger.Logger.
+func (a *App) Log() *zap.Logger {
+	if a.Logger != nil {
+		return a.Logger
+	}
+	return logger.Logger
+}
+
+// DB returns the database of the app, nil if mongo is not connected.
+func (a *App) DB() *mongo.Database {
+	if !a.Mongo.HasClient() {
+		return nil
+	}
+	return a.Mongo.DB()
+}
+
+// NamedDB returns the database of the named client, see db.ConnectNamed, for
+// handlers using another database than the dbc they are given. The app
+// database is returned for an empty name.
+func (a *App) NamedDB(name string) *mongo.Database {
+	if len(name) == 0 {
+		return a.DB()
+	}
+	return db.NamedDB(name)
+}
@@ -199,7 +199,9 @@ func TestUnmarshalDateTimePtrISO(t *testing.T) {
 }
 
 func TestBSON(t *testing.T) {
-	db.TestConnect()
+	if err := db.TestConnect(); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
 	dbc := db.DB()
 	defer dbc.Client().Disconnect(nil)
 
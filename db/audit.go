@@ -0,0 +1,426 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/logger"
+)
+
+// AuditCollection is the append-only collection the audit entries are
+// stored in.
+var AuditCollection = "_audit"
+
+// AuditBatchSize is the number of documents written at a time by the audited
+// writes of many documents, their states are kept in memory to be compared.
+var AuditBatchSize = 500
+
+// Audit operations.
+const (
+	AuditInsert = "insert"
+	AuditUpdate = "update"
+	AuditRemove = "remove"
+)
+
+// AuditChange is the change of a field of a document. From is nil for a new
+// field and To is nil for a removed field.
+type AuditChange struct {
+	Field string      `bson:"field" json:"field"`
+	From  interface{} `bson:"from,omitempty" json:"from,omitempty"`
+	To    interface{} `bson:"to,omitempty" json:"to,omitempty"`
+}
+
+// Actor is the user or admin making a write, recorded in its audit entries.
+type Actor struct {
+	UserID  string
+	AdminID string
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor of the writes.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor carried by ctx.
+func ActorFromContext(ctx context.Context) Actor {
+	if ctx == nil {
+		return Actor{}
+	}
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// AuditEntry records a write of a document, with the actor and request id
+// found in the context of the write.
+type AuditEntry struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Collection string             `bson:"collection" json:"collection"`
+	DocumentID interface{}        `bson:"document_id" json:"document_id"`
+	Operation  string             `bson:"operation" json:"operation"`
+	Changes    []AuditChange      `bson:"changes,omitempty" json:"changes,omitempty"`
+	UserID     string             `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	AdminID    string             `bson:"admin_id,omitempty" json:"admin_id,omitempty"`
+	RequestID  string             `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	TenantID   interface{}        `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WithAudit returns a copy of the collection whose writes are recorded in the
+// audit collection. The actor and request id are read from the context of the
+// *Context methods, see extsrv.Request.Context.
+func (c *Collection) WithAudit() *Collection {
+	col := *c
+	col.Audit = true
+	return &col
+}
+
+// audited runs write with selector and records the changes of the documents
+// matching it. The single document writes are given selector restricted to
+// the _id of the document found before, so the recorded document is the
+// written one. The writes of many documents are run on batches of
+// AuditBatchSize documents in _id order, given selector restricted to their
+// _id. write returns the id of an upserted document, if any.
+func (c *Collection) audited(ctx context.Context, operation string, selector interface{}, many bool, write func(selector interface{}) (interface{}, error)) error {
+	if !c.Audit {
+		_, err := write(selector)
+		return err
+	}
+
+	found := func(selector interface{}) interface{} {
+		if operation == AuditRemove && c.SoftDelete {
+			return (&Collection{SoftDelete: true}).notDeleted(selector)
+		}
+		return selector
+	}
+	if !many {
+		befores, err := c.auditFind(ctx, found(selector), 1)
+		if err != nil {
+			return err
+		}
+		if len(befores) > 0 {
+			selector = withID(selector, befores[0].Lookup("_id"))
+		}
+		return c.auditWrite(ctx, operation, selector, befores, write)
+	}
+
+	batch := selector
+	for first := true; ; first = false {
+		befores, err := c.auditFind(ctx, found(batch), int64(AuditBatchSize))
+		if err != nil {
+			return err
+		}
+		if len(befores) == 0 {
+			if first {
+				// nothing matches, an upsert may insert a document
+				return c.auditWrite(ctx, operation, selector, nil, write)
+			}
+			return nil
+		}
+
+		ids := primitive.A{}
+		for _, before := range befores {
+			ids = append(ids, rawInterface(before.Lookup("_id")))
+		}
+		byIDs := primitive.D{{Key: "$and", Value: primitive.A{selector, primitive.D{{Key: "_id", Value: primitive.D{{Key: "$in", Value: ids}}}}}}}
+		if err := c.auditWrite(ctx, operation, byIDs, befores, write); err != nil {
+			return err
+		}
+		if len(befores) < AuditBatchSize {
+			return nil
+		}
+		last := primitive.D{{Key: "_id", Value: primitive.D{{Key: "$gt", Value: ids[len(ids)-1]}}}}
+		batch = primitive.D{{Key: "$and", Value: primitive.A{selector, last}}}
+	}
+}
+
+// auditWrite runs write with selector and records the changes of the
+// documents found before it, befores.
+func (c *Collection) auditWrite(ctx context.Context, operation string, selector interface{}, befores []bson.Raw, write func(selector interface{}) (interface{}, error)) error {
+	upsertedID, err := write(selector)
+	if err != nil {
+		return err
+	}
+
+	ids := primitive.A{}
+	for _, before := range befores {
+		ids = append(ids, before.Lookup("_id"))
+	}
+	if upsertedID != nil {
+		ids = append(ids, upsertedID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	afters := map[string]bson.Raw{}
+	if operation != AuditRemove || c.SoftDelete {
+		docs, err := c.auditFind(ctx, primitive.M{"_id": primitive.M{"$in": ids}}, 0)
+		if err != nil {
+			c.auditError(err)
+			return nil
+		}
+		for _, doc := range docs {
+			afters[idKey(doc.Lookup("_id"))] = doc
+		}
+	}
+
+	entries := []*AuditEntry{}
+	for _, before := range befores {
+		id := before.Lookup("_id")
+		changes := diffDocuments(before, afters[idKey(id)])
+		if len(changes) == 0 && operation != AuditRemove {
+			continue
+		}
+		entries = append(entries, c.auditEntry(ctx, operation, rawInterface(id), changes))
+	}
+	if upsertedID != nil {
+		if after, ok := afters[idKey(rawValue(upsertedID))]; ok {
+			entries = append(entries, c.auditEntry(ctx, AuditInsert, upsertedID, diffDocuments(nil, after)))
+		}
+	}
+
+	c.audit(ctx, entries)
+	return nil
+}
+
+// withID restricts selector to the document with id.
+func withID(selector interface{}, id bson.RawValue) primitive.D {
+	byID := primitive.D{{Key: "_id", Value: rawInterface(id)}}
+	if selector == nil {
+		return byID
+	}
+	return primitive.D{{Key: "$and", Value: primitive.A{selector, byID}}}
+}
+
+// auditInserts records the inserted documents.
+func (c *Collection) auditInserts(ctx context.Context, documents []interface{}, ids []interface{}) {
+	if !c.Audit {
+		return
+	}
+
+	entries := []*AuditEntry{}
+	for i, document := range documents {
+		data, err := bson.Marshal(document)
+		if err != nil || i >= len(ids) {
+			continue
+		}
+		entries = append(entries, c.auditEntry(ctx, AuditInsert, ids[i], diffDocuments(nil, data)))
+	}
+	c.audit(ctx, entries)
+}
+
+func (c *Collection) auditEntry(ctx context.Context, operation string, id interface{}, changes []AuditChange) *AuditEntry {
+	actor := ActorFromContext(ctx)
+	tenant, _ := c.tenant(ctx)
+	return &AuditEntry{
+		ID:         primitive.NewObjectID(),
+		Collection: c.Name(),
+		DocumentID: id,
+		Operation:  operation,
+		Changes:    changes,
+		UserID:     actor.UserID,
+		AdminID:    actor.AdminID,
+		RequestID:  logger.RequestID(ctx),
+		TenantID:   tenant,
+		CreatedAt:  now(),
+	}
+}
+
+// audit stores the entries. A failure is logged, the write itself is done.
+func (c *Collection) audit(ctx context.Context, entries []*AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		docs = append(docs, entry)
+	}
+	if _, err := c.sibling(AuditCollection).InsertMany(ctx, docs); err != nil {
+		c.auditError(err)
+	}
+}
+
+func (c *Collection) auditError(err error) {
+	log := c.logger()
+	if log == nil {
+		return
+	}
+	log.Error("audit entries not recorded",
+		zap.String("collection", c.Name()),
+		zap.Error(err))
+}
+
+// auditFind returns up to limit documents matching selector, all of them when
+// limit is zero, in _id order when there can be several.
+func (c *Collection) auditFind(ctx context.Context, selector interface{}, limit int64) ([]bson.Raw, error) {
+	if selector == nil {
+		selector = primitive.D{}
+	}
+	opts := options.Find()
+	if limit != 1 {
+		opts.SetSort(primitive.D{{Key: "_id", Value: 1}})
+	}
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cur, err := c.Find(ctx, selector, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	docs := []bson.Raw{}
+	for cur.Next(ctx) {
+		docs = append(docs, append(bson.Raw{}, cur.Current...))
+	}
+	return docs, cur.Err()
+}
+
+// diffDocuments returns the changes of the top level fields from before to
+// after, either can be nil. _id and updated_at are left out.
+func diffDocuments(before bson.Raw, after bson.Raw) []AuditChange {
+	fields := []string{}
+	seen := map[string]bool{}
+	for _, doc := range []bson.Raw{before, after} {
+		if len(doc) == 0 {
+			continue
+		}
+		elems, _ := doc.Elements()
+		for _, elem := range elems {
+			if key := elem.Key(); !seen[key] {
+				seen[key] = true
+				fields = append(fields, key)
+			}
+		}
+	}
+
+	changes := []AuditChange{}
+	for _, field := range fields {
+		if field == "_id" || field == UpdatedAtField {
+			continue
+		}
+
+		from, hasFrom := lookup(before, field)
+		to, hasTo := lookup(after, field)
+		if hasFrom && hasTo && from.Type == to.Type && bytes.Equal(from.Value, to.Value) {
+			continue
+		}
+
+		change := AuditChange{Field: field}
+		if hasFrom {
+			change.From = rawInterface(from)
+		}
+		if hasTo {
+			change.To = rawInterface(to)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func lookup(doc bson.Raw, field string) (bson.RawValue, bool) {
+	if len(doc) == 0 {
+		return bson.RawValue{}, false
+	}
+	value, err := doc.LookupErr(field)
+	return value, err == nil
+}
+
+func rawInterface(value bson.RawValue) interface{} {
+	var v interface{}
+	_ = value.Unmarshal(&v)
+	return v
+}
+
+func rawValue(v interface{}) bson.RawValue {
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return bson.RawValue{}
+	}
+	return bson.RawValue{Type: t, Value: data}
+}
+
+func idKey(id bson.RawValue) string {
+	return string(id.Type) + string(id.Value)
+}
+
+// AuditQuery selects audit entries, the zero fields are not filtered on.
+type AuditQuery struct {
+	Collection string
+	DocumentID interface{}
+	Operation  string
+	UserID     string
+	AdminID    string
+	RequestID  string
+	Since      time.Time
+	Until      time.Time
+	Limit      int64
+}
+
+func (q *AuditQuery) filter() primitive.D {
+	filter := primitive.D{}
+	for _, f := range []struct {
+		key   string
+		value string
+	}{
+		{"collection", q.Collection},
+		{"operation", q.Operation},
+		{"user_id", q.UserID},
+		{"admin_id", q.AdminID},
+		{"request_id", q.RequestID},
+	} {
+		if len(f.value) > 0 {
+			filter = append(filter, primitive.E{Key: f.key, Value: f.value})
+		}
+	}
+	if q.DocumentID != nil {
+		filter = append(filter, primitive.E{Key: "document_id", Value: q.DocumentID})
+	}
+
+	createdAt := primitive.D{}
+	if !q.Since.IsZero() {
+		createdAt = append(createdAt, primitive.E{Key: "$gte", Value: q.Since})
+	}
+	if !q.Until.IsZero() {
+		createdAt = append(createdAt, primitive.E{Key: "$lt", Value: q.Until})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, primitive.E{Key: "created_at", Value: createdAt})
+	}
+	return filter
+}
+
+// FindAudit returns the audit entries of dbc matching q, newest first. They
+// are restricted to the tenant of ctx, unless it bypasses the tenant scope.
+func FindAudit(ctx context.Context, dbc *mongo.Database, q AuditQuery) ([]AuditEntry, error) {
+	opts := options.Find().SetSort(primitive.D{{Key: "_id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+
+	filter := q.filter()
+	if tenant, ok := TenantFromContext(ctx); ok && !bypassesTenant(ctx) {
+		filter = append(filter, primitive.E{Key: "tenant_id", Value: tenant})
+	}
+	entries := []AuditEntry{}
+	if err := Col(dbc, AuditCollection).AllContext(ctx, filter, opts, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DocumentHistory returns the audit entries of a document, newest first.
+func DocumentHistory(ctx context.Context, dbc *mongo.Database, collection string, id interface{}) ([]AuditEntry, error) {
+	return FindAudit(ctx, dbc, AuditQuery{Collection: collection, DocumentID: id})
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/vavas/go_services/db/query"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	before, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "old"}, {Key: "age", Value: 30}, {Key: "nick", Value: "o"}})
+	after, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "new"}, {Key: "age", Value: 30}, {Key: "email", Value: "e"}})
+
+	changes := diffDocuments(before, after)
+	expected := []AuditChange{
+		{Field: "name", From: "old", To: "new"},
+		{Field: "nick", From: "o"},
+		{Field: "email", To: "e"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Unexpected changes: %+v, expected %+v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Unexpected change: %+v, expected %+v", changes[i], expected[i])
+		}
+	}
+
+	if changes := diffDocuments(nil, after); len(changes) != 3 {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+func TestAuditActor(t *testing.T) {
+	ctx := WithActor(context.Background(), Actor{UserID: "u1"})
+	if actor := ActorFromContext(ctx); actor.UserID != "u1" {
+		t.Errorf("Unexpected actor: %+v", actor)
+	}
+
+	q := AuditQuery{Collection: "users", DocumentID: 1, UserID: "u1"}
+	data, _ := bson.MarshalExtJSON(q.filter(), false, false)
+	if string(data) != `{"collection":"users","user_id":"u1","document_id":1}` {
+		t.Errorf("Unexpected filter: %s", data)
+	}
+}
+
+func TestAuditedSingleWrite(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	c := m.Col("users").WithAudit()
+
+	ids := []interface{}{}
+	for _, name := range []string{"ann", "bob"} {
+		result, err := c.InsertContext(ctx, &memoryUser{Name: name, Age: 30})
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+		ids = append(ids, result.InsertedID)
+	}
+
+	// the write is restricted to the audited document
+	err := c.audited(ctx, AuditUpdate, query.Eq("age", 30), false, func(selector interface{}) (interface{}, error) {
+		if n, err := c.CountContext(ctx, selector); err != nil || n != 1 {
+			t.Errorf("Unexpected count of the write selector: %+v (%+v), expected %+v", n, err, 1)
+		}
+		_, err := c.UpdateOne(ctx, selector, primitive.M{"$set": primitive.M{"age": 31}})
+		return nil, err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	entries, err := FindAudit(ctx, m.DB(), AuditQuery{Collection: "users", Operation: AuditUpdate})
+	if err != nil || len(entries) != 1 || entries[0].DocumentID != ids[0] || entries[0].Changes[0].To != int32(31) {
+		t.Errorf("Unexpected audit entries: %+v (%+v), expected one of %+v", entries, err, ids[0])
+	}
+}
+
+func TestAuditedBatches(t *testing.T) {
+	previous := AuditBatchSize
+	AuditBatchSize = 2
+	defer func() { AuditBatchSize = previous }()
+
+	m := NewMemory()
+	ctx := context.Background()
+	c := m.Col("users").WithAudit()
+	for _, name := range []string{"ann", "bob", "cid", "dan", "eve"} {
+		if _, err := c.InsertContext(ctx, &memoryUser{Name: name, Age: 30}); err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+	}
+
+	result, err := c.UpdateAllContext(ctx, query.Eq("age", 30), primitive.M{"$set": primitive.M{"age": 31}})
+	if err != nil || result.MatchedCount != 5 || result.ModifiedCount != 5 {
+		t.Fatalf("Unexpected result: %+v (%+v), expected 5 updates", result, err)
+	}
+	if err := c.RemoveAllContext(ctx, nil); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	for operation, expected := range map[string]int{AuditUpdate: 5, AuditRemove: 5} {
+		entries, err := FindAudit(ctx, m.DB(), AuditQuery{Collection: "users", Operation: operation})
+		if err != nil || len(entries) != expected {
+			t.Errorf("Unexpected %s entries: %+v (%+v), expected %+v", operation, len(entries), err, expected)
+		}
+	}
+}
+
+func TestAuditErrorLogger(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	m := NewMemory()
+	m.Client().Logger = zap.New(core)
+
+	Col(m.DB(), "users").auditError(errors.New("boom"))
+	if logs.Len() != 1 || logs.All()[0].Message != "audit entries not recorded" {
+		t.Errorf("Unexpected logs: %+v", logs.All())
+	}
+}
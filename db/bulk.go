@@ -0,0 +1,584 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkChunkSize is the default number of operations sent in one bulk write.
+var BulkChunkSize = 1000
+
+// BulkChunkBytes is the default size of the operations sent in one bulk
+// write, below the 48MB mongo message limit.
+var BulkChunkBytes = 16 * 1024 * 1024
+
+// maxLineSize is the largest JSON line read by ImportJSONLines, above the
+// 16MB mongo document limit for the extended JSON overhead.
+const maxLineSize = 32 * 1024 * 1024
+
+// Bulk collects mixed writes of a collection and runs them with BulkWrite,
+// ChunkSize operations at a time. The operations of audited collections are
+// run one at a time to record their changes.
+//
+//	result, err := db.Col(dbc, "users").Bulk().
+//		Insert(newUser).
+//		UpdateID(id, primitive.M{"$set": primitive.M{"name": name}}).
+//		RemoveID(oldID).
+//		Run(ctx)
+type Bulk struct {
+	// ChunkSize is the number of operations per bulk write, BulkChunkSize
+	// when zero.
+	ChunkSize int
+	// ChunkBytes is the marshalled size of the operations per bulk write,
+	// BulkChunkBytes when zero. A larger operation is sent alone.
+	ChunkBytes int
+
+	col        *Collection
+	models     []mongo.WriteModel
+	operations []string
+	sizes      []int
+	ordered    bool
+	err        error
+}
+
+// BulkResult sums the results of the bulk writes.
+type BulkResult struct {
+	Inserted int64
+	Matched  int64
+	Modified int64
+	Deleted  int64
+	Upserted int64
+	// UpsertedIDs maps the index of the upserting operations to the _id of
+	// the upserted document.
+	UpsertedIDs map[int]interface{}
+}
+
+// BulkOpError is the error of an operation. Index is the index of the
+// operation in the order they were added, or of the line for ImportJSONLines.
+type BulkOpError struct {
+	Index   int    `json:"index"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// BulkError is returned when operations of a bulk write failed. In ordered
+// mode the operations after the first failure are not run.
+type BulkError struct {
+	Errors []BulkOpError
+	// WriteConcernErrors are the write concern errors of the chunks.
+	WriteConcernErrors []string
+}
+
+// Error implements the error interface.
+func (e *BulkError) Error() string {
+	msgs := []string{}
+	for _, opErr := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("#%d: %s", opErr.Index, opErr.Message))
+	}
+	msgs = append(msgs, e.WriteConcernErrors...)
+	return fmt.Sprintf("bulk write: %d errors: %s", len(msgs), strings.Join(msgs, ", "))
+}
+
+// Bulk returns an ordered bulk write of the collection.
+func (c *Collection) Bulk() *Bulk {
+	return &Bulk{col: c, ordered: true}
+}
+
+// Unordered makes the operations run in any order, an operation failure
+// doesn't stop the others.
+func (b *Bulk) Unordered() *Bulk {
+	b.ordered = false
+	return b
+}
+
+// Len returns the number of operations.
+func (b *Bulk) Len() int {
+	return len(b.models)
+}
+
+// add adds model, the operation is the one of its audit entries.
+func (b *Bulk) add(operation string, model mongo.WriteModel, err error) *Bulk {
+	if err != nil && b.err == nil {
+		b.err = fmt.Errorf("bulk operation #%d: %w", len(b.models), err)
+	}
+	b.models = append(b.models, model)
+	b.operations = append(b.operations, operation)
+	b.sizes = append(b.sizes, modelSize(model))
+	return b
+}
+
+// reset removes the operations.
+func (b *Bulk) reset() {
+	b.models, b.operations, b.sizes = b.models[:0], b.operations[:0], b.sizes[:0]
+}
+
+// modelSize returns the marshalled size of the documents of model.
+func modelSize(model mongo.WriteModel) int {
+	values := []interface{}{}
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		values = append(values, m.Document)
+	case *mongo.UpdateOneModel:
+		values = append(values, m.Filter, m.Update)
+	case *mongo.UpdateManyModel:
+		values = append(values, m.Filter, m.Update)
+	case *mongo.ReplaceOneModel:
+		values = append(values, m.Filter, m.Replacement)
+	case *mongo.DeleteOneModel:
+		values = append(values, m.Filter)
+	case *mongo.DeleteManyModel:
+		values = append(values, m.Filter)
+	}
+
+	size := 0
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		if _, data, err := bson.MarshalValue(value); err == nil {
+			size += len(data)
+		}
+	}
+	return size
+}
+
+// Insert adds the insert of documents.
+func (b *Bulk) Insert(documents ...interface{}) *Bulk {
+	for _, document := range documents {
+		doc, err := b.col.insertDocument(document)
+		b.add(AuditInsert, mongo.NewInsertOneModel().SetDocument(doc), err)
+	}
+	return b
+}
+
+// Update adds the update of the first document matching selector.
+func (b *Bulk) Update(selector interface{}, update interface{}) *Bulk {
+	selector, update, err := b.update(selector, update)
+	return b.add(AuditUpdate, mongo.NewUpdateOneModel().SetFilter(orEmpty(selector)).SetUpdate(update), err)
+}
+
+// UpdateID adds the update of the document with id.
+func (b *Bulk) UpdateID(id interface{}, update interface{}) *Bulk {
+	return b.Update(primitive.M{"_id": id}, update)
+}
+
+// UpdateAll adds the update of the documents matching selector.
+func (b *Bulk) UpdateAll(selector interface{}, update interface{}) *Bulk {
+	selector, update, err := b.update(selector, update)
+	return b.add(AuditUpdate, mongo.NewUpdateManyModel().SetFilter(orEmpty(selector)).SetUpdate(update), err)
+}
+
+// Upsert adds the update of the first document matching selector, inserting
+// one when none matches.
+func (b *Bulk) Upsert(selector interface{}, update interface{}) *Bulk {
+	selector, update, err := b.update(selector, update)
+	return b.add(AuditUpdate, mongo.NewUpdateOneModel().SetFilter(orEmpty(selector)).SetUpdate(update).SetUpsert(true), err)
+}
+
+// Replace adds the replacement of the first document matching selector.
+func (b *Bulk) Replace(selector interface{}, replacement interface{}) *Bulk {
+	selector, err := b.col.encryptFilter(selector)
+	if err != nil {
+		return b.add(AuditUpdate, mongo.NewReplaceOneModel(), err)
+	}
+	doc, err := b.col.insertDocument(replacement)
+	return b.add(AuditUpdate, mongo.NewReplaceOneModel().SetFilter(orEmpty(selector)).SetReplacement(doc), err)
+}
+
+// Remove adds the removal of the first document matching selector, a soft
+// delete for soft delete collections.
+func (b *Bulk) Remove(selector interface{}) *Bulk {
+	selector, err := b.col.encryptFilter(selector)
+	if err != nil {
+		return b.add(AuditRemove, mongo.NewDeleteOneModel(), err)
+	}
+	if b.col.SoftDelete {
+		update, err := b.col.updateDocument(softDeleteUpdate())
+		return b.add(AuditRemove, mongo.NewUpdateOneModel().SetFilter(b.col.notDeleted(selector)).SetUpdate(update), err)
+	}
+	return b.add(AuditRemove, mongo.NewDeleteOneModel().SetFilter(orEmpty(selector)), nil)
+}
+
+// RemoveID adds the removal of the document with id.
+func (b *Bulk) RemoveID(id interface{}) *Bulk {
+	return b.Remove(primitive.M{"_id": id})
+}
+
+// RemoveAll adds the removal of the documents matching selector.
+func (b *Bulk) RemoveAll(selector interface{}) *Bulk {
+	selector, err := b.col.encryptFilter(selector)
+	if err != nil {
+		return b.add(AuditRemove, mongo.NewDeleteManyModel(), err)
+	}
+	if b.col.SoftDelete {
+		update, err := b.col.updateDocument(softDeleteUpdate())
+		return b.add(AuditRemove, mongo.NewUpdateManyModel().SetFilter(b.col.notDeleted(selector)).SetUpdate(update), err)
+	}
+	return b.add(AuditRemove, mongo.NewDeleteManyModel().SetFilter(orEmpty(selector)), nil)
+}
+
+// update returns the selector and update of an update operation.
+func (b *Bulk) update(selector interface{}, update interface{}) (interface{}, interface{}, error) {
+	selector, err := b.col.encryptFilter(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	update, err = b.col.updateDocument(update)
+	return selector, update, err
+}
+
+func orEmpty(selector interface{}) interface{} {
+	if selector == nil {
+		return primitive.D{}
+	}
+	return selector
+}
+
+func (b *Bulk) chunkSize() int {
+	if b.ChunkSize > 0 {
+		return b.ChunkSize
+	}
+	return BulkChunkSize
+}
+
+func (b *Bulk) chunkBytes() int {
+	if b.ChunkBytes > 0 {
+		return b.ChunkBytes
+	}
+	return BulkChunkBytes
+}
+
+// chunkEnd returns the end of the chunk of operations starting at offset.
+func (b *Bulk) chunkEnd(offset int) int {
+	size, budget := b.chunkSize(), b.chunkBytes()
+	end, bytes := offset, 0
+	for end < len(b.models) && end-offset < size {
+		if end > offset && bytes+b.sizes[end] > budget {
+			break
+		}
+		bytes += b.sizes[end]
+		end++
+	}
+	return end
+}
+
+// pending returns the marshalled size of the operations.
+func (b *Bulk) pending() int {
+	bytes := 0
+	for _, size := range b.sizes {
+		bytes += size
+	}
+	return bytes
+}
+
+// Run runs the operations. The failed operations are reported in a
+// *BulkError, with the result of the others.
+func (b *Bulk) Run(ctx context.Context) (*BulkResult, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	result := &BulkResult{UpsertedIDs: map[int]interface{}{}}
+	bulkErr := &BulkError{}
+
+	for offset, end := 0, 0; offset < len(b.models); offset = end {
+		end = b.chunkEnd(offset)
+		if err := b.runChunk(ctx, b.models[offset:end], offset, result, bulkErr); err != nil {
+			return result, err
+		}
+		if b.ordered && len(bulkErr.Errors) > 0 {
+			break
+		}
+	}
+
+	if len(bulkErr.Errors) > 0 || len(bulkErr.WriteConcernErrors) > 0 {
+		return result, bulkErr
+	}
+	return result, nil
+}
+
+func (b *Bulk) runChunk(ctx context.Context, models []mongo.WriteModel, offset int, result *BulkResult, bulkErr *BulkError) error {
+	models, err := b.scopeModels(ctx, models)
+	if err != nil {
+		return err
+	}
+	if b.col.Audit {
+		return b.runAudited(ctx, models, offset, result, bulkErr)
+	}
+	return b.write(ctx, models, offset, result, bulkErr)
+}
+
+// errBulkOp tells audited that the operation failed, it is reported in the
+// *BulkError.
+var errBulkOp = errors.New("bulk operation failed")
+
+// runAudited runs the models one at a time, recording their changes.
+func (b *Bulk) runAudited(ctx context.Context, models []mongo.WriteModel, offset int, result *BulkResult, bulkErr *BulkError) error {
+	for i, model := range models {
+		index, failed := offset+i, len(bulkErr.Errors)
+		if insert, ok := model.(*mongo.InsertOneModel); ok {
+			cm, id, err := insertWithID(insert)
+			if err != nil {
+				return err
+			}
+			if err := b.write(ctx, []mongo.WriteModel{cm}, index, result, bulkErr); err != nil {
+				return err
+			}
+			if len(bulkErr.Errors) == failed {
+				b.col.auditInserts(ctx, []interface{}{cm.Document}, []interface{}{id})
+			}
+		} else {
+			filter, many := modelFilter(model)
+			err := b.col.audited(ctx, b.operations[index], filter, many, func(selector interface{}) (interface{}, error) {
+				if err := b.write(ctx, []mongo.WriteModel{withFilter(model, selector)}, index, result, bulkErr); err != nil {
+					return nil, err
+				}
+				if len(bulkErr.Errors) > failed {
+					return nil, errBulkOp
+				}
+				return result.UpsertedIDs[index], nil
+			})
+			if err != nil && !errors.Is(err, errBulkOp) {
+				return err
+			}
+		}
+		if b.ordered && len(bulkErr.Errors) > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// insertWithID returns a copy of the insert model whose document has an _id.
+func insertWithID(m *mongo.InsertOneModel) (*mongo.InsertOneModel, interface{}, error) {
+	doc, err := toD(m.Document)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id, ok := doc.Map()["_id"]; ok {
+		return m, id, nil
+	}
+	id := primitive.NewObjectID()
+	cm := *m
+	cm.Document = append(primitive.D{{Key: "_id", Value: id}}, doc...)
+	return &cm, id, nil
+}
+
+// modelFilter returns the filter of model and whether it writes many
+// documents.
+func modelFilter(model mongo.WriteModel) (interface{}, bool) {
+	switch m := model.(type) {
+	case *mongo.UpdateOneModel:
+		return m.Filter, false
+	case *mongo.UpdateManyModel:
+		return m.Filter, true
+	case *mongo.ReplaceOneModel:
+		return m.Filter, false
+	case *mongo.DeleteOneModel:
+		return m.Filter, false
+	case *mongo.DeleteManyModel:
+		return m.Filter, true
+	}
+	return nil, false
+}
+
+// withFilter returns a copy of model with filter.
+func withFilter(model mongo.WriteModel, filter interface{}) mongo.WriteModel {
+	switch m := model.(type) {
+	case *mongo.UpdateOneModel:
+		cm := *m
+		cm.Filter = filter
+		return &cm
+	case *mongo.UpdateManyModel:
+		cm := *m
+		cm.Filter = filter
+		return &cm
+	case *mongo.ReplaceOneModel:
+		cm := *m
+		cm.Filter = filter
+		return &cm
+	case *mongo.DeleteOneModel:
+		cm := *m
+		cm.Filter = filter
+		return &cm
+	case *mongo.DeleteManyModel:
+		cm := *m
+		cm.Filter = filter
+		return &cm
+	}
+	return model
+}
+
+// write runs the models in one bulk write.
+func (b *Bulk) write(ctx context.Context, models []mongo.WriteModel, offset int, result *BulkResult, bulkErr *BulkError) error {
+	opts := options.BulkWrite().SetOrdered(b.ordered)
+	r, err := b.col.BulkWrite(ctx, models, opts)
+
+	if r != nil {
+		result.Inserted += r.InsertedCount
+		result.Matched += r.MatchedCount
+		result.Modified += r.ModifiedCount
+		result.Deleted += r.DeletedCount
+		result.Upserted += r.UpsertedCount
+		for i, id := range r.UpsertedIDs {
+			result.UpsertedIDs[offset+int(i)] = id
+		}
+	}
+
+	var bwe mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bwe) {
+		return err
+	}
+	for _, we := range bwe.WriteErrors {
+		bulkErr.Errors = append(bulkErr.Errors, BulkOpError{Index: offset + we.Index, Code: we.Code, Message: we.Message})
+	}
+	if bwe.WriteConcernError != nil {
+		bulkErr.WriteConcernErrors = append(bulkErr.WriteConcernErrors, bwe.WriteConcernError.Message)
+	}
+	return nil
+}
+
+// scopeModels returns copies of the models scoped to the tenant of ctx.
+func (b *Bulk) scopeModels(ctx context.Context, models []mongo.WriteModel) ([]mongo.WriteModel, error) {
+	tenant, err := b.col.tenant(ctx)
+	if err != nil || tenant == nil {
+		return models, err
+	}
+
+	scoped := make([]mongo.WriteModel, 0, len(models))
+	for _, model := range models {
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			cm := *m
+			cm.Document, err = b.col.scopeDocument(ctx, m.Document)
+			model = &cm
+		case *mongo.UpdateOneModel:
+			cm := *m
+			if cm.Filter, err = b.col.scope(ctx, m.Filter); err == nil {
+				cm.Update, err = b.col.scopeUpdate(ctx, m.Update)
+			}
+			model = &cm
+		case *mongo.UpdateManyModel:
+			cm := *m
+			if cm.Filter, err = b.col.scope(ctx, m.Filter); err == nil {
+				cm.Update, err = b.col.scopeUpdate(ctx, m.Update)
+			}
+			model = &cm
+		case *mongo.ReplaceOneModel:
+			cm := *m
+			if cm.Filter, err = b.col.scope(ctx, m.Filter); err == nil {
+				cm.Replacement, err = b.col.scopeDocument(ctx, m.Replacement)
+			}
+			model = &cm
+		case *mongo.DeleteOneModel:
+			cm := *m
+			cm.Filter, err = b.col.scope(ctx, m.Filter)
+			model = &cm
+		case *mongo.DeleteManyModel:
+			cm := *m
+			cm.Filter, err = b.col.scope(ctx, m.Filter)
+			model = &cm
+		}
+		if err != nil {
+			return nil, err
+		}
+		scoped = append(scoped, model)
+	}
+	return scoped, nil
+}
+
+// ImportJSONLines inserts the documents read from r, one extended JSON object
+// per line, in bulk writes of BulkChunkSize documents or about BulkChunkBytes.
+// Empty lines are skipped. The index of the failed lines, counted from 0, are
+// reported in a *BulkError; in ordered mode the import stops at the first
+// failure.
+func (c *Collection) ImportJSONLines(ctx context.Context, r io.Reader, ordered bool) (*BulkResult, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	result := &BulkResult{UpsertedIDs: map[int]interface{}{}}
+	bulkErr := &BulkError{}
+
+	bulk := &Bulk{col: c, ordered: ordered}
+	lines := []int{}
+	flush := func() error {
+		if bulk.Len() == 0 {
+			return nil
+		}
+		if bulk.err != nil {
+			return bulk.err
+		}
+
+		chunkErr := &BulkError{}
+		if err := bulk.runChunk(ctx, bulk.models, 0, result, chunkErr); err != nil {
+			return err
+		}
+		// map the operation indexes back to the lines
+		for _, opErr := range chunkErr.Errors {
+			opErr.Index = lines[opErr.Index]
+			bulkErr.Errors = append(bulkErr.Errors, opErr)
+		}
+		bulkErr.WriteConcernErrors = append(bulkErr.WriteConcernErrors, chunkErr.WriteConcernErrors...)
+
+		bulk.reset()
+		lines = lines[:0]
+		return nil
+	}
+
+	for line := 0; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		doc := primitive.D{}
+		if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+			if ordered {
+				// the lines before are written, as an ordered bulk would
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+			bulkErr.Errors = append(bulkErr.Errors, BulkOpError{Index: line, Message: err.Error()})
+			if ordered {
+				break
+			}
+			continue
+		}
+
+		bulk.Insert(doc)
+		lines = append(lines, line)
+		if bulk.Len() >= bulk.chunkSize() || bulk.pending() >= bulk.chunkBytes() {
+			if err := flush(); err != nil {
+				return result, err
+			}
+			if ordered && len(bulkErr.Errors) > 0 {
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	if !ordered || len(bulkErr.Errors) == 0 {
+		if err := flush(); err != nil {
+			return result, err
+		}
+	}
+
+	if len(bulkErr.Errors) > 0 || len(bulkErr.WriteConcernErrors) > 0 {
+		return result, bulkErr
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestBulkModels(t *testing.T) {
+	b := (&Collection{SoftDelete: true}).Bulk().
+		Insert(primitive.M{"name": "a"}, primitive.M{"name": "b"}).
+		UpdateID(1, primitive.M{"$set": primitive.M{"name": "c"}}).
+		RemoveID(2)
+
+	if b.Len() != 4 {
+		t.Fatalf("Unexpected length: %+v, expected %+v", b.Len(), 4)
+	}
+	if _, ok := b.models[3].(*mongo.UpdateOneModel); !ok {
+		t.Errorf("Unexpected soft delete model: %T, expected *mongo.UpdateOneModel", b.models[3])
+	}
+
+	b = (&Collection{}).Bulk().Insert("not a document")
+	if _, err := b.Run(context.Background()); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an error", err)
+	}
+}
+
+func TestImportJSONLinesParseErrors(t *testing.T) {
+	c := &Collection{}
+	input := "\nnot json\n{\"name\": \n"
+
+	_, err := c.ImportJSONLines(context.Background(), strings.NewReader(input), false)
+	var bulkErr *BulkError
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("Unexpected error: %+v, expected a *BulkError", err)
+	}
+	if len(bulkErr.Errors) != 2 || bulkErr.Errors[0].Index != 1 || bulkErr.Errors[1].Index != 2 {
+		t.Errorf("Unexpected errors: %+v", bulkErr.Errors)
+	}
+
+	_, err = c.ImportJSONLines(context.Background(), strings.NewReader(input), true)
+	if !errors.As(err, &bulkErr) || len(bulkErr.Errors) != 1 {
+		t.Errorf("Unexpected error: %+v, expected one error", err)
+	}
+}
+
+func TestBulkChunks(t *testing.T) {
+	b := (&Collection{}).Bulk().
+		Insert(primitive.M{"name": strings.Repeat("a", 100)}).
+		Insert(primitive.M{"name": strings.Repeat("b", 100)}).
+		Insert(primitive.M{"name": "c"}, primitive.M{"name": "d"})
+	b.ChunkBytes = 150
+
+	// the first documents are alone over the budget, the last share a chunk
+	ends := []int{}
+	for offset, end := 0, 0; offset < b.Len(); offset = end {
+		end = b.chunkEnd(offset)
+		ends = append(ends, end)
+	}
+	if len(ends) != 3 || ends[0] != 1 || ends[1] != 2 || ends[2] != 4 {
+		t.Errorf("Unexpected chunk ends: %+v, expected %+v", ends, []int{1, 2, 4})
+	}
+
+	b.ChunkSize = 1
+	if end := b.chunkEnd(2); end != 3 {
+		t.Errorf("Unexpected chunk end: %+v, expected %+v", end, 3)
+	}
+}
+
+func TestBulkAudited(t *testing.T) {
+	useKeys(t, "k1")
+	m := NewMemory()
+	c := Col(m.DB(), "profiles").WithAudit()
+	ctx := context.Background()
+
+	_, err := c.Bulk().
+		Insert(primitive.M{"_id": 1, "city": "Oslo"}, primitive.M{"_id": 2, "city": "Bergen"}).
+		UpdateID(1, primitive.D{{Key: "$set", Value: secureProfile{Phone: "555", City: "Oslo"}}}).
+		RemoveID(2).
+		Run(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	if raw := m.collections["profiles"][0].Map(); !isEncrypted(raw["phone"]) {
+		t.Errorf("Unexpected phone: %+v, expected an encrypted value", raw["phone"])
+	}
+	entries, err := FindAudit(ctx, m.DB(), AuditQuery{Collection: "profiles"})
+	if err != nil || len(entries) != 4 || entries[0].Operation != AuditRemove || entries[1].Operation != AuditUpdate {
+		t.Errorf("Unexpected audit entries: %+v (%+v)", entries, err)
+	}
+}
@@ -2,82 +2,420 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/vavas/go_services/logger"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"go.uber.org/zap"
 )
 
-// Session mongo session
+// Client is a mongo client together with the name of its database. Several
+// Client can be used in one process; the package level functions use the
+// Default one.
 type Client struct {
-	client     *mongo.Client
-	collection *mongo.Collection
-	filter     interface{}
-	fOpts      *options.FindOptions
+	// Logger is used for connection logs. When nil logger.Logger is used.
+	Logger *zap.Logger
+
+	client   *mongo.Client
+	database string
+	// settings of the collections of the client, see Config.
+	timeout            time.Duration
+	slowQueryThreshold time.Duration
+	explainSlowQueries bool
+	keys               *KeyRing
+	// memory is the in-memory database of the client, see Memory.Client.
+	memory *Memory
 }
 
-var client *mongo.Client
+var defaultClient = &Client{}
+
+// ErrNotConnected is returned by the Client methods needing a connection when
+// the client is not connected.
+var ErrNotConnected = errors.New("mongo client is not connected")
+
+// ErrAlreadyConnected is returned when connecting a connected client, it must
+// be disconnected first.
+var ErrAlreadyConnected = errors.New("mongo client is already connected")
+
+// clients maps the connected mongo clients to their Client, so Col applies
+// the settings of the client of its database.
+var clients sync.Map
+
+func clientOf(dbc *mongo.Database) *Client {
+	if dbc == nil {
+		return nil
+	}
+	if c, ok := clients.Load(dbc.Client()); ok {
+		return c.(*Client)
+	}
+	return nil
+}
 
-// Database name.
-var database string
+// Default returns the Client used by the package level functions.
+func Default() *Client {
+	return defaultClient
+}
 
 // Config structure.
 type Config struct {
 	URL string
 	DB  string
+
+	// Timeout of the Collection methods without a context, for the
+	// collections of the client. DefaultTimeout is used when zero.
+	Timeout time.Duration
+
+	// AppName is sent to the server in the connection handshake.
+	AppName string
+	// ReadPreference is a read preference mode, e.g. "secondaryPreferred".
+	// The URL one is kept when empty.
+	ReadPreference string
+	// WriteConcern is "majority" or the number of nodes acknowledging the
+	// writes. The URL one is kept when empty.
+	WriteConcern string
+	MaxPoolSize  uint64
+	MinPoolSize  uint64
+
+	// MaxAttempts of ConnectConfig, DefaultMaxAttempts when zero. It retries
+	// until connected or the ConnectContext context is done when negative.
+	MaxAttempts int
+	// ConnectTimeout of each attempt, DefaultConnectTimeout when zero.
+	ConnectTimeout time.Duration
+	// RetryWait is the wait after the first failed attempt, doubled after
+	// each next one up to MaxRetryWait. DefaultRetryWait and
+	// DefaultMaxRetryWait are used when zero.
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration
+	// PingReadPreference is the read preference mode the connection is
+	// verified with, e.g. "primary" to wait for a writable server. The client
+	// read preference is used when empty.
+	PingReadPreference string
+
+	// SlowQueryThreshold of the collections of the client, the package one
+	// is used when zero. ExplainSlowQueries explains their slow finds.
+	SlowQueryThreshold time.Duration
+	ExplainSlowQueries bool
+
+	// EncryptionKeys of the collections of the client in the ParseKeyRing
+	// format, the package ones are used when empty.
+	EncryptionKeys string
 }
 
-// Connect mongo client
-func Connect(db string, url string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Connection retry defaults, used when the Config ones are zero.
+var (
+	DefaultMaxAttempts    = 10
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultRetryWait      = time.Second
+	DefaultMaxRetryWait   = 30 * time.Second
+)
+
+func (conf *Config) maxAttempts() int {
+	if conf.MaxAttempts != 0 {
+		return conf.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (conf *Config) connectTimeout() time.Duration {
+	if conf.ConnectTimeout > 0 {
+		return conf.ConnectTimeout
+	}
+	return DefaultConnectTimeout
+}
+
+// retryWait returns the wait after a failed attempt, starting at 1.
+func (conf *Config) retryWait(attempt int) time.Duration {
+	wait, max := conf.RetryWait, conf.MaxRetryWait
+	if wait <= 0 {
+		wait = DefaultRetryWait
+	}
+	if max <= 0 {
+		max = DefaultMaxRetryWait
+	}
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
 
-	database = db
-	opt := options.Client().ApplyURI(url)
+func readPref(mode string) (*readpref.ReadPref, error) {
+	m, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+	return readpref.New(m)
+}
 
-	for {
-		client, _ = mongo.NewClient(opt)
-		err := client.Connect(ctx)
+// ClientOptions returns the mongo client options of the config.
+func (conf *Config) ClientOptions() (*options.ClientOptions, error) {
+	if len(conf.URL) == 0 {
+		return nil, errors.New("mongo URL is required")
+	}
+	opt := options.Client().ApplyURI(conf.URL)
+
+	if len(conf.AppName) > 0 {
+		opt.SetAppName(conf.AppName)
+	}
+	if len(conf.ReadPreference) > 0 {
+		rp, err := readPref(conf.ReadPreference)
 		if err != nil {
-			logger.Logger.Warn("MongoDB Connection Error (retrying in 5sec)",
-				zap.NamedError("error", err),
-			)
-			time.Sleep(10 * time.Second)
+			return nil, err
+		}
+		opt.SetReadPreference(rp)
+	}
+	if len(conf.WriteConcern) > 0 {
+		if conf.WriteConcern == "majority" {
+			opt.SetWriteConcern(writeconcern.Majority())
+		} else if w, err := strconv.Atoi(conf.WriteConcern); err == nil && w >= 0 {
+			opt.SetWriteConcern(&writeconcern.WriteConcern{W: w})
 		} else {
-			logger.Logger.Debug("MongoDB Connected",
-				zap.String("url", url),
-				zap.String("database", database),
+			return nil, fmt.Errorf(`"%s" is not a valid write concern`, conf.WriteConcern)
+		}
+	}
+	if conf.MaxPoolSize > 0 {
+		opt.SetMaxPoolSize(conf.MaxPoolSize)
+	}
+	if conf.MinPoolSize > 0 {
+		opt.SetMinPoolSize(conf.MinPoolSize)
+	}
+
+	return opt, opt.Validate()
+}
+
+func (c *Client) logger() *zap.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logger.Logger
+}
+
+// Connect connects the mongo client to url, with up to DefaultMaxAttempts
+// attempts, see ConnectConfig.
+func (c *Client) Connect(db string, url string) error {
+	return c.ConnectConfig(&Config{URL: url, DB: db})
+}
+
+// ConnectConfig connects the mongo client using conf, see ConnectContext.
+func (c *Client) ConnectConfig(conf *Config) error {
+	return c.ConnectContext(context.Background(), conf)
+}
+
+// ConnectContext connects the mongo client using conf. Each attempt is
+// verified with a Ping and the failed ones are retried with an exponential
+// backoff, up to conf.MaxAttempts or until ctx is done. The last error is
+// returned, or the conf one when it is invalid. ErrAlreadyConnected is
+// returned when the client is connected.
+func (c *Client) ConnectContext(ctx context.Context, conf *Config) error {
+	if c.HasClient() {
+		return ErrAlreadyConnected
+	}
+	opt, err := conf.ClientOptions()
+	if err != nil {
+		return err
+	}
+	var rp *readpref.ReadPref
+	if len(conf.PingReadPreference) > 0 {
+		if rp, err = readPref(conf.PingReadPreference); err != nil {
+			return err
+		}
+	}
+
+	var keys *KeyRing
+	if len(conf.EncryptionKeys) > 0 {
+		if keys, err = ParseKeyRing(conf.EncryptionKeys); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		client, err := dial(ctx, opt, rp, conf.connectTimeout())
+		if err == nil {
+			c.client = client
+			c.database = conf.DB
+			c.timeout = conf.Timeout
+			c.slowQueryThreshold = conf.SlowQueryThreshold
+			c.explainSlowQueries = conf.ExplainSlowQueries
+			c.keys = keys
+			clients.Store(client, c)
+			c.logger().Debug("MongoDB Connected",
+				zap.String("url", conf.URL),
+				zap.String("database", c.database),
+				zap.Int("attempt", attempt),
 			)
-			break
+			return nil
+		}
+
+		if attempts := conf.maxAttempts(); attempts > 0 && attempt >= attempts {
+			return fmt.Errorf("MongoDB connection failed after %d attempts: %w", attempt, err)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("MongoDB connection cancelled after %d attempts: %w", attempt, ctx.Err())
+		}
+		wait := conf.retryWait(attempt)
+		c.logger().Warn("MongoDB Connection Error",
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", wait),
+			zap.NamedError("error", err),
+		)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("MongoDB connection cancelled after %d attempts: %w", attempt, ctx.Err())
+		case <-timer.C:
 		}
 	}
 }
 
+// dial connects a new mongo client and pings it with rp, the client read
+// preference when nil.
+func dial(ctx context.Context, opt *options.ClientOptions, rp *readpref.ReadPref, timeout time.Duration) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, rp); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Disconnect closes the connections of the client, waiting at most the client
+// timeout for the operations in progress.
+func (c *Client) Disconnect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.collectionTimeout())
+	defer cancel()
+	return c.DisconnectContext(ctx)
+}
+
+// DisconnectContext closes the connections of the client.
+func (c *Client) DisconnectContext(ctx context.Context) error {
+	if !c.HasClient() {
+		return nil
+	}
+	clients.Delete(c.client)
+	err := c.client.Disconnect(ctx)
+	c.client = nil
+	return err
+}
+
+func (c *Client) collectionTimeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return DefaultTimeout
+}
+
+// configure applies the settings of the client to one of its collections.
+func (c *Client) configure(col *Collection) {
+	col.Timeout = c.collectionTimeout()
+	col.slowQueryThreshold = c.slowQueryThreshold
+	col.explainSlowQueries = c.explainSlowQueries
+	col.keys = c.keys
+	col.log = c.Logger
+}
+
+// Col returns a collection of the database of the client.
+func (c *Client) Col(name string) *Collection {
+	return Col(c.DB(), name)
+}
+
+// Ping verifies that the client can connect to the topology.
+func (c *Client) Ping() error {
+	return c.client.Ping(context.Background(), readpref.Primary())
+}
+
+// PingContext verifies that the client can reach a server matching rp, the
+// client read preference when nil.
+func (c *Client) PingContext(ctx context.Context, rp *readpref.ReadPref) error {
+	return c.client.Ping(ctx, rp)
+}
+
+// DB returns a value representing the named database.
+func (c *Client) DB() *mongo.Database {
+	return c.client.Database(c.database)
+}
+
+// Database returns another database of the client's cluster.
+func (c *Client) Database(name string) *mongo.Database {
+	return c.client.Database(name)
+}
+
+// HasClient returns true if client is not nil.
+func (c *Client) HasClient() bool {
+	return c != nil && c.client != nil
+}
+
+// Client returns the underlying mongo client.
+func (c *Client) Client() *mongo.Client {
+	return c.client
+}
+
+// Connect connects the mongo client to url, with up to DefaultMaxAttempts
+// attempts, see ConnectConfig.
+func Connect(db string, url string) error {
+	return defaultClient.Connect(db, url)
+}
+
+// ConnectConfig connects the mongo client using conf, retrying the failed
+// attempts up to conf.MaxAttempts.
+func ConnectConfig(conf *Config) error {
+	return defaultClient.ConnectConfig(conf)
+}
+
+// ConnectContext connects the mongo client using conf, retrying the failed
+// attempts up to conf.MaxAttempts or until ctx is done.
+func ConnectContext(ctx context.Context, conf *Config) error {
+	return defaultClient.ConnectContext(ctx, conf)
+}
+
+// Disconnect closes the connections of the mongo client.
+func Disconnect() error {
+	return defaultClient.Disconnect()
+}
+
 // Ping verifies that the client can connect to the topology.
 // If readPreference is nil then will use the client's default read
 // preference.
 func Ping() error {
-	return client.Ping(context.Background(), readpref.Primary())
+	return defaultClient.Ping()
 }
 
 // DB returns a value representing the named database.
 func DB() *mongo.Database {
-	return client.Database(database)
+	return defaultClient.DB()
 }
 
 // HasClient returns true if client is not nil.
 func HasClient() bool {
-	return client != nil
+	return defaultClient.HasClient()
+}
+
+// MongoClient returns the underlying mongo client, e.g. to start sessions.
+func MongoClient() *mongo.Client {
+	return defaultClient.Client()
 }
 
 // ------------------------------------------------------------------------------------------------------------------ //
 
 //TestConnect returns a test DB
-func TestConnect() {
+func TestConnect() error {
 	port := os.Getenv("MONGODB_PORT")
 	if len(port) == 0 {
 		port = "27017"
@@ -86,5 +424,9 @@ func TestConnect() {
 	// Init logging
 	logger.InitLogging("db_testing")
 
-	Connect("testing", "mongodb://127.0.0.1:" + port)
+	return ConnectConfig(&Config{
+		URL:         "mongodb://127.0.0.1:" + port,
+		DB:          "testing",
+		MaxAttempts: 3,
+	})
 }
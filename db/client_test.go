@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+func TestConfigRetryWait(t *testing.T) {
+	conf := &Config{RetryWait: 100 * time.Millisecond, MaxRetryWait: time.Second}
+	for attempt, expected := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		50: time.Second,
+	} {
+		if wait := conf.retryWait(attempt); wait != expected {
+			t.Errorf("Unexpected wait of attempt %d: %+v, expected %+v", attempt, wait, expected)
+		}
+	}
+
+	conf = &Config{}
+	if wait := conf.retryWait(1); wait != DefaultRetryWait {
+		t.Errorf("Unexpected default wait: %+v, expected %+v", wait, DefaultRetryWait)
+	}
+	if wait := conf.retryWait(100); wait != DefaultMaxRetryWait {
+		t.Errorf("Unexpected default max wait: %+v, expected %+v", wait, DefaultMaxRetryWait)
+	}
+}
+
+func TestConnectMaxAttempts(t *testing.T) {
+	c := &Client{Logger: zap.NewNop()}
+	start := time.Now()
+	err := c.ConnectConfig(&Config{
+		URL:            "mongodb://127.0.0.1:1/?connect=direct",
+		DB:             "testing",
+		MaxAttempts:    3,
+		ConnectTimeout: 50 * time.Millisecond,
+		RetryWait:      10 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("Unexpected connection to a closed port")
+	}
+	if c.HasClient() {
+		t.Errorf("Unexpected client after a failed connection")
+	}
+	// 3 attempts and 2 waits of 10ms & 20ms
+	if elapsed := time.Since(start); elapsed < 3*50*time.Millisecond+30*time.Millisecond {
+		t.Errorf("Unexpected connection time: %+v", elapsed)
+	}
+
+	if err := c.ConnectConfig(&Config{URL: "mongodb://127.0.0.1", PingReadPreference: "any"}); err == nil {
+		t.Errorf("Unexpected connection with an invalid ping read preference")
+	}
+	if err := c.Disconnect(); err != nil {
+		t.Errorf("Unexpected error disconnecting an unconnected client: %+v", err)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	c := &Client{Logger: zap.NewNop()}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := c.ConnectContext(ctx, &Config{
+		URL:            "mongodb://127.0.0.1:1/?connect=direct",
+		DB:             "testing",
+		MaxAttempts:    -1,
+		ConnectTimeout: 50 * time.Millisecond,
+		RetryWait:      time.Minute,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unexpected connection time: %+v, expected the context timeout", elapsed)
+	}
+
+	if err := unconnectedClient(t, "testing").ConnectConfig(&Config{URL: "mongodb://127.0.0.1"}); !errors.Is(err, ErrAlreadyConnected) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrAlreadyConnected)
+	}
+	if attempts := (&Config{}).maxAttempts(); attempts != DefaultMaxAttempts {
+		t.Errorf("Unexpected default attempts: %+v, expected %+v", attempts, DefaultMaxAttempts)
+	}
+}
+
+// unconnectedClient returns a Client registered like a connected one, with a
+// mongo client that never connects.
+func unconnectedClient(t *testing.T, database string) *Client {
+	mc, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	c := &Client{client: mc, database: database}
+	clients.Store(mc, c)
+	t.Cleanup(func() { clients.Delete(mc) })
+	return c
+}
+
+func TestClientTimeout(t *testing.T) {
+	analytics := unconnectedClient(t, "events")
+	analytics.timeout = time.Minute
+	other := unconnectedClient(t, "users")
+
+	if timeout := analytics.Col("events").Timeout; timeout != time.Minute {
+		t.Errorf("Unexpected timeout: %+v, expected %+v", timeout, time.Minute)
+	}
+	if timeout := Col(analytics.Database("other"), "events").Timeout; timeout != time.Minute {
+		t.Errorf("Unexpected timeout of another database: %+v, expected %+v", timeout, time.Minute)
+	}
+	if timeout := other.Col("users").Timeout; timeout != DefaultTimeout {
+		t.Errorf("Unexpected timeout: %+v, expected %+v", timeout, DefaultTimeout)
+	}
+}
@@ -5,34 +5,110 @@ import (
 	"reflect"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/logger"
 )
 
+// DefaultTimeout is the timeout of the Collection methods without a context,
+// for the clients without Config.Timeout.
+var DefaultTimeout = 10 * time.Second
+
 // Collection mongo-driver collection
 type Collection struct {
 	*mongo.Collection
+
+	// Timeout is used by the methods that don't take a context.
+	Timeout time.Duration
+	// NoTimestamps disables the created_at & updated_at fields set by the
+	// write methods, see WithoutTimestamps.
+	NoTimestamps bool
+	// SoftDelete turns the removes into setting deleted_at, see WithSoftDelete.
+	SoftDelete bool
+	// Audit records the writes in the audit collection, see WithAudit.
+	Audit bool
+	// TenantScoped restricts the queries to the tenant of their context, see
+	// WithTenantScope.
+	TenantScoped bool
+
+	withDeleted bool
+	memory      *memoryCollection
+	// slow query settings of the Client of the collection, see profile.
+	slowQueryThreshold time.Duration
+	explainSlowQueries bool
+	// secure are the encrypted fields of the filters and updates, see
+	// WithEncryption, and keys the key ring of the Client, see WithKeys.
+	secure secureFields
+	keys   *KeyRing
+	// log is the logger of the Client of the collection, see logger.
+	log *zap.Logger
 }
 
-// Col returns the collection.
+// Col returns the collection, of the in-memory database when dbc is the one
+// of a Memory, see Memory.DB. The collection has the settings of the Client
+// of dbc, e.g. its timeout.
 func Col(dbc *mongo.Database, name string) *Collection {
-	return &Collection{dbc.Collection(name)}
+	c := clientOf(dbc)
+	if c != nil && c.memory != nil {
+		col := c.memory.Col(name)
+		col.log = c.Logger
+		return col
+	}
+	col := &Collection{Collection: dbc.Collection(name), Timeout: DefaultTimeout}
+	if c != nil {
+		c.configure(col)
+	}
+	return col
+}
+
+// WithTimeout returns a copy of the collection using timeout for the methods
+// that don't take a context.
+func (c *Collection) WithTimeout(timeout time.Duration) *Collection {
+	col := *c
+	col.Timeout = timeout
+	return &col
+}
+
+// logger returns the logger of the Client of the collection, logger.Logger
+// when it has none.
+func (c *Collection) logger() *zap.Logger {
+	if c.log != nil {
+		return c.log
+	}
+	return logger.Logger
+}
+
+func (c *Collection) context() (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
 }
 
 // All returns all results from the cursor
 func (c *Collection) All(filter interface{}, opts *options.FindOptions, result interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
+	return c.AllContext(ctx, filter, opts, result)
+}
 
-	cur, err := c.Find(ctx, filter, opts)
-	defer cur.Close(ctx)
+// AllContext returns all results from the cursor
+func (c *Collection) AllContext(ctx context.Context, filter interface{}, opts *options.FindOptions, result interface{}) error {
+	filter, err := c.readFilter(ctx, filter)
 	if err != nil {
 		return err
 	}
-	if err = cur.Err(); err != nil {
+
+	cur, err := c.Find(ctx, filter, opts)
+	if err != nil {
 		return err
 	}
+	defer cur.Close(ctx)
 
 	resultv := reflect.ValueOf(result)
 	slicev := resultv.Elem()
@@ -43,61 +119,118 @@ func (c *Collection) All(filter interface{}, opts *options.FindOptions, result i
 	elemt := slicev.Type().Elem()
 	i := 0
 
-	for {
+	for cur.Next(ctx) {
 		elemp := reflect.New(elemt)
-		if !cur.Next(nil) {
-			break
-		}
-		err := cur.Decode(elemp.Interface())
-		if err != nil {
+		if err := decodeRaw(c.keyRing(), cur.Current, elemp.Interface()); err != nil {
 			return err
 		}
 		slicev = reflect.Append(slicev, elemp.Elem())
 		i++
 	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
 	resultv.Elem().Set(slicev.Slice(0, i))
 	return nil
 }
 
 // One returns one result from the cursor
 func (c *Collection) One(filter interface{}, opts *options.FindOneOptions, result interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.OneContext(ctx, filter, opts, result)
+}
+
+// OneContext returns one result from the cursor
+func (c *Collection) OneContext(ctx context.Context, filter interface{}, opts *options.FindOneOptions, result interface{}) error {
 	if opts == nil {
 		opts = options.FindOne()
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	filter, err := c.readFilter(ctx, filter)
+	if err != nil {
+		return err
+	}
 
-	if err := c.FindOne(ctx, filter, opts).Decode(result); err != nil {
+	raw, err := c.FindOne(ctx, filter, opts).Raw()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return decodeRaw(c.keyRing(), raw, result)
 }
 
 // Insert inserts a single document into the collection and returns insert one result.
 func (c *Collection) Insert(document interface{}) (result *mongo.InsertOneResult, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	result, err = c.InsertOne(ctx, document)
+	return c.InsertContext(ctx, document)
+}
+
+// InsertContext inserts a single document into the collection and returns insert one result.
+func (c *Collection) InsertContext(ctx context.Context, document interface{}) (result *mongo.InsertOneResult, err error) {
+	if document, err = c.scopeDocument(ctx, document); err != nil {
+		return nil, err
+	}
+	if document, err = c.insertDocument(document); err != nil {
+		return nil, err
+	}
+	if result, err = c.InsertOne(ctx, document); err != nil {
+		return nil, err
+	}
+	c.auditInserts(ctx, []interface{}{document}, []interface{}{result.InsertedID})
 	return
 }
 
 // InsertAll inserts the provided documents and returns insert many result.
 func (c *Collection) InsertAll(documents []interface{}) (result *mongo.InsertManyResult, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	result, err = c.InsertMany(ctx, documents)
+	return c.InsertAllContext(ctx, documents)
+}
+
+// InsertAllContext inserts the provided documents and returns insert many result.
+func (c *Collection) InsertAllContext(ctx context.Context, documents []interface{}) (result *mongo.InsertManyResult, err error) {
+	scoped := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		doc, err := c.scopeDocument(ctx, document)
+		if err != nil {
+			return nil, err
+		}
+		scoped = append(scoped, doc)
+	}
+	if documents, err = c.insertDocuments(scoped); err != nil {
+		return nil, err
+	}
+	if result, err = c.InsertMany(ctx, documents); err != nil {
+		return nil, err
+	}
+	c.auditInserts(ctx, documents, result.InsertedIDs)
 	return
 }
 
 // Update updates a single document in the collection.
 func (c *Collection) Update(selector interface{}, update interface{}, upsert ...bool) error {
-	if selector == nil {
-		selector = primitive.D{}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.UpdateContext(ctx, selector, update, upsert...)
+}
+
+// UpdateContext updates a single document in the collection.
+func (c *Collection) UpdateContext(ctx context.Context, selector interface{}, update interface{}, upsert ...bool) error {
+	selector, err := c.scope(ctx, selector)
+	if err != nil {
+		return err
 	}
 
-	var err error
+	if update, err = c.scopeUpdate(ctx, update); err != nil {
+		return err
+	}
+	update, err = c.updateDocument(update)
+	if err != nil {
+		return err
+	}
 
 	opt := options.Update()
 	for _, arg := range upsert {
@@ -105,12 +238,13 @@ func (c *Collection) Update(selector interface{}, update interface{}, upsert ...
 			opt.SetUpsert(arg)
 		}
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if _, err = c.UpdateOne(ctx, selector, update, opt); err != nil {
-		return err
-	}
-	return nil
+	return c.audited(ctx, AuditUpdate, selector, false, func(selector interface{}) (interface{}, error) {
+		result, err := c.UpdateOne(ctx, selector, update, opt)
+		if err != nil {
+			return nil, err
+		}
+		return result.UpsertedID, nil
+	})
 }
 
 // UpdateID updates a single document in the collection by id
@@ -118,13 +252,32 @@ func (c *Collection) UpdateID(id interface{}, update interface{}) error {
 	return c.Update(primitive.M{"_id": id}, update)
 }
 
+// UpdateIDContext updates a single document in the collection by id
+func (c *Collection) UpdateIDContext(ctx context.Context, id interface{}, update interface{}) error {
+	return c.UpdateContext(ctx, primitive.M{"_id": id}, update)
+}
+
 // UpdateAll updates multiple documents in the collection.
 func (c *Collection) UpdateAll(selector interface{}, update interface{}, upsert ...bool) (*mongo.UpdateResult, error) {
-	if selector == nil {
-		selector = primitive.D{}
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.UpdateAllContext(ctx, selector, update, upsert...)
+}
+
+// UpdateAllContext updates multiple documents in the collection.
+func (c *Collection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}, upsert ...bool) (*mongo.UpdateResult, error) {
+	selector, err := c.scope(ctx, selector)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
+	if update, err = c.scopeUpdate(ctx, update); err != nil {
+		return nil, err
+	}
+	update, err = c.updateDocument(update)
+	if err != nil {
+		return nil, err
+	}
 
 	opt := options.Update()
 	for _, arg := range upsert {
@@ -133,123 +286,228 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}, upsert
 		}
 	}
 
-	var updateResult *mongo.UpdateResult
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if updateResult, err = c.UpdateMany(ctx, selector, update, opt); err != nil {
-		return updateResult, err
+	// the audited updates run in batches, their results are summed
+	result := &mongo.UpdateResult{}
+	err = c.audited(ctx, AuditUpdate, selector, true, func(selector interface{}) (interface{}, error) {
+		r, err := c.UpdateMany(ctx, selector, update, opt)
+		if err != nil {
+			return nil, err
+		}
+		result.MatchedCount += r.MatchedCount
+		result.ModifiedCount += r.ModifiedCount
+		result.UpsertedCount += r.UpsertedCount
+		if r.UpsertedID != nil {
+			result.UpsertedID = r.UpsertedID
+		}
+		return r.UpsertedID, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return updateResult, nil
+	return result, nil
 }
 
 // Remove deletes a single document from the collection.
 func (c *Collection) Remove(selector interface{}) error {
-	if selector == nil {
-		selector = primitive.D{}
-	}
-	var err error
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	if _, err = c.DeleteOne(ctx, selector); err != nil {
+	return c.RemoveContext(ctx, selector)
+}
+
+// RemoveContext deletes a single document from the collection.
+func (c *Collection) RemoveContext(ctx context.Context, selector interface{}) error {
+	selector, err := c.scope(ctx, selector)
+	if err != nil {
 		return err
 	}
-	return nil
+	return c.audited(ctx, AuditRemove, selector, false, func(selector interface{}) (interface{}, error) {
+		if c.SoftDelete {
+			_, err := c.softDelete(ctx, selector, false)
+			return nil, err
+		}
+		_, err := c.DeleteOne(ctx, selector)
+		return nil, err
+	})
 }
 
 // RemoveID deletes a single document from the collection by id.
 func (c *Collection) RemoveID(id interface{}) error {
-	return c.Remove(id)
+	return c.Remove(primitive.M{"_id": id})
+}
+
+// RemoveIDContext deletes a single document from the collection by id.
+func (c *Collection) RemoveIDContext(ctx context.Context, id interface{}) error {
+	return c.RemoveContext(ctx, primitive.M{"_id": id})
 }
 
 // RemoveAll deletes multiple documents from the collection.
 func (c *Collection) RemoveAll(selector interface{}) error {
-	if selector == nil {
-		selector = primitive.D{}
-	}
-	var err error
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	if _, err = c.DeleteMany(ctx, selector); err != nil {
+	return c.RemoveAllContext(ctx, selector)
+}
+
+// RemoveAllContext deletes multiple documents from the collection.
+func (c *Collection) RemoveAllContext(ctx context.Context, selector interface{}) error {
+	selector, err := c.scope(ctx, selector)
+	if err != nil {
 		return err
 	}
-	return nil
+	return c.audited(ctx, AuditRemove, selector, true, func(selector interface{}) (interface{}, error) {
+		if c.SoftDelete {
+			_, err := c.softDelete(ctx, selector, true)
+			return nil, err
+		}
+		_, err := c.DeleteMany(ctx, selector)
+		return nil, err
+	})
 }
 
 // Count gets the number of documents matching the filter.
 func (c *Collection) Count(selector interface{}) (int64, error) {
-	if selector == nil {
-		selector = primitive.D{}
-	}
-	var err error
-	var count int64
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	count, err = c.CountDocuments(ctx, selector)
-	return count, err
+	return c.CountContext(ctx, selector)
 }
 
-func (c *Collection) Create(data interface{}, result interface{}) error {
-	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
-	filter := primitive.M{"_id": primitive.NewObjectIDFromTimestamp(time.Now())}
-	update := primitive.M{
-		"$set":         data,
-		"$currentDate": primitive.M{"updated_at": true, "created_at": true},
+// CountContext gets the number of documents matching the filter.
+func (c *Collection) CountContext(ctx context.Context, selector interface{}) (int64, error) {
+	selector, err := c.readFilter(ctx, selector)
+	if err != nil {
+		return 0, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	return c.CountDocuments(ctx, selector)
+}
+
+// Create inserts data as a new document and decodes it into result.
+func (c *Collection) Create(data interface{}, result interface{}) error {
+	ctx, cancel := c.context()
 	defer cancel()
-	r := c.FindOneAndUpdate(ctx, filter, update, opts)
-	if err := r.Err(); err != nil && err != mongo.ErrNoDocuments {
+	return c.CreateContext(ctx, data, result)
+}
+
+// CreateContext inserts data as a new document and decodes it into result.
+// An _id is generated when data has none.
+func (c *Collection) CreateContext(ctx context.Context, data interface{}, result interface{}) error {
+	data, err := c.encryptDocument(data)
+	if err != nil {
+		return err
+	}
+	if data, err = c.scopeDocument(ctx, data); err != nil {
+		return err
+	}
+	doc, err := toD(data)
+	if err != nil {
 		return err
 	}
+	if _, ok := doc.Map()["_id"]; !ok {
+		doc = append(primitive.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+	}
+	if !c.NoTimestamps {
+		if doc, err = stampDocument(doc, now()); err != nil {
+			return err
+		}
+	}
+
+	inserted, err := c.InsertOne(ctx, doc)
+	if err != nil {
+		return err
+	}
+	c.auditInserts(ctx, []interface{}{doc}, []interface{}{inserted.InsertedID})
 	if result != nil {
-		if err := r.Decode(result); err != nil {
+		data, err := bson.Marshal(doc)
+		if err != nil {
 			return err
 		}
+		return decodeRaw(c.keyRing(), data, result)
 	}
 	return nil
 }
 
 // AggregatePipe process data records and return computed results
 func (c *Collection) AggregatePipe(pipe mongo.Pipeline, result interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
+	return c.AggregatePipeContext(ctx, pipe, result)
+}
+
+// AggregatePipeContext process data records and return computed results
+func (c *Collection) AggregatePipeContext(ctx context.Context, pipe mongo.Pipeline, result interface{}) error {
+	pipe, err := c.scopePipe(ctx, pipe)
+	if err != nil {
+		return err
+	}
 
-	cur, err := c.Aggregate(ctx, pipe)
+	cur, err := c.Aggregate(ctx, c.notDeletedPipe(pipe))
 	if err != nil {
 		return err
 	}
 	defer cur.Close(ctx)
 
-	return cur.All(ctx, result)
+	return decodeAll(ctx, c.keyRing(), cur, result)
 }
 
 // FindDistinct finds the distinct values for a specified field across a single collection
 func (c *Collection) FindDistinct(filter interface{}, fieldName string, opts *options.DistinctOptions) ([]interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := c.context()
 	defer cancel()
-	return c.Distinct(ctx, fieldName, filter, opts)
+	return c.FindDistinctContext(ctx, filter, fieldName, opts)
+}
+
+// FindDistinctContext finds the distinct values for a specified field across a single collection
+func (c *Collection) FindDistinctContext(ctx context.Context, filter interface{}, fieldName string, opts *options.DistinctOptions) ([]interface{}, error) {
+	filter, err := c.readFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	values, err := c.Distinct(ctx, fieldName, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return decryptValues(c.keyRing(), values)
 }
 
 // Modify uses $set to modify matching records
 func (c *Collection) Modify(filter interface{}, update interface{}, result interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.ModifyContext(ctx, filter, update, result)
+}
+
+// ModifyContext uses $set to modify matching records
+func (c *Collection) ModifyContext(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
 	after := options.After
 	opts := options.FindOneAndUpdateOptions{
 		ReturnDocument: &after,
 	}
-	updateQ := primitive.M{
-		"$set":         update,
-		"$currentDate": primitive.M{"updated_at": true, "created_at": true},
+	filter, err := c.scope(ctx, filter)
+	if err != nil {
+		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	r := c.FindOneAndUpdate(ctx, filter, updateQ, &opts)
-	if err := r.Err(); err != nil && err != mongo.ErrNoDocuments {
+	if _, err = c.scopeUpdate(ctx, primitive.M{"$set": update}); err != nil {
+		return err
+	}
+	updateQ, err := c.modifyDocument(update)
+	if err != nil {
+		return err
+	}
+	var r *mongo.SingleResult
+	err = c.audited(ctx, AuditUpdate, filter, false, func(filter interface{}) (interface{}, error) {
+		r = c.FindOneAndUpdate(ctx, filter, updateQ, &opts)
+		if err := r.Err(); err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
 		return err
 	}
 	if result != nil {
-		if err := r.Decode(result); err != nil {
+		raw, err := r.Raw()
+		if err != nil {
 			return err
 		}
+		return decodeRaw(c.keyRing(), raw, result)
 	}
 	return nil
 }
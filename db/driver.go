@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The mongo.Collection methods used by Collection. They are timed for the
+// slow query log and run against the in-memory database when the collection
+// is one of its.
+
+// Name returns the name of the collection.
+func (c *Collection) Name() string {
+	if c.memory != nil {
+		return c.memory.name
+	}
+	return c.Collection.Name()
+}
+
+// Find executes a find command and returns a cursor over the matching documents.
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	defer c.profile(ctx, OpFind, filter, findSort(opts), time.Now())
+	if c.memory == nil {
+		return c.Collection.Find(ctx, filter, opts...)
+	}
+	return c.memory.find(filter, opts)
+}
+
+// FindOne executes a find command and returns a SingleResult for one document.
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	defer c.profile(ctx, OpFindOne, filter, findOneSort(opts), time.Now())
+	if c.memory == nil {
+		return c.Collection.FindOne(ctx, filter, opts...)
+	}
+	return c.memory.findOne(filter, opts)
+}
+
+// InsertOne executes an insert command to insert a single document.
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	defer c.profile(ctx, OpInsert, nil, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.InsertOne(ctx, document, opts...)
+	}
+	return c.memory.insertOne(document)
+}
+
+// InsertMany executes an insert command to insert multiple documents.
+func (c *Collection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	defer c.profile(ctx, OpInsertMany, nil, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.InsertMany(ctx, documents, opts...)
+	}
+	return c.memory.insertMany(documents, opts)
+}
+
+// UpdateOne executes an update command to update at most one document.
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	defer c.profile(ctx, OpUpdate, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.UpdateOne(ctx, filter, update, opts...)
+	}
+	return c.memory.updateWith(filter, update, false, opts)
+}
+
+// UpdateMany executes an update command to update the matching documents.
+func (c *Collection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	defer c.profile(ctx, OpUpdateMany, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.UpdateMany(ctx, filter, update, opts...)
+	}
+	return c.memory.updateWith(filter, update, true, opts)
+}
+
+// DeleteOne executes a delete command to delete at most one document.
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	defer c.profile(ctx, OpDelete, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.DeleteOne(ctx, filter, opts...)
+	}
+	return c.memory.deleteWith(filter, false)
+}
+
+// DeleteMany executes a delete command to delete the matching documents.
+func (c *Collection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	defer c.profile(ctx, OpDeleteMany, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.DeleteMany(ctx, filter, opts...)
+	}
+	return c.memory.deleteWith(filter, true)
+}
+
+// CountDocuments returns the number of documents matching filter.
+func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	defer c.profile(ctx, OpCount, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.CountDocuments(ctx, filter, opts...)
+	}
+	return c.memory.count(filter, opts)
+}
+
+// Distinct executes a distinct command to find the unique values of a field.
+func (c *Collection) Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) ([]interface{}, error) {
+	defer c.profile(ctx, OpDistinct, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.Distinct(ctx, fieldName, filter, opts...)
+	}
+	return c.memory.distinct(fieldName, filter)
+}
+
+// Aggregate executes an aggregate command and returns a cursor over the
+// resulting documents.
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	defer c.profile(ctx, OpAggregate, pipeline, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.Aggregate(ctx, pipeline, opts...)
+	}
+	return c.memory.aggregate(pipeline)
+}
+
+// FindOneAndUpdate executes a findAndModify command to update at most one
+// document and returns it, before or after the update.
+func (c *Collection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	defer c.profile(ctx, OpFindAndModify, filter, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.FindOneAndUpdate(ctx, filter, update, opts...)
+	}
+	return c.memory.findOneAndUpdate(filter, update, opts)
+}
+
+// BulkWrite performs a bulk write operation.
+func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	defer c.profile(ctx, OpBulkWrite, nil, nil, time.Now())
+	if c.memory == nil {
+		return c.Collection.BulkWrite(ctx, models, opts...)
+	}
+	return c.memory.bulkWrite(models, opts)
+}
+
+// Watch returns a change stream of the collection, ErrMemoryUnsupported for
+// the in-memory collections. The changes of tenant scoped collections are not
+// scoped, their ctx must bypass the scope, see WithoutTenant.
+func (c *Collection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	if c.TenantScoped && !bypassesTenant(ctx) {
+		return nil, ErrTenantUnscoped
+	}
+	if c.memory == nil {
+		return c.Collection.Watch(ctx, pipeline, opts...)
+	}
+	return nil, ErrMemoryUnsupported
+}
+
+func findSort(opts []*options.FindOptions) interface{} {
+	var sort interface{}
+	for _, opt := range opts {
+		if opt != nil && opt.Sort != nil {
+			sort = opt.Sort
+		}
+	}
+	return sort
+}
+
+func findOneSort(opts []*options.FindOneOptions) interface{} {
+	var sort interface{}
+	for _, opt := range opts {
+		if opt != nil && opt.Sort != nil {
+			sort = opt.Sort
+		}
+	}
+	return sort
+}
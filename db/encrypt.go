@@ -0,0 +1,561 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// The fields tagged `secure:"encrypt"` are encrypted with the key ring of the
+// collection by its write methods and decrypted by the read ones:
+//
+//	type User struct {
+//		ID    primitive.ObjectID `bson:"_id"`
+//		Email string             `bson:"email" secure:"encrypt,deterministic"`
+//		Name  string             `bson:"name" secure:"encrypt"`
+//	}
+//
+// The fields are encrypted with a random nonce, or deterministically with
+// the "deterministic" flag so equality filters on them can be encrypted as
+// well, with each key of the ring to match the values encrypted before a
+// rotation. The filters and updates only know the fields of the collection
+// model, see WithEncryption; the repositories use their document type.
+const secureTag = "secure"
+
+// secureFields maps the paths of the encrypted fields to their deterministic
+// mode.
+type secureFields map[string]bool
+
+var secureFieldsCache sync.Map
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldsOf returns the encrypted fields of the type of v.
+func fieldsOf(v interface{}) secureFields {
+	if v == nil {
+		return nil
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	if fields, ok := secureFieldsCache.Load(t); ok {
+		return fields.(secureFields)
+	}
+	fields := secureFields{}
+	collectFields(t, "", fields, map[reflect.Type]bool{})
+	secureFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectFields(t reflect.Type, prefix string, fields secureFields, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if len(sf.PkgPath) > 0 {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("bson"), ",")
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = strings.ToLower(sf.Name)
+		}
+
+		if mode, flags, _ := strings.Cut(sf.Tag.Get(secureTag), ","); mode == "encrypt" {
+			fields[prefix+name] = flags == "deterministic"
+			continue
+		}
+
+		ft := sf.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct || ft == timeType {
+			continue
+		}
+		if hasOption(opts, "inline") {
+			collectFields(ft, prefix, fields, seen)
+		} else {
+			collectFields(ft, prefix+name+".", fields, seen)
+		}
+	}
+}
+
+func hasOption(opts string, option string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+func merge(a secureFields, b secureFields) secureFields {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	fields := secureFields{}
+	for path, deterministic := range a {
+		fields[path] = deterministic
+	}
+	for path, deterministic := range b {
+		fields[path] = deterministic
+	}
+	return fields
+}
+
+// parent returns true if path is a document holding encrypted fields.
+func (f secureFields) parent(path string) bool {
+	for field := range f {
+		if strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// inside returns true if path is in an encrypted field.
+func (f secureFields) inside(path string) bool {
+	for field := range f {
+		if strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// encrypt returns a copy of doc with the values of the fields encrypted.
+func (f secureFields) encrypt(keys *KeyRing, doc primitive.D, prefix string) (primitive.D, error) {
+	if len(f) == 0 {
+		return doc, nil
+	}
+
+	out := make(primitive.D, 0, len(doc))
+	for _, e := range doc {
+		path := prefix + e.Key
+		if deterministic, ok := f[path]; ok {
+			value, err := keys.encryptValue(e.Value, deterministic)
+			if err != nil {
+				return nil, err
+			}
+			e.Value = value
+		} else if f.inside(path) {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedField, path)
+		} else if sub, ok := e.Value.(primitive.D); ok && f.parent(path) {
+			value, err := f.encrypt(keys, sub, path+".")
+			if err != nil {
+				return nil, err
+			}
+			e.Value = value
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// encryptFilter returns a copy of filter with the values of the equality
+// conditions of the deterministic fields encrypted.
+func (f secureFields) encryptFilter(keys *KeyRing, filter primitive.D) (primitive.D, error) {
+	out := make(primitive.D, 0, len(filter))
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			clauses, _ := e.Value.(primitive.A)
+			encrypted := primitive.A{}
+			for _, clause := range clauses {
+				if d, ok := clause.(primitive.D); ok {
+					var err error
+					if clause, err = f.encryptFilter(keys, d); err != nil {
+						return nil, err
+					}
+				}
+				encrypted = append(encrypted, clause)
+			}
+			e.Value = encrypted
+		default:
+			if deterministic, ok := f[e.Key]; ok {
+				value, err := encryptCondition(keys, e.Key, e.Value, deterministic)
+				if err != nil {
+					return nil, err
+				}
+				e.Value = value
+			} else if f.inside(e.Key) {
+				return nil, fmt.Errorf("%w: %s", ErrEncryptedField, e.Key)
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func encryptCondition(keys *KeyRing, field string, cond interface{}, deterministic bool) (interface{}, error) {
+	unsupported := fmt.Errorf("%w: filter of %s", ErrEncryptedField, field)
+
+	d, ok := cond.(primitive.D)
+	if !ok || len(d) == 0 || !strings.HasPrefix(d[0].Key, "$") {
+		if cond == nil {
+			return nil, nil
+		}
+		if !deterministic {
+			return nil, unsupported
+		}
+		values, err := keys.encryptValues(cond)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 1 {
+			return values[0], nil
+		}
+		return primitive.D{{Key: "$in", Value: values}}, nil
+	}
+
+	// the equalities are matched as $in of the values encrypted with each key
+	out := primitive.D{}
+	for _, op := range d {
+		switch op.Key {
+		case "$exists":
+			out = append(out, op)
+		case "$eq", "$ne", "$in", "$nin":
+			if !deterministic {
+				return nil, unsupported
+			}
+			values := primitive.A{op.Value}
+			if op.Key == "$in" || op.Key == "$nin" {
+				if values, ok = op.Value.(primitive.A); !ok {
+					return nil, unsupported
+				}
+			}
+
+			encrypted := primitive.A{}
+			for _, v := range values {
+				all, err := keys.encryptValues(v)
+				if err != nil {
+					return nil, err
+				}
+				encrypted = append(encrypted, all...)
+			}
+			operator := "$in"
+			if op.Key == "$ne" || op.Key == "$nin" {
+				operator = "$nin"
+			}
+			out = appendValues(out, operator, encrypted)
+		default:
+			return nil, unsupported
+		}
+	}
+	return out, nil
+}
+
+// appendValues adds values to the operator of cond.
+func appendValues(cond primitive.D, operator string, values primitive.A) primitive.D {
+	for i, op := range cond {
+		if op.Key == operator {
+			cond[i].Value = append(op.Value.(primitive.A), values...)
+			return cond
+		}
+	}
+	return append(cond, primitive.E{Key: operator, Value: values})
+}
+
+// WithKeys returns a copy of the collection encrypting its fields with keys
+// instead of the key ring of its client, or EncryptionKeys.
+func (c *Collection) WithKeys(keys *KeyRing) *Collection {
+	col := *c
+	col.keys = keys
+	return &col
+}
+
+func (c *Collection) keyRing() *KeyRing {
+	if c.keys != nil {
+		return c.keys
+	}
+	return EncryptionKeys
+}
+
+// WithEncryption returns a copy of the collection that also encrypts the
+// fields of model in the filters and updates.
+func (c *Collection) WithEncryption(model interface{}) *Collection {
+	col := *c
+	col.secure = merge(c.secure, fieldsOf(model))
+	return &col
+}
+
+// encryptDocument returns document with the encrypted fields of the
+// collection and of the document type encrypted.
+func (c *Collection) encryptDocument(document interface{}) (interface{}, error) {
+	fields := merge(c.secure, fieldsOf(document))
+	if len(fields) == 0 {
+		return document, nil
+	}
+	doc, err := toD(document)
+	if err != nil {
+		return nil, err
+	}
+	return fields.encrypt(c.keyRing(), doc, "")
+}
+
+// encryptUpdate returns update with the values of fields set by $set and
+// $setOnInsert encrypted, or the fields of a replacement document.
+func (c *Collection) encryptUpdate(update interface{}, fields secureFields) (interface{}, error) {
+	if len(fields) == 0 {
+		return update, nil
+	}
+	doc, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) > 0 && !strings.HasPrefix(doc[0].Key, "$") {
+		return fields.encrypt(c.keyRing(), doc, "")
+	}
+
+	for i, op := range doc {
+		values, err := toD(op.Value)
+		if err != nil {
+			continue
+		}
+		switch op.Key {
+		case "$set", "$setOnInsert":
+			if doc[i].Value, err = fields.encrypt(c.keyRing(), values, ""); err != nil {
+				return nil, err
+			}
+		case "$unset":
+		default:
+			for _, e := range values {
+				if _, ok := fields[e.Key]; ok || fields.parent(e.Key) || fields.inside(e.Key) {
+					return nil, fmt.Errorf("%w: %s of %s", ErrEncryptedField, op.Key, e.Key)
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+// updateFields returns the fields to encrypt of the structs update holds,
+// either as a replacement or as the value of an operator, e.g. {$set: user}.
+func updateFields(update interface{}) secureFields {
+	fields := fieldsOf(update)
+	switch u := update.(type) {
+	case primitive.D:
+		for _, op := range u {
+			fields = merge(fields, fieldsOf(op.Value))
+		}
+	case primitive.M:
+		for _, value := range u {
+			fields = merge(fields, fieldsOf(value))
+		}
+	case map[string]interface{}:
+		for _, value := range u {
+			fields = merge(fields, fieldsOf(value))
+		}
+	}
+	return fields
+}
+
+// encryptFilter returns filter with the equality conditions of the
+// deterministic fields encrypted.
+func (c *Collection) encryptFilter(filter interface{}) (interface{}, error) {
+	if len(c.secure) == 0 || filter == nil {
+		return filter, nil
+	}
+	doc, err := toD(filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.secure.encryptFilter(c.keyRing(), doc)
+}
+
+// decodeRaw decrypts doc with keys and decodes it into result.
+func decodeRaw(keys *KeyRing, doc bson.Raw, result interface{}) error {
+	doc, err := decrypt(keys, doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(doc, result)
+}
+
+// decodeAll decrypts the documents of cur and decodes them into result, a
+// pointer to a slice.
+func decodeAll(ctx context.Context, keys *KeyRing, cur *mongo.Cursor, result interface{}) error {
+	docs := []bson.Raw{}
+	for cur.Next(ctx) {
+		docs = append(docs, append(bson.Raw{}, cur.Current...))
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	return decodeRaws(keys, docs, result)
+}
+
+// decrypt returns doc with its encrypted values decrypted.
+func decrypt(keys *KeyRing, doc bson.Raw) (bson.Raw, error) {
+	out, changed, err := decryptDocument(keys, bsoncore.Document(doc))
+	if err != nil || !changed {
+		return doc, err
+	}
+	return bson.Raw(out), nil
+}
+
+func decryptDocument(keys *KeyRing, doc bsoncore.Document) (bsoncore.Document, bool, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	values := make([]bsoncore.Value, len(elems))
+	for i, elem := range elems {
+		v := elem.Value()
+		switch v.Type {
+		case bsontype.Binary:
+			if subtype, data := v.Binary(); subtype == EncryptedSubtype {
+				raw, _, err := keys.decryptValue(data)
+				if err != nil {
+					return nil, false, err
+				}
+				v = bsoncore.Value{Type: raw.Type, Data: raw.Value}
+				changed = true
+			}
+		case bsontype.EmbeddedDocument, bsontype.Array:
+			sub, subChanged, err := decryptDocument(keys, v.Data)
+			if err != nil {
+				return nil, false, err
+			}
+			if subChanged {
+				v.Data = sub
+				changed = true
+			}
+		}
+		values[i] = v
+	}
+	if !changed {
+		return doc, false, nil
+	}
+
+	idx, out := bsoncore.AppendDocumentStart(nil)
+	for i, elem := range elems {
+		out = bsoncore.AppendValueElement(out, elem.Key(), values[i])
+	}
+	out, err = bsoncore.AppendDocumentEnd(out, idx)
+	return out, true, err
+}
+
+// decryptValues decrypts the encrypted values, e.g. of a distinct.
+func decryptValues(keys *KeyRing, values []interface{}) ([]interface{}, error) {
+	for i, v := range values {
+		b, ok := v.(primitive.Binary)
+		if !ok || b.Subtype != EncryptedSubtype {
+			continue
+		}
+		raw, _, err := keys.decryptValue(b.Data)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := raw.Unmarshal(&value); err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Reencrypt encrypts with the current key the values of the documents
+// matching filter that were encrypted with another one, e.g. after a key
+// rotation, and returns the number of updated documents. Their updated_at is
+// left unchanged.
+func (c *Collection) Reencrypt(ctx context.Context, filter interface{}) (int64, error) {
+	keys := c.keyRing()
+	if keys == nil {
+		return 0, ErrNoEncryptionKeys
+	}
+	filter, err := c.scope(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	cur, err := c.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	updated := int64(0)
+	for cur.Next(ctx) {
+		set := primitive.D{}
+		if err := reencrypt(keys, bsoncore.Document(cur.Current), "", &set); err != nil {
+			return updated, err
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		selector := primitive.D{{Key: "_id", Value: cur.Current.Lookup("_id")}}
+		if _, err := c.UpdateOne(ctx, selector, primitive.D{{Key: "$set", Value: set}}); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, cur.Err()
+}
+
+// reencrypt adds to set the values of doc encrypted with the current key that
+// were encrypted with another one.
+func reencrypt(keys *KeyRing, doc bsoncore.Document, prefix string, set *primitive.D) error {
+	elems, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+
+	current := keys.Current()
+	for _, elem := range elems {
+		path := prefix + elem.Key()
+		v := elem.Value()
+		switch v.Type {
+		case bsontype.Binary:
+			subtype, data := v.Binary()
+			if subtype != EncryptedSubtype {
+				continue
+			}
+			raw, e, err := keys.decryptValue(data)
+			if err != nil {
+				return err
+			}
+			if e.keyID == current {
+				continue
+			}
+			value, err := keys.encrypt(current, raw.Type, raw.Value, e.mode == encryptDeterministic)
+			if err != nil {
+				return err
+			}
+			*set = append(*set, primitive.E{Key: path, Value: value})
+		case bsontype.EmbeddedDocument, bsontype.Array:
+			if err := reencrypt(keys, v.Data, path+".", set); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package files stores files, e.g. the uploads of the raw handlers, in GridFS
+// buckets.
+//
+//	bucket := files.New(dbc, "avatars")
+//	file, err := bucket.Upload(ctx, "me.png", r, primitive.M{"user_id": userID})
+//	...
+//	_, err = bucket.Download(ctx, file.ID, w)
+//	list, err := bucket.List(ctx, primitive.M{"user_id": userID})
+package files
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultBucket is the name of the bucket of New with an empty name.
+const DefaultBucket = "fs"
+
+// ContentTypeField is the metadata field holding the content type of a file.
+const ContentTypeField = "content_type"
+
+// DefaultContentType is the content type of the files without one.
+const DefaultContentType = "application/octet-stream"
+
+// ErrNotFound is returned for a file that does not exist.
+var ErrNotFound = gridfs.ErrFileNotFound
+
+// ErrInvalidRange is returned for a range outside of the file.
+var ErrInvalidRange = errors.New("invalid file range")
+
+// File is a stored file.
+type File struct {
+	ID         interface{} `json:"id"`
+	Name       string      `json:"name"`
+	Length     int64       `json:"length"`
+	UploadDate time.Time   `json:"upload_date"`
+	Metadata   primitive.M `json:"metadata,omitempty"`
+}
+
+// ContentType returns the content type of the file, from its metadata or its
+// name extension.
+func (f *File) ContentType() string {
+	if contentType, ok := f.Metadata[ContentTypeField].(string); ok && len(contentType) > 0 {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(path.Ext(f.Name)); len(contentType) > 0 {
+		return contentType
+	}
+	return DefaultContentType
+}
+
+func newFile(f *gridfs.File) (*File, error) {
+	file := &File{ID: f.ID, Name: f.Name, Length: f.Length, UploadDate: f.UploadDate}
+	if len(f.Metadata) > 0 {
+		if err := bson.Unmarshal(f.Metadata, &file.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// Bucket is a GridFS bucket.
+type Bucket struct {
+	DB   *mongo.Database
+	Name string
+	// ChunkSize of the uploaded files, the GridFS default one when zero.
+	ChunkSize int32
+}
+
+// New returns the bucket name of dbc, DefaultBucket when name is empty.
+func New(dbc *mongo.Database, name string) *Bucket {
+	if len(name) == 0 {
+		name = DefaultBucket
+	}
+	return &Bucket{DB: dbc, Name: name}
+}
+
+// gridfs returns a gridfs bucket with the deadline of ctx. One is made per
+// operation as the deadlines are set on the bucket.
+func (b *Bucket) gridfs(ctx context.Context) (*gridfs.Bucket, error) {
+	opts := options.GridFSBucket().SetName(b.Name)
+	if b.ChunkSize > 0 {
+		opts.SetChunkSizeBytes(b.ChunkSize)
+	}
+	bucket, err := gridfs.NewBucket(b.DB, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := bucket.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if err := bucket.SetWriteDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// Upload stores the content of r as a file named name with metadata. The
+// content type is detected from the name extension or the content when the
+// metadata has none.
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader, metadata primitive.M) (*File, error) {
+	bucket, err := b.gridfs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := primitive.M{}
+	for k, v := range metadata {
+		meta[k] = v
+	}
+	if contentType, _ := meta[ContentTypeField].(string); len(contentType) == 0 {
+		contentType = mime.TypeByExtension(path.Ext(name))
+		if len(contentType) == 0 {
+			br := bufio.NewReaderSize(r, 512)
+			head, _ := br.Peek(512)
+			contentType = http.DetectContentType(head)
+			r = br
+		}
+		meta[ContentTypeField] = contentType
+	}
+
+	id := primitive.NewObjectID()
+	if err := bucket.UploadFromStreamWithID(id, name, r, options.GridFSUpload().SetMetadata(meta)); err != nil {
+		return nil, err
+	}
+	return b.Find(ctx, id)
+}
+
+// Find returns the file with id.
+func (b *Bucket) Find(ctx context.Context, id interface{}) (*File, error) {
+	files, err := b.find(ctx, primitive.M{"_id": id}, options.GridFSFind().SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrNotFound
+	}
+	return files[0], nil
+}
+
+// List returns the files whose metadata has the fields of metadata, the most
+// recent first.
+func (b *Bucket) List(ctx context.Context, metadata primitive.M) ([]*File, error) {
+	filter := primitive.M{}
+	for k, v := range metadata {
+		filter["metadata."+k] = v
+	}
+	return b.find(ctx, filter, options.GridFSFind().SetSort(primitive.D{{Key: "uploadDate", Value: -1}}))
+}
+
+func (b *Bucket) find(ctx context.Context, filter interface{}, opts *options.GridFSFindOptions) ([]*File, error) {
+	bucket, err := b.gridfs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := bucket.FindContext(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	files := []*File{}
+	for cur.Next(ctx) {
+		f := &gridfs.File{}
+		if err := cur.Decode(f); err != nil {
+			return nil, err
+		}
+		file, err := newFile(f)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, cur.Err()
+}
+
+// Download writes the content of the file with id to w.
+func (b *Bucket) Download(ctx context.Context, id interface{}, w io.Writer) (*File, error) {
+	return b.DownloadRange(ctx, id, w, 0, -1)
+}
+
+// DownloadRange writes length bytes of the file with id from offset to w,
+// up to the end of the file when length is negative.
+func (b *Bucket) DownloadRange(ctx context.Context, id interface{}, w io.Writer, offset int64, length int64) (*File, error) {
+	bucket, err := b.gridfs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	file, err := newFile(stream.GetFile())
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > file.Length || (length > 0 && offset+length > file.Length) {
+		return nil, ErrInvalidRange
+	}
+
+	if offset > 0 {
+		if _, err := stream.Skip(offset); err != nil {
+			return nil, err
+		}
+	}
+	if length < 0 {
+		_, err = io.Copy(w, stream)
+	} else {
+		_, err = io.CopyN(w, stream, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Delete deletes the file with id.
+func (b *Bucket) Delete(ctx context.Context, id interface{}) error {
+	bucket, err := b.gridfs(ctx)
+	if err != nil {
+		return err
+	}
+	return bucket.DeleteContext(ctx, id)
+}
@@ -0,0 +1,22 @@
+package files
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFileContentType(t *testing.T) {
+	for _, test := range []struct {
+		file     File
+		expected string
+	}{
+		{File{Name: "a.png", Metadata: primitive.M{ContentTypeField: "image/webp"}}, "image/webp"},
+		{File{Name: "a.png"}, "image/png"},
+		{File{Name: "a"}, DefaultContentType},
+	} {
+		if got := test.file.ContentType(); got != test.expected {
+			t.Errorf("Unexpected content type of %+v: %+v, expected %+v", test.file, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrMemoryUnsupported is returned by the collections of a Memory database for
+// the operations it can't run, e.g. change streams.
+var ErrMemoryUnsupported = errors.New("not supported by the in-memory database")
+
+// Memory is an in-memory database for unit tests. The Collection methods of
+// its collections run against it instead of mongo, with the common filter
+// operators, $set, $unset, $inc, $min, $max, $push, $addToSet, $pull and
+// $currentDate updates, sort, skip & limit, and the $match, $sort, $skip,
+// $limit, $project, $addFields, $unset, $group, $count, $unwind, $lookup and
+// $facet aggregation stages. Unsupported operators return an error.
+type Memory struct {
+	mu          sync.Mutex
+	collections map[string][]primitive.D
+
+	once   sync.Once
+	client *Client
+}
+
+// NewMemory returns an empty in-memory database.
+func NewMemory() *Memory {
+	return &Memory{collections: map[string][]primitive.D{}}
+}
+
+// Col returns a collection of the in-memory database. Its mongo.Collection is
+// the one of DB, so its Database maps back to m, and its methods not run in
+// memory, e.g. Indexes().List, fail as the client is not connected.
+func (m *Memory) Col(name string) *Collection {
+	return &Collection{
+		Collection: m.DB().Collection(name),
+		Timeout:    DefaultTimeout,
+		memory:     &memoryCollection{db: m, name: name},
+	}
+}
+
+// Drop removes the documents of all the collections.
+func (m *Memory) Drop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collections = map[string][]primitive.D{}
+}
+
+// DB returns a database whose collections are the ones of m, so the code
+// taking a *mongo.Database can be unit tested against it:
+//
+//	m := db.NewMemory()
+//	resp := handler(m.DB(), req)
+//
+// The database is not connected, only Col and the Client of m use it.
+func (m *Memory) DB() *mongo.Database {
+	return m.Client().DB()
+}
+
+// Client returns a client whose database is m. Its WithTransaction runs the
+// functions without a transaction.
+func (m *Memory) Client() *Client {
+	m.once.Do(func() {
+		// the client is never connected, it only maps the databases to m
+		client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://memory"))
+		if err != nil {
+			panic(err)
+		}
+		m.client = &Client{client: client, database: "memory", memory: m}
+		clients.Store(client, m.client)
+	})
+	return m.client
+}
+
+// sibling returns another collection of the database of the collection.
+func (c *Collection) sibling(name string) *Collection {
+	var col *Collection
+	if c.memory != nil {
+		col = c.memory.db.Col(name)
+	} else {
+		col = &Collection{Collection: c.Database().Collection(name)}
+	}
+	col.Timeout = c.Timeout
+	col.slowQueryThreshold = c.slowQueryThreshold
+	col.explainSlowQueries = c.explainSlowQueries
+	col.keys = c.keys
+	col.log = c.log
+	return col
+}
@@ -0,0 +1,493 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sortDocs sorts docs by the fields of spec, e.g. {name: 1, age: -1}.
+func sortDocs(docs []primitive.D, spec primitive.D) error {
+	for _, e := range spec {
+		if _, ok := toFloat(e.Value); !ok {
+			return fmt.Errorf("unsupported sort of %s", e.Key)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range spec {
+			c := compareValues(sortValue(docs[i], e.Key), sortValue(docs[j], e.Key))
+			if c == 0 {
+				continue
+			}
+			if order, _ := toFloat(e.Value); order < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func sortValue(doc primitive.D, field string) interface{} {
+	values := lookupField(doc, field)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// project returns doc with the fields of spec, either all included or all
+// excluded; _id is included unless excluded. Included fields can also be
+// expressions, e.g. {name: "$user.name"}.
+func project(doc primitive.D, spec primitive.D) (primitive.D, error) {
+	exclude := false
+	for _, e := range spec {
+		if isExclusion(e.Value) && e.Key != "_id" {
+			exclude = true
+		}
+	}
+
+	if exclude {
+		projected := cloneValue(doc).(primitive.D)
+		for _, e := range spec {
+			if !isExclusion(e.Value) {
+				return nil, fmt.Errorf("cannot include %s in an exclusion projection", e.Key)
+			}
+			projected = unsetPath(projected, e.Key)
+		}
+		return projected, nil
+	}
+
+	projected := primitive.D{}
+	includeID := true
+	for _, e := range spec {
+		if e.Key == "_id" && isExclusion(e.Value) {
+			includeID = false
+		}
+	}
+	if id, ok := getPath(doc, "_id"); ok && includeID {
+		projected = append(projected, primitive.E{Key: "_id", Value: id})
+	}
+	for _, e := range spec {
+		if e.Key == "_id" && (isExclusion(e.Value) || isInclusion(e.Value)) {
+			continue
+		}
+
+		var value interface{}
+		if isInclusion(e.Value) {
+			v, ok := getPath(doc, e.Key)
+			if !ok {
+				continue
+			}
+			value = v
+		} else {
+			v, err := evalExpr(doc, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			value = v
+		}
+		var err error
+		if projected, err = setPath(projected, e.Key, cloneValue(value)); err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
+
+func isExclusion(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return !b
+	}
+	f, ok := toFloat(v)
+	return ok && f == 0
+}
+
+func isInclusion(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	f, ok := toFloat(v)
+	return ok && f != 0
+}
+
+// evalExpr evaluates an aggregation expression against doc: a "$field" path,
+// "$$ROOT", a document of expressions or a literal.
+func evalExpr(doc primitive.D, expr interface{}) (interface{}, error) {
+	switch t := expr.(type) {
+	case string:
+		if t == "$$ROOT" {
+			return doc, nil
+		}
+		if strings.HasPrefix(t, "$") {
+			if v, ok := getPath(doc, t[1:]); ok {
+				return v, nil
+			}
+			// a path through an array of documents, e.g. "$items.price"
+			if values := lookupField(doc, t[1:]); len(values) > 0 {
+				return primitive.A(values), nil
+			}
+			return nil, nil
+		}
+	case primitive.D:
+		if len(t) == 1 && t[0].Key == "$literal" {
+			return t[0].Value, nil
+		}
+		if isOperatorDoc(t) {
+			return nil, fmt.Errorf("unsupported expression operator %s", t[0].Key)
+		}
+		d := primitive.D{}
+		for _, e := range t {
+			v, err := evalExpr(doc, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, primitive.E{Key: e.Key, Value: v})
+		}
+		return d, nil
+	case primitive.A:
+		a := primitive.A{}
+		for _, e := range t {
+			v, err := evalExpr(doc, e)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+	return expr, nil
+}
+
+// aggregate runs the stages of pipe against docs. lookup returns the
+// documents of another collection for $lookup.
+func aggregate(docs []primitive.D, pipe primitive.A, lookup func(string) []primitive.D) ([]primitive.D, error) {
+	for _, s := range pipe {
+		stage, ok := s.(primitive.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage needs one operator")
+		}
+		var err error
+		if docs, err = aggregateStage(docs, stage[0], lookup); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func aggregateStage(docs []primitive.D, stage primitive.E, lookup func(string) []primitive.D) ([]primitive.D, error) {
+	spec, _ := stage.Value.(primitive.D)
+
+	switch stage.Key {
+	case "$match":
+		matched := []primitive.D{}
+		for _, doc := range docs {
+			ok, err := match(doc, spec)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, doc)
+			}
+		}
+		return matched, nil
+	case "$sort":
+		sorted := append([]primitive.D{}, docs...)
+		return sorted, sortDocs(sorted, spec)
+	case "$skip", "$limit":
+		n, ok := toFloat(stage.Value)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s needs a positive number", stage.Key)
+		}
+		if stage.Key == "$skip" {
+			return docs[int(math.Min(n, float64(len(docs)))):], nil
+		}
+		return docs[:int(math.Min(n, float64(len(docs))))], nil
+	case "$project", "$addFields", "$set", "$unset":
+		projected := make([]primitive.D, 0, len(docs))
+		for _, doc := range docs {
+			var p primitive.D
+			var err error
+			switch stage.Key {
+			case "$project":
+				p, err = project(doc, spec)
+			case "$unset":
+				p = cloneValue(doc).(primitive.D)
+				fields, ok := stage.Value.(primitive.A)
+				if !ok {
+					fields = primitive.A{stage.Value}
+				}
+				for _, f := range fields {
+					field, _ := f.(string)
+					p = unsetPath(p, field)
+				}
+			default:
+				p = cloneValue(doc).(primitive.D)
+				for _, e := range spec {
+					v, evalErr := evalExpr(doc, e.Value)
+					if evalErr != nil {
+						return nil, evalErr
+					}
+					if p, err = setPath(p, e.Key, v); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			projected = append(projected, p)
+		}
+		return projected, nil
+	case "$group":
+		return group(docs, spec)
+	case "$count":
+		field, ok := stage.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("$count needs a field name")
+		}
+		if len(docs) == 0 {
+			return []primitive.D{}, nil
+		}
+		return []primitive.D{{{Key: field, Value: int32(len(docs))}}}, nil
+	case "$unwind":
+		return unwind(docs, stage.Value)
+	case "$lookup":
+		var from, localField, foreignField, as string
+		for _, e := range spec {
+			s, _ := e.Value.(string)
+			switch e.Key {
+			case "from":
+				from = s
+			case "localField":
+				localField = s
+			case "foreignField":
+				foreignField = s
+			case "as":
+				as = s
+			default:
+				return nil, fmt.Errorf("unsupported $lookup field %s", e.Key)
+			}
+		}
+		foreign := lookup(from)
+		joined := make([]primitive.D, 0, len(docs))
+		for _, doc := range docs {
+			local := flatten(lookupField(doc, localField))
+			if len(local) == 0 {
+				local = []interface{}{nil}
+			}
+			matched := primitive.A{}
+			for _, f := range foreign {
+				for _, v := range local {
+					if matchEq(lookupField(f, foreignField), v) {
+						matched = append(matched, f)
+						break
+					}
+				}
+			}
+			j, err := setPath(cloneValue(doc).(primitive.D), as, matched)
+			if err != nil {
+				return nil, err
+			}
+			joined = append(joined, j)
+		}
+		return joined, nil
+	case "$facet":
+		facets := primitive.D{}
+		for _, e := range spec {
+			sub, ok := e.Value.(primitive.A)
+			if !ok {
+				return nil, fmt.Errorf("$facet %s needs a pipeline", e.Key)
+			}
+			result, err := aggregate(docs, sub, lookup)
+			if err != nil {
+				return nil, err
+			}
+			a := primitive.A{}
+			for _, doc := range result {
+				a = append(a, doc)
+			}
+			facets = append(facets, primitive.E{Key: e.Key, Value: a})
+		}
+		return []primitive.D{facets}, nil
+	}
+	return nil, fmt.Errorf("unsupported aggregation stage %s", stage.Key)
+}
+
+func unwind(docs []primitive.D, spec interface{}) ([]primitive.D, error) {
+	path, preserve := "", false
+	switch t := spec.(type) {
+	case string:
+		path = t
+	case primitive.D:
+		for _, e := range t {
+			switch e.Key {
+			case "path":
+				path, _ = e.Value.(string)
+			case "preserveNullAndEmptyArrays":
+				preserve = truthy(e.Value)
+			default:
+				return nil, fmt.Errorf("unsupported $unwind field %s", e.Key)
+			}
+		}
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("$unwind needs a $field path")
+	}
+	field := path[1:]
+
+	unwound := []primitive.D{}
+	for _, doc := range docs {
+		v, ok := getPath(doc, field)
+		array, isArray := v.(primitive.A)
+		switch {
+		case isArray && len(array) > 0:
+			for _, elem := range array {
+				u, err := setPath(cloneValue(doc).(primitive.D), field, elem)
+				if err != nil {
+					return nil, err
+				}
+				unwound = append(unwound, u)
+			}
+		case ok && v != nil && !isArray:
+			unwound = append(unwound, doc)
+		case preserve:
+			u := cloneValue(doc).(primitive.D)
+			if isArray {
+				u = unsetPath(u, field)
+			}
+			unwound = append(unwound, u)
+		}
+	}
+	return unwound, nil
+}
+
+type groupAcc struct {
+	field    string
+	operator string
+	expr     interface{}
+}
+
+type groupState struct {
+	id     interface{}
+	values [][]interface{}
+}
+
+// group runs a $group stage, keeping the groups in their order of appearance.
+func group(docs []primitive.D, spec primitive.D) ([]primitive.D, error) {
+	var idExpr interface{}
+	accs := []groupAcc{}
+	for _, e := range spec {
+		if e.Key == "_id" {
+			idExpr = e.Value
+			continue
+		}
+		acc, ok := e.Value.(primitive.D)
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("$group %s needs one accumulator", e.Key)
+		}
+		accs = append(accs, groupAcc{field: e.Key, operator: acc[0].Key, expr: acc[0].Value})
+	}
+
+	groups := []*groupState{}
+	for _, doc := range docs {
+		id, err := evalExpr(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var g *groupState
+		for _, existing := range groups {
+			if compareValues(existing.id, id) == 0 {
+				g = existing
+				break
+			}
+		}
+		if g == nil {
+			g = &groupState{id: id, values: make([][]interface{}, len(accs))}
+			groups = append(groups, g)
+		}
+		for i, acc := range accs {
+			v, err := evalExpr(doc, acc.expr)
+			if err != nil {
+				return nil, err
+			}
+			if acc.operator == "$count" {
+				v = int32(1)
+			}
+			g.values[i] = append(g.values[i], v)
+		}
+	}
+
+	results := make([]primitive.D, 0, len(groups))
+	for _, g := range groups {
+		doc := primitive.D{{Key: "_id", Value: g.id}}
+		for i, acc := range accs {
+			v, err := accumulate(acc.operator, g.values[i])
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, primitive.E{Key: acc.field, Value: v})
+		}
+		results = append(results, doc)
+	}
+	return results, nil
+}
+
+func accumulate(operator string, values []interface{}) (interface{}, error) {
+	switch operator {
+	case "$sum", "$count":
+		var sum interface{} = int32(0)
+		for _, v := range values {
+			if _, ok := toFloat(v); ok {
+				sum, _ = addNumbers(sum, v)
+			}
+		}
+		return sum, nil
+	case "$avg":
+		total, n := 0.0, 0
+		for _, v := range values {
+			if f, ok := toFloat(v); ok {
+				total += f
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return total / float64(n), nil
+	case "$min", "$max":
+		var result interface{}
+		for _, v := range values {
+			if v == nil {
+				continue
+			}
+			c := compareValues(v, result)
+			if result == nil || (operator == "$min" && c < 0) || (operator == "$max" && c > 0) {
+				result = v
+			}
+		}
+		return result, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		if operator == "$first" {
+			return values[0], nil
+		}
+		return values[len(values)-1], nil
+	case "$push", "$addToSet":
+		a := primitive.A{}
+		for _, v := range values {
+			if operator == "$addToSet" && contains(a, v) {
+				continue
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("unsupported accumulator %s", operator)
+}
@@ -0,0 +1,607 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const errCodeDuplicateKey = 11000
+
+// memoryCollection runs the operations of a Collection against a Memory
+// database. The documents are stored as primitive.D, each with an _id.
+type memoryCollection struct {
+	db   *Memory
+	name string
+}
+
+type memoryQuery struct {
+	filter     interface{}
+	sort       interface{}
+	skip       int64
+	limit      int64
+	projection interface{}
+}
+
+func (mc *memoryCollection) lock() func() {
+	mc.db.mu.Lock()
+	return mc.db.mu.Unlock
+}
+
+func (mc *memoryCollection) docs() []primitive.D {
+	return mc.db.collections[mc.name]
+}
+
+// query returns the documents matching q, without their projection.
+func (mc *memoryCollection) query(q memoryQuery) ([]primitive.D, error) {
+	filter, err := normalizeDoc(q.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := []primitive.D{}
+	for _, doc := range mc.docs() {
+		ok, err := match(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+
+	if q.sort != nil {
+		spec, err := normalizeDoc(q.sort)
+		if err != nil {
+			return nil, err
+		}
+		if err := sortDocs(matched, spec); err != nil {
+			return nil, err
+		}
+	}
+	if q.skip > 0 {
+		if q.skip > int64(len(matched)) {
+			q.skip = int64(len(matched))
+		}
+		matched = matched[q.skip:]
+	}
+	if q.limit < 0 {
+		q.limit = -q.limit
+	}
+	if q.limit > 0 && q.limit < int64(len(matched)) {
+		matched = matched[:q.limit]
+	}
+	return matched, nil
+}
+
+// results returns copies of docs with their projection.
+func results(docs []primitive.D, projection interface{}) ([]interface{}, error) {
+	var spec primitive.D
+	if projection != nil {
+		var err error
+		if spec, err = normalizeDoc(projection); err != nil {
+			return nil, err
+		}
+	}
+
+	copies := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		result := cloneValue(doc).(primitive.D)
+		if len(spec) > 0 {
+			var err error
+			if result, err = project(doc, spec); err != nil {
+				return nil, err
+			}
+		}
+		copies = append(copies, result)
+	}
+	return copies, nil
+}
+
+func singleResult(doc interface{}, err error) *mongo.SingleResult {
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(primitive.D{}, err, nil)
+	}
+	if doc == nil {
+		return mongo.NewSingleResultFromDocument(primitive.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(doc, nil, nil)
+}
+
+func (mc *memoryCollection) find(filter interface{}, opts []*options.FindOptions) (*mongo.Cursor, error) {
+	defer mc.lock()()
+
+	q := memoryQuery{filter: filter}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			q.sort = opt.Sort
+		}
+		if opt.Skip != nil {
+			q.skip = *opt.Skip
+		}
+		if opt.Limit != nil {
+			q.limit = *opt.Limit
+		}
+		if opt.Projection != nil {
+			q.projection = opt.Projection
+		}
+	}
+
+	docs, err := mc.query(q)
+	if err != nil {
+		return nil, err
+	}
+	found, err := results(docs, q.projection)
+	if err != nil {
+		return nil, err
+	}
+	return mongo.NewCursorFromDocuments(found, nil, nil)
+}
+
+func (mc *memoryCollection) findOne(filter interface{}, opts []*options.FindOneOptions) *mongo.SingleResult {
+	defer mc.lock()()
+
+	q := memoryQuery{filter: filter, limit: 1}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			q.sort = opt.Sort
+		}
+		if opt.Skip != nil {
+			q.skip = *opt.Skip
+		}
+		if opt.Projection != nil {
+			q.projection = opt.Projection
+		}
+	}
+
+	docs, err := mc.query(q)
+	if err != nil || len(docs) == 0 {
+		return singleResult(nil, err)
+	}
+	found, err := results(docs, q.projection)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	return singleResult(found[0], nil)
+}
+
+func (mc *memoryCollection) count(filter interface{}, opts []*options.CountOptions) (int64, error) {
+	defer mc.lock()()
+
+	q := memoryQuery{filter: filter}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Skip != nil {
+			q.skip = *opt.Skip
+		}
+		if opt.Limit != nil {
+			q.limit = *opt.Limit
+		}
+	}
+
+	docs, err := mc.query(q)
+	return int64(len(docs)), err
+}
+
+func (mc *memoryCollection) distinct(field string, filter interface{}) ([]interface{}, error) {
+	defer mc.lock()()
+
+	docs, err := mc.query(memoryQuery{filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	values := primitive.A{}
+	for _, doc := range docs {
+		for _, v := range lookupField(doc, field) {
+			elems := primitive.A{v}
+			if a, ok := v.(primitive.A); ok {
+				elems = a
+			}
+			for _, elem := range elems {
+				if !contains(values, elem) {
+					values = append(values, elem)
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func (mc *memoryCollection) indexOf(id interface{}) int {
+	for i, doc := range mc.docs() {
+		if docID, ok := getPath(doc, "_id"); ok && compareValues(docID, id) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func duplicateKey(name string, id interface{}) mongo.WriteError {
+	return mongo.WriteError{
+		Code:    errCodeDuplicateKey,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", name, id),
+	}
+}
+
+// insert stores a document, with a new _id when it has none.
+func (mc *memoryCollection) insert(document interface{}) (interface{}, *mongo.WriteError, error) {
+	doc, err := normalizeDoc(document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, ok := getPath(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(primitive.D{{Key: "_id", Value: id}}, doc...)
+	}
+	if mc.indexOf(id) >= 0 {
+		we := duplicateKey(mc.name, id)
+		return nil, &we, nil
+	}
+
+	mc.db.collections[mc.name] = append(mc.docs(), doc)
+	return id, nil, nil
+}
+
+func (mc *memoryCollection) insertOne(document interface{}) (*mongo.InsertOneResult, error) {
+	defer mc.lock()()
+
+	id, we, err := mc.insert(document)
+	if err != nil {
+		return nil, err
+	}
+	if we != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*we}}
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+func (mc *memoryCollection) insertMany(documents []interface{}, opts []*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	defer mc.lock()()
+
+	ordered := true
+	for _, opt := range opts {
+		if opt != nil && opt.Ordered != nil {
+			ordered = *opt.Ordered
+		}
+	}
+
+	result := &mongo.InsertManyResult{}
+	bwe := mongo.BulkWriteException{}
+	for i, document := range documents {
+		id, we, err := mc.insert(document)
+		if err != nil {
+			return nil, err
+		}
+		if we != nil {
+			we.Index = i
+			bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: *we})
+			if ordered {
+				break
+			}
+			continue
+		}
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return result, bwe
+	}
+	return result, nil
+}
+
+// upsertDocument returns the document inserted by an upsert of filter: its
+// equality conditions.
+func upsertDocument(filter primitive.D) primitive.D {
+	doc := primitive.D{}
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and":
+			conds, _ := e.Value.(primitive.A)
+			for _, cond := range conds {
+				if d, ok := cond.(primitive.D); ok {
+					for _, f := range upsertDocument(d) {
+						doc, _ = setPath(doc, f.Key, f.Value)
+					}
+				}
+			}
+		case len(e.Key) > 0 && e.Key[0] == '$':
+		case isOperatorDoc(e.Value):
+			for _, op := range e.Value.(primitive.D) {
+				if op.Key == "$eq" {
+					doc, _ = setPath(doc, e.Key, op.Value)
+				}
+			}
+		default:
+			doc, _ = setPath(doc, e.Key, e.Value)
+		}
+	}
+	return doc
+}
+
+// update updates one or all the documents matching filter. The update is a
+// replacement when replace is true, an operator document otherwise.
+func (mc *memoryCollection) update(filter interface{}, update interface{}, many bool, upsert bool, replace bool) (*mongo.UpdateResult, error) {
+	upd, err := normalizeDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	if !replace && !isOperatorDoc(upd) {
+		return nil, fmt.Errorf("update document requires atomic operators")
+	}
+	if replace && isOperatorDoc(upd) {
+		return nil, fmt.Errorf("replacement document cannot contain keys beginning with '$'")
+	}
+
+	q := memoryQuery{filter: filter}
+	if !many {
+		q.limit = 1
+	}
+	docs, err := mc.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &mongo.UpdateResult{MatchedCount: int64(len(docs))}
+	for _, doc := range docs {
+		id, _ := getPath(doc, "_id")
+		updated, err := applyUpdate(doc, upd, false)
+		if err != nil {
+			return nil, err
+		}
+		if newID, ok := getPath(updated, "_id"); !ok || compareValues(newID, id) != 0 {
+			return nil, fmt.Errorf("the _id of a document cannot be changed")
+		}
+		if sameDocument(doc, updated) {
+			continue
+		}
+		mc.docs()[mc.indexOf(id)] = updated
+		result.ModifiedCount++
+	}
+
+	if len(docs) == 0 && upsert {
+		f, err := normalizeDoc(filter)
+		if err != nil {
+			return nil, err
+		}
+		base := upsertDocument(f)
+		if replace {
+			base = primitive.D{}
+			if id, ok := getPath(upsertDocument(f), "_id"); ok {
+				base = primitive.D{{Key: "_id", Value: id}}
+			}
+		}
+		doc, err := applyUpdate(base, upd, true)
+		if err != nil {
+			return nil, err
+		}
+		id, we, err := mc.insert(doc)
+		if err != nil {
+			return nil, err
+		}
+		if we != nil {
+			return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*we}}
+		}
+		result.UpsertedCount = 1
+		result.UpsertedID = id
+	}
+	return result, nil
+}
+
+func sameDocument(a primitive.D, b primitive.D) bool {
+	ra, errA := bson.Marshal(a)
+	rb, errB := bson.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ra, rb)
+}
+
+func (mc *memoryCollection) updateWith(filter interface{}, update interface{}, many bool, opts []*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	defer mc.lock()()
+
+	upsert := false
+	for _, opt := range opts {
+		if opt != nil && opt.Upsert != nil {
+			upsert = *opt.Upsert
+		}
+	}
+	return mc.update(filter, update, many, upsert, false)
+}
+
+// remove deletes one or all the documents matching filter.
+func (mc *memoryCollection) remove(filter interface{}, many bool) (int64, error) {
+	q := memoryQuery{filter: filter}
+	if !many {
+		q.limit = 1
+	}
+	docs, err := mc.query(q)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, doc := range docs {
+		id, _ := getPath(doc, "_id")
+		i := mc.indexOf(id)
+		mc.db.collections[mc.name] = append(mc.docs()[:i:i], mc.docs()[i+1:]...)
+	}
+	return int64(len(docs)), nil
+}
+
+func (mc *memoryCollection) deleteWith(filter interface{}, many bool) (*mongo.DeleteResult, error) {
+	defer mc.lock()()
+
+	n, err := mc.remove(filter, many)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.DeleteResult{DeletedCount: n}, nil
+}
+
+func (mc *memoryCollection) findOneAndUpdate(filter interface{}, update interface{}, opts []*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	defer mc.lock()()
+
+	q := memoryQuery{filter: filter, limit: 1}
+	upsert, after := false, false
+	var projection interface{}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Sort != nil {
+			q.sort = opt.Sort
+		}
+		if opt.Upsert != nil {
+			upsert = *opt.Upsert
+		}
+		if opt.ReturnDocument != nil {
+			after = *opt.ReturnDocument == options.After
+		}
+		if opt.Projection != nil {
+			projection = opt.Projection
+		}
+	}
+
+	docs, err := mc.query(q)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+
+	var before primitive.D
+	selector := filter
+	if len(docs) > 0 {
+		before = docs[0]
+		id, _ := getPath(before, "_id")
+		selector = primitive.D{{Key: "_id", Value: id}}
+	}
+	result, err := mc.update(selector, update, false, upsert, false)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+
+	doc := before
+	if after {
+		id := result.UpsertedID
+		if before != nil {
+			id, _ = getPath(before, "_id")
+		}
+		doc = nil
+		if i := mc.indexOf(id); id != nil && i >= 0 {
+			doc = mc.docs()[i]
+		}
+	}
+	if doc == nil {
+		return singleResult(nil, nil)
+	}
+	found, err := results([]primitive.D{doc}, projection)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	return singleResult(found[0], nil)
+}
+
+func (mc *memoryCollection) aggregate(pipeline interface{}) (*mongo.Cursor, error) {
+	defer mc.lock()()
+
+	pipe, err := normalize(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	stages, ok := pipe.(primitive.A)
+	if !ok {
+		return nil, fmt.Errorf("a pipeline needs an array of stages")
+	}
+
+	docs, err := aggregate(mc.docs(), stages, func(name string) []primitive.D {
+		return mc.db.collections[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+	found, err := results(docs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return mongo.NewCursorFromDocuments(found, nil, nil)
+}
+
+func (mc *memoryCollection) bulkWrite(models []mongo.WriteModel, opts []*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	defer mc.lock()()
+
+	ordered := true
+	for _, opt := range opts {
+		if opt != nil && opt.Ordered != nil {
+			ordered = *opt.Ordered
+		}
+	}
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{}}
+	bwe := mongo.BulkWriteException{}
+	for i, model := range models {
+		var r *mongo.UpdateResult
+		var we *mongo.WriteError
+		var err error
+
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			_, we, err = mc.insert(m.Document)
+			if err == nil && we == nil {
+				result.InsertedCount++
+			}
+		case *mongo.UpdateOneModel:
+			r, err = mc.update(m.Filter, m.Update, false, m.Upsert != nil && *m.Upsert, false)
+		case *mongo.UpdateManyModel:
+			r, err = mc.update(m.Filter, m.Update, true, m.Upsert != nil && *m.Upsert, false)
+		case *mongo.ReplaceOneModel:
+			r, err = mc.update(m.Filter, m.Replacement, false, m.Upsert != nil && *m.Upsert, true)
+		case *mongo.DeleteOneModel, *mongo.DeleteManyModel:
+			var n int64
+			if d, ok := m.(*mongo.DeleteOneModel); ok {
+				n, err = mc.remove(d.Filter, false)
+			} else {
+				n, err = mc.remove(m.(*mongo.DeleteManyModel).Filter, true)
+			}
+			result.DeletedCount += n
+		default:
+			err = fmt.Errorf("%T: %w", model, ErrMemoryUnsupported)
+		}
+
+		if r != nil {
+			result.MatchedCount += r.MatchedCount
+			result.ModifiedCount += r.ModifiedCount
+			result.UpsertedCount += r.UpsertedCount
+			if r.UpsertedID != nil {
+				result.UpsertedIDs[int64(i)] = r.UpsertedID
+			}
+		}
+
+		var writeErr mongo.WriteException
+		if errors.As(err, &writeErr) && len(writeErr.WriteErrors) > 0 {
+			we, err = &writeErr.WriteErrors[0], nil
+		}
+		if err != nil {
+			we = &mongo.WriteError{Code: 2, Message: err.Error()}
+		}
+		if we != nil {
+			we.Index = i
+			bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: *we, Request: model})
+			if ordered {
+				break
+			}
+		}
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return result, bwe
+	}
+	return result, nil
+}
@@ -0,0 +1,459 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// lookupPath returns the values at a dotted path of v, traversing the arrays
+// like mongo does. A missing path returns no values.
+func lookupPath(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	switch t := v.(type) {
+	case primitive.D:
+		for _, e := range t {
+			if e.Key == path[0] {
+				return lookupPath(e.Value, path[1:])
+			}
+		}
+	case primitive.A:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(t) {
+				return lookupPath(t[i], path[1:])
+			}
+			return nil
+		}
+		values := []interface{}{}
+		for _, elem := range t {
+			if _, ok := elem.(primitive.D); ok {
+				values = append(values, lookupPath(elem, path)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func lookupField(doc primitive.D, field string) []interface{} {
+	return lookupPath(doc, strings.Split(field, "."))
+}
+
+// flatten returns values with the elements of the arrays added.
+func flatten(values []interface{}) []interface{} {
+	flat := []interface{}{}
+	for _, v := range values {
+		flat = append(flat, v)
+		if a, ok := v.(primitive.A); ok {
+			flat = append(flat, a...)
+		}
+	}
+	return flat
+}
+
+// match reports whether doc matches filter.
+func match(doc primitive.D, filter primitive.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc primitive.D, e primitive.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		filters, ok := e.Value.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", e.Key)
+		}
+		matched := 0
+		for _, f := range filters {
+			fd, ok := f.(primitive.D)
+			if !ok {
+				return false, fmt.Errorf("%s needs an array of documents", e.Key)
+			}
+			ok, err := match(doc, fd)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched++
+			}
+		}
+		switch e.Key {
+		case "$and":
+			return matched == len(filters), nil
+		case "$or":
+			return matched > 0, nil
+		}
+		return matched == 0, nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("unsupported query operator %s", e.Key)
+	}
+	return matchValues(lookupField(doc, e.Key), e.Value)
+}
+
+func isOperatorDoc(v interface{}) bool {
+	d, ok := v.(primitive.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// matchValues reports whether the values of a field match cond, either a
+// value or an operator document.
+func matchValues(values []interface{}, cond interface{}) (bool, error) {
+	if !isOperatorDoc(cond) {
+		return matchEq(values, cond), nil
+	}
+
+	ops := cond.(primitive.D)
+	for _, op := range ops {
+		ok, err := matchOperator(values, op, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchEq(values []interface{}, cond interface{}) bool {
+	if cond == nil && len(values) == 0 {
+		return true
+	}
+	if re, ok := cond.(primitive.Regex); ok {
+		return matchRegex(values, re.Pattern, re.Options)
+	}
+	for _, v := range flatten(values) {
+		if compareValues(v, cond) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRegex(values []interface{}, pattern string, options string) bool {
+	flags := ""
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	for _, v := range flatten(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOperator(values []interface{}, op primitive.E, ops primitive.D) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEq(values, op.Value), nil
+	case "$ne":
+		return !matchEq(values, op.Value), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range flatten(values) {
+			if typeOrder(v) != typeOrder(op.Value) {
+				continue
+			}
+			c := compareValues(v, op.Value)
+			if (op.Key == "$gt" && c > 0) || (op.Key == "$gte" && c >= 0) ||
+				(op.Key == "$lt" && c < 0) || (op.Key == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := op.Value.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op.Key)
+		}
+		in := false
+		for _, item := range list {
+			if matchEq(values, item) {
+				in = true
+				break
+			}
+		}
+		return in == (op.Key == "$in"), nil
+	case "$all":
+		list, ok := op.Value.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		for _, item := range list {
+			if !matchEq(values, item) {
+				return false, nil
+			}
+		}
+		return len(list) > 0, nil
+	case "$exists":
+		return truthy(op.Value) == (len(values) > 0), nil
+	case "$regex":
+		pattern, options := "", ""
+		switch re := op.Value.(type) {
+		case string:
+			pattern = re
+		case primitive.Regex:
+			pattern, options = re.Pattern, re.Options
+		default:
+			return false, fmt.Errorf("$regex needs a string")
+		}
+		for _, o := range ops {
+			if o.Key == "$options" {
+				options, _ = o.Value.(string)
+			}
+		}
+		return matchRegex(values, pattern, options), nil
+	case "$options":
+		return true, nil
+	case "$size":
+		size, ok := toFloat(op.Value)
+		if !ok {
+			return false, fmt.Errorf("$size needs a number")
+		}
+		for _, v := range values {
+			if a, ok := v.(primitive.A); ok && float64(len(a)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		cond, ok := op.Value.(primitive.D)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch needs a document")
+		}
+		for _, v := range values {
+			a, _ := v.(primitive.A)
+			for _, elem := range a {
+				var ok bool
+				var err error
+				if isOperatorDoc(cond) {
+					ok, err = matchValues([]interface{}{elem}, cond)
+				} else if d, isDoc := elem.(primitive.D); isDoc {
+					ok, err = match(d, cond)
+				}
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$not":
+		if _, ok := op.Value.(primitive.Regex); !ok && !isOperatorDoc(op.Value) {
+			return false, fmt.Errorf("$not needs a regex or a document")
+		}
+		ok, err := matchValues(values, op.Value)
+		return !ok, err
+	}
+	return false, fmt.Errorf("unsupported query operator %s", op.Key)
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// typeOrder is the rank of the bson type of v in the mongo sort order.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 1
+	case nil, primitive.Null, primitive.Undefined:
+		return 2
+	case int32, int64, float64, int, primitive.Decimal128:
+		return 3
+	case string, primitive.Symbol:
+		return 4
+	case primitive.D:
+		return 5
+	case primitive.A:
+		return 6
+	case primitive.Binary:
+		return 7
+	case primitive.ObjectID:
+		return 8
+	case bool:
+		return 9
+	case primitive.DateTime:
+		return 10
+	case primitive.Timestamp:
+		return 11
+	case primitive.Regex:
+		return 12
+	case primitive.MaxKey:
+		return 13
+	}
+	return 14
+}
+
+// compareValues compares a and b in the mongo sort order.
+func compareValues(a interface{}, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return ta - tb
+	}
+
+	switch x := a.(type) {
+	case nil, primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return 0
+	case string:
+		y, _ := b.(string)
+		return strings.Compare(x, y)
+	case primitive.D:
+		y := b.(primitive.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	case primitive.A:
+		y := b.(primitive.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return compareInts(int64(x), int64(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return compareInts(int64(x.T), int64(y.T))
+		}
+		return compareInts(int64(x.I), int64(y.I))
+	}
+
+	if fa, ok := toFloat(a); ok {
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		case math.IsNaN(fa) || math.IsNaN(fb):
+			return compareInts(boolInt(!math.IsNaN(fa)), boolInt(!math.IsNaN(fb)))
+		}
+		return 0
+	}
+
+	ra, rb := rawValue(a), rawValue(b)
+	return bytes.Compare(ra.Value, rb.Value)
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// normalize converts v, e.g. a filter or a struct, to the primitive types
+// the in-memory documents are made of.
+func normalize(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc primitive.D
+	wrapped, err := bson.Marshal(primitive.D{{Key: "v", Value: bson.RawValue{Type: t, Value: data}}})
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(wrapped, &doc); err != nil {
+		return nil, err
+	}
+	return doc[0].Value, nil
+}
+
+// normalizeDoc converts a document to a primitive.D, nil is an empty one.
+func normalizeDoc(v interface{}) (primitive.D, error) {
+	if v == nil {
+		return primitive.D{}, nil
+	}
+	n, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := n.(primitive.D)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a document", v)
+	}
+	return doc, nil
+}
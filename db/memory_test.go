@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/vavas/go_services/db/query"
+)
+
+type memoryUser struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Name      string             `bson:"name"`
+	Age       int                `bson:"age"`
+	Tags      []string           `bson:"tags"`
+	Logins    int                `bson:"logins"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty"`
+}
+
+func memoryUsers(t *testing.T) *Collection {
+	c := NewMemory().Col("users")
+	_, err := c.InsertAll([]interface{}{
+		memoryUser{Name: "ann", Age: 31, Tags: []string{"admin", "beta"}},
+		memoryUser{Name: "bob", Age: 25, Tags: []string{"beta"}},
+		memoryUser{Name: "cid", Age: 40},
+		memoryUser{Name: "dan", Age: 25, Tags: []string{"admin"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	return c
+}
+
+func names(users []memoryUser) []string {
+	n := []string{}
+	for _, u := range users {
+		n = append(n, u.Name)
+	}
+	return n
+}
+
+func TestMemoryFind(t *testing.T) {
+	c := memoryUsers(t)
+
+	for _, test := range []struct {
+		filter   interface{}
+		opts     *options.FindOptions
+		expected []string
+	}{
+		{nil, nil, []string{"ann", "bob", "cid", "dan"}},
+		{query.Eq("age", 25), nil, []string{"bob", "dan"}},
+		{query.Gte("age", 31), nil, []string{"ann", "cid"}},
+		{query.In("name", "ann", "cid", "zed"), nil, []string{"ann", "cid"}},
+		{query.Eq("tags", "beta"), nil, []string{"ann", "bob"}},
+		{query.Size("tags", 2), nil, []string{"ann"}},
+		{query.Exists("tags", false), nil, []string{}},
+		{query.Eq("tags", nil), nil, []string{"cid"}},
+		{query.Regex("name", "^[ab]", ""), nil, []string{"ann", "bob"}},
+		{query.Or(query.Eq("name", "cid"), query.Lt("age", 26)), nil, []string{"bob", "cid", "dan"}},
+		{query.Not(query.Eq("age", 25)), nil, []string{"ann", "cid"}},
+		{query.Not(query.Gt("age", 25)), nil, []string{"bob", "dan"}},
+		{query.Not(query.Regex("name", "^[ab]", "")), nil, []string{"cid", "dan"}},
+		{primitive.M{"age": primitive.M{"$ne": 25}, "tags": "admin"}, nil, []string{"ann"}},
+		{nil, options.Find().SetSort(query.SortBy("age", "-name")), []string{"dan", "bob", "ann", "cid"}},
+		{nil, options.Find().SetSort(query.SortBy("-age")).SetSkip(1).SetLimit(2), []string{"ann", "bob"}},
+	} {
+		users := []memoryUser{}
+		if err := c.All(test.filter, test.opts, &users); err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+		if got := names(users); len(got) != len(test.expected) || (len(got) > 0 && !equalStrings(got, test.expected)) {
+			t.Errorf("Unexpected users of %+v: %+v, expected %+v", test.filter, got, test.expected)
+		}
+	}
+
+	user := memoryUser{}
+	if err := c.One(query.Eq("name", "bob"), nil, &user); err != nil || user.Age != 25 || user.CreatedAt.IsZero() {
+		t.Errorf("Unexpected user: %+v (%+v)", user, err)
+	}
+	if err := c.One(query.Eq("name", "zed"), nil, &user); err != mongo.ErrNoDocuments {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, mongo.ErrNoDocuments)
+	}
+	if n, err := c.Count(query.Eq("tags", "admin")); err != nil || n != 2 {
+		t.Errorf("Unexpected count: %+v (%+v), expected %+v", n, err, 2)
+	}
+	if ages, err := c.FindDistinct(nil, "age", nil); err != nil || len(ages) != 3 {
+		t.Errorf("Unexpected distinct ages: %+v (%+v)", ages, err)
+	}
+	if err := c.All(primitive.M{"age": primitive.M{"$where": 1}}, nil, &[]memoryUser{}); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an unsupported operator error", err)
+	}
+	if err := c.All(primitive.M{"age": primitive.M{"$not": 25}}, nil, &[]memoryUser{}); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an invalid $not error", err)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	c := memoryUsers(t)
+
+	update := query.NewUpdate().Inc("logins", 2).Push("tags", "new").Set("age", 26)
+	if err := c.Update(query.Eq("name", "bob"), update); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	user := memoryUser{}
+	if err := c.One(query.Eq("name", "bob"), nil, &user); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if user.Logins != 2 || user.Age != 26 || !equalStrings(user.Tags, []string{"beta", "new"}) {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if !user.UpdatedAt.After(user.CreatedAt) && !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Errorf("Unexpected updated_at: %+v, created_at %+v", user.UpdatedAt, user.CreatedAt)
+	}
+
+	result, err := c.UpdateAll(query.Eq("tags", "admin"), primitive.M{"$pull": primitive.M{"tags": "admin"}})
+	if err != nil || result.MatchedCount != 2 || result.ModifiedCount != 2 {
+		t.Errorf("Unexpected result: %+v (%+v)", result, err)
+	}
+
+	if err := c.Update(query.Eq("name", "eve"), query.NewUpdate().Set("age", 50), true); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if err := c.One(query.Eq("name", "eve"), nil, &user); err != nil || user.Age != 50 || user.CreatedAt.IsZero() {
+		t.Errorf("Unexpected upserted user: %+v (%+v)", user, err)
+	}
+
+	modified := memoryUser{}
+	if err := c.Modify(query.Eq("name", "cid"), primitive.M{"age": 41}, &modified); err != nil || modified.Age != 41 {
+		t.Errorf("Unexpected modified user: %+v (%+v)", modified, err)
+	}
+
+	if err := c.Update(query.Eq("name", "cid"), primitive.M{"age": 42}); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an error for an update without operators", err)
+	}
+	if _, err := c.Insert(primitive.M{"_id": user.ID}); !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("Unexpected error: %+v, expected a duplicate key error", err)
+	}
+}
+
+func TestMemoryRemove(t *testing.T) {
+	c := memoryUsers(t).WithSoftDelete()
+
+	if err := c.Remove(query.Eq("name", "ann")); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if n, _ := c.Count(nil); n != 3 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 3)
+	}
+	if n, _ := c.WithDeleted().Count(nil); n != 4 {
+		t.Errorf("Unexpected count with the deleted: %+v, expected %+v", n, 4)
+	}
+
+	if err := c.RemoveAll(query.Eq("age", 25)); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if n, _ := c.Count(nil); n != 1 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 1)
+	}
+	if n, err := c.Purge(-1); err != nil || n != 3 {
+		t.Errorf("Unexpected purged count: %+v (%+v), expected %+v", n, err, 3)
+	}
+	if n, _ := c.WithDeleted().Count(nil); n != 1 {
+		t.Errorf("Unexpected count after the purge: %+v, expected %+v", n, 1)
+	}
+}
+
+func TestMemoryAggregate(t *testing.T) {
+	c := memoryUsers(t)
+
+	pipe := query.NewPipeline().
+		Group("$age", query.Count("count"), query.PushAcc("names", "$name")).
+		Sort("-count", "_id").
+		Build()
+	groups := []struct {
+		Age   int      `bson:"_id"`
+		Count int      `bson:"count"`
+		Names []string `bson:"names"`
+	}{}
+	if err := c.AggregatePipe(pipe, &groups); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if len(groups) != 3 || groups[0].Age != 25 || groups[0].Count != 2 || !equalStrings(groups[0].Names, []string{"bob", "dan"}) {
+		t.Errorf("Unexpected groups: %+v", groups)
+	}
+
+	pipe = query.NewPipeline().
+		Unwind("$tags").
+		Group("$tags", query.Avg("age", "$age")).
+		Match(query.Eq("_id", "beta")).
+		Build()
+	avgs := []primitive.M{}
+	if err := c.AggregatePipe(pipe, &avgs); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if len(avgs) != 1 || avgs[0]["age"] != 28.0 {
+		t.Errorf("Unexpected averages: %+v", avgs)
+	}
+
+	pipe = query.NewPipeline().Stage("$bucket", primitive.M{}).Build()
+	if err := c.AggregatePipe(pipe, &avgs); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an unsupported stage error", err)
+	}
+}
+
+func TestMemoryCol(t *testing.T) {
+	m, other := NewMemory(), NewMemory()
+	ctx := context.Background()
+
+	if _, err := NewRepo[memoryUser](m.DB(), "users").Insert(ctx, &memoryUser{Name: "ann"}); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if n, _ := m.Col("users").Count(nil); n != 1 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 1)
+	}
+	if n, _ := Col(other.DB(), "users").Count(nil); n != 0 {
+		t.Errorf("Unexpected count of the other database: %+v, expected %+v", n, 0)
+	}
+
+	// the driver collection is the never connected one of the database
+	c := m.Col("users")
+	if c.Collection == nil || c.Collection.Name() != "users" || c.Database().Client() != m.DB().Client() {
+		t.Errorf("Unexpected driver collection: %+v", c.Collection)
+	}
+	if n, _ := Col(c.Database(), "users").Count(nil); n != 1 {
+		t.Errorf("Unexpected count of the collection database: %+v, expected %+v", n, 1)
+	}
+	if _, err := c.Indexes().List(ctx); err == nil {
+		t.Errorf("Unexpected nil error listing the indexes of a memory collection")
+	}
+
+	err := m.Client().WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := m.Client().Col("users").InsertContext(ctx, &memoryUser{Name: "bob"})
+		return err
+	})
+	if n, _ := m.Col("users").Count(nil); err != nil || n != 2 {
+		t.Errorf("Unexpected count: %+v (%+v), expected %+v", n, err, 2)
+	}
+}
+
+func TestMemoryAudit(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	c := Col(m.DB(), "users").WithAudit()
+
+	if _, err := c.InsertContext(ctx, &memoryUser{Name: "ann"}); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if err := c.UpdateContext(ctx, query.Eq("name", "ann"), query.NewUpdate().Set("age", 31)); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	entries, err := FindAudit(ctx, m.DB(), AuditQuery{Collection: "users"})
+	if err != nil || len(entries) != 2 || entries[0].Operation != AuditUpdate || entries[1].Operation != AuditInsert {
+		t.Errorf("Unexpected audit entries: %+v (%+v)", entries, err)
+	}
+}
@@ -0,0 +1,302 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// getPath returns the value at a dotted path of doc, without traversing the
+// arrays other than by index.
+func getPath(doc primitive.D, field string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, key := range strings.Split(field, ".") {
+		switch t := v.(type) {
+		case primitive.D:
+			found := false
+			for _, e := range t {
+				if e.Key == key {
+					v, found = e.Value, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case primitive.A:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath sets the value at a dotted path of doc, creating the missing
+// embedded documents.
+func setPath(doc primitive.D, field string, value interface{}) (primitive.D, error) {
+	v, err := setIn(doc, strings.Split(field, "."), value)
+	if err != nil {
+		return nil, err
+	}
+	return v.(primitive.D), nil
+}
+
+func setIn(v interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch t := v.(type) {
+	case primitive.D:
+		for i, e := range t {
+			if e.Key == path[0] {
+				set, err := setIn(e.Value, path[1:], value)
+				if err != nil {
+					return nil, err
+				}
+				t[i].Value = set
+				return t, nil
+			}
+		}
+		set, err := setIn(primitive.D{}, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return append(t, primitive.E{Key: path[0], Value: set}), nil
+	case primitive.A:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("cannot set field %s of an array", path[0])
+		}
+		for len(t) <= i {
+			t = append(t, nil)
+		}
+		set, err := setIn(t[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = set
+		return t, nil
+	case nil:
+		return setIn(primitive.D{}, path, value)
+	}
+	return nil, fmt.Errorf("cannot set field %s of a %T", path[0], v)
+}
+
+// unsetPath removes the value at a dotted path of doc.
+func unsetPath(doc primitive.D, field string) primitive.D {
+	path := strings.Split(field, ".")
+	parent := interface{}(doc)
+	if len(path) > 1 {
+		var ok bool
+		if parent, ok = getPath(doc, strings.Join(path[:len(path)-1], ".")); !ok {
+			return doc
+		}
+	}
+	key := path[len(path)-1]
+
+	switch t := parent.(type) {
+	case primitive.D:
+		for i, e := range t {
+			if e.Key == key {
+				removed := append(t[:i:i], t[i+1:]...)
+				if len(path) == 1 {
+					return removed
+				}
+				doc, _ = setPath(doc, strings.Join(path[:len(path)-1], "."), removed)
+				return doc
+			}
+		}
+	case primitive.A:
+		// like mongo, unsetting an array element sets it to null
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(t) {
+			t[i] = nil
+		}
+	}
+	return doc
+}
+
+// applyUpdate returns doc updated with update, an operator document or a
+// replacement. The $setOnInsert fields are only set when inserting.
+func applyUpdate(doc primitive.D, update primitive.D, inserting bool) (primitive.D, error) {
+	if !isOperatorDoc(update) {
+		replaced := primitive.D{}
+		if id, ok := getPath(doc, "_id"); ok {
+			replaced = append(replaced, primitive.E{Key: "_id", Value: id})
+		}
+		for _, e := range update {
+			if e.Key != "_id" || len(replaced) == 0 {
+				replaced = append(replaced, e)
+			}
+		}
+		return replaced, nil
+	}
+
+	doc = cloneValue(doc).(primitive.D)
+	for _, op := range update {
+		fields, ok := op.Value.(primitive.D)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a document", op.Key)
+		}
+		for _, f := range fields {
+			var err error
+			if doc, err = applyOperator(doc, op.Key, f, inserting); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+func applyOperator(doc primitive.D, operator string, f primitive.E, inserting bool) (primitive.D, error) {
+	current, exists := getPath(doc, f.Key)
+
+	switch operator {
+	case "$set":
+		return setPath(doc, f.Key, f.Value)
+	case "$setOnInsert":
+		if !inserting {
+			return doc, nil
+		}
+		return setPath(doc, f.Key, f.Value)
+	case "$unset":
+		return unsetPath(doc, f.Key), nil
+	case "$inc":
+		if !exists {
+			return setPath(doc, f.Key, f.Value)
+		}
+		sum, err := addNumbers(current, f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("$inc of %s: %v", f.Key, err)
+		}
+		return setPath(doc, f.Key, sum)
+	case "$min", "$max":
+		c := compareValues(f.Value, current)
+		if !exists || (operator == "$min" && c < 0) || (operator == "$max" && c > 0) {
+			return setPath(doc, f.Key, f.Value)
+		}
+		return doc, nil
+	case "$currentDate":
+		var at interface{} = primitive.NewDateTimeFromTime(now())
+		if spec, ok := f.Value.(primitive.D); ok && len(spec) > 0 && spec[0].Value == "timestamp" {
+			at = primitive.Timestamp{T: uint32(time.Now().Unix())}
+		}
+		return setPath(doc, f.Key, at)
+	case "$push", "$addToSet":
+		array := primitive.A{}
+		if exists {
+			var ok bool
+			if array, ok = current.(primitive.A); !ok {
+				return nil, fmt.Errorf("%s of %s: not an array", operator, f.Key)
+			}
+		}
+		values := primitive.A{f.Value}
+		if spec, ok := f.Value.(primitive.D); ok && len(spec) > 0 && spec[0].Key == "$each" {
+			if values, ok = spec[0].Value.(primitive.A); !ok {
+				return nil, fmt.Errorf("$each needs an array")
+			}
+		}
+		for _, v := range values {
+			if operator == "$addToSet" && contains(array, v) {
+				continue
+			}
+			array = append(array, v)
+		}
+		return setPath(doc, f.Key, array)
+	case "$pull":
+		array, ok := current.(primitive.A)
+		if !ok {
+			return doc, nil
+		}
+		kept := primitive.A{}
+		for _, elem := range array {
+			pulled, err := matchPull(elem, f.Value)
+			if err != nil {
+				return nil, err
+			}
+			if !pulled {
+				kept = append(kept, elem)
+			}
+		}
+		return setPath(doc, f.Key, kept)
+	}
+	return nil, fmt.Errorf("unsupported update operator %s", operator)
+}
+
+func contains(array primitive.A, v interface{}) bool {
+	for _, elem := range array {
+		if compareValues(elem, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPull(elem interface{}, cond interface{}) (bool, error) {
+	if isOperatorDoc(cond) {
+		return matchValues([]interface{}{elem}, cond)
+	}
+	if c, ok := cond.(primitive.D); ok {
+		if d, ok := elem.(primitive.D); ok {
+			return match(d, c)
+		}
+	}
+	return compareValues(elem, cond) == 0, nil
+}
+
+// addNumbers adds two numbers keeping the widest type, like mongo.
+func addNumbers(a interface{}, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int32:
+		switch y := b.(type) {
+		case int32:
+			if sum := int64(x) + int64(y); sum >= math.MinInt32 && sum <= math.MaxInt32 {
+				return int32(sum), nil
+			}
+			return int64(x) + int64(y), nil
+		case int64:
+			return int64(x) + y, nil
+		}
+	case int64:
+		switch y := b.(type) {
+		case int32:
+			return x + int64(y), nil
+		case int64:
+			return x + y, nil
+		}
+	}
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("cannot add %T and %T", a, b)
+	}
+	return fa + fb, nil
+}
+
+// cloneValue returns a deep copy of the documents and arrays of v.
+func cloneValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		d := make(primitive.D, len(t))
+		for i, e := range t {
+			d[i] = primitive.E{Key: e.Key, Value: cloneValue(e.Value)}
+		}
+		return d
+	case primitive.A:
+		a := make(primitive.A, len(t))
+		for i, e := range t {
+			a[i] = cloneValue(e)
+		}
+		return a
+	}
+	return v
+}
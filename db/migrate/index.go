@@ -0,0 +1,236 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Index is the declaration of an index of a collection.
+type Index struct {
+	Collection string
+	// Name defaults to the name mongo generates, e.g. "email_1_created_at_-1".
+	Name string
+	// Keys in order, a compound index has several keys.
+	Keys   bson.D
+	Unique bool
+	Sparse bool
+	// TTL removes documents once the date in the single key is older.
+	TTL time.Duration
+	// Partial only indexes the documents matching the filter.
+	Partial interface{}
+}
+
+// IndexActionType is what reconciling does with an index.
+type IndexActionType string
+
+// Index actions.
+const (
+	IndexCreate   IndexActionType = "create"
+	IndexRecreate IndexActionType = "recreate"
+	IndexDrop     IndexActionType = "drop"
+)
+
+// IndexAction is a change of an index.
+type IndexAction struct {
+	Collection string          `json:"collection"`
+	Name       string          `json:"name"`
+	Action     IndexActionType `json:"action"`
+
+	index *Index
+}
+
+// existingIndex is an index as listed by mongo.
+type existingIndex struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique"`
+	Sparse                  bool   `bson:"sparse"`
+	ExpireAfterSeconds      *int64 `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.D `bson:"partialFilterExpression"`
+}
+
+func (index *Index) name() string {
+	if len(index.Name) > 0 {
+		return index.Name
+	}
+
+	parts := make([]string, 0, 2*len(index.Keys))
+	for _, key := range index.Keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (index *Index) validate() error {
+	if len(index.Collection) == 0 {
+		return errors.New("migrate: index without collection")
+	}
+	if len(index.Keys) == 0 {
+		return fmt.Errorf("migrate: index %s.%s without keys", index.Collection, index.Name)
+	}
+	if index.TTL > 0 && len(index.Keys) != 1 {
+		return fmt.Errorf("migrate: ttl index %s.%s must have a single key", index.Collection, index.name())
+	}
+	if index.TTL < 0 || index.TTL%time.Second != 0 {
+		return fmt.Errorf("migrate: ttl of index %s.%s must be whole seconds", index.Collection, index.name())
+	}
+	return nil
+}
+
+func (index *Index) model() mongo.IndexModel {
+	opts := options.Index().SetName(index.name())
+	if index.Unique {
+		opts.SetUnique(true)
+	}
+	if index.Sparse {
+		opts.SetSparse(true)
+	}
+	if index.TTL > 0 {
+		opts.SetExpireAfterSeconds(int32(index.TTL / time.Second))
+	}
+	if index.Partial != nil {
+		opts.SetPartialFilterExpression(index.Partial)
+	}
+	return mongo.IndexModel{Keys: index.Keys, Options: opts}
+}
+
+// matches returns true if the existing index is the declared one.
+func (index *Index) matches(existing *existingIndex) bool {
+	if index.Unique != existing.Unique || index.Sparse != existing.Sparse {
+		return false
+	}
+
+	var ttl int64
+	if existing.ExpireAfterSeconds != nil {
+		ttl = *existing.ExpireAfterSeconds
+	}
+	if int64(index.TTL/time.Second) != ttl {
+		return false
+	}
+
+	if !sameDocument(index.Keys, existing.Key) {
+		return false
+	}
+
+	var partial interface{} = bson.D{}
+	if index.Partial != nil {
+		partial = index.Partial
+	}
+	existingPartial := existing.PartialFilterExpression
+	if existingPartial == nil {
+		existingPartial = bson.D{}
+	}
+	return sameDocument(partial, existingPartial)
+}
+
+// sameDocument compares documents ignoring the integer types.
+func sameDocument(a interface{}, b interface{}) bool {
+	aJSON, err := bson.MarshalExtJSON(a, false, false)
+	if err != nil {
+		return false
+	}
+	bJSON, err := bson.MarshalExtJSON(b, false, false)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// diffIndexes returns the actions turning the existing indexes of a
+// collection into the declared ones.
+func diffIndexes(collection string, declared []*Index, existing []existingIndex, dropUnknown bool) []IndexAction {
+	byName := map[string]*existingIndex{}
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+	}
+
+	actions := []IndexAction{}
+	known := map[string]bool{"_id_": true}
+	for _, index := range declared {
+		name := index.name()
+		known[name] = true
+
+		current, ok := byName[name]
+		switch {
+		case !ok:
+			actions = append(actions, IndexAction{Collection: collection, Name: name, Action: IndexCreate, index: index})
+		case !index.matches(current):
+			actions = append(actions, IndexAction{Collection: collection, Name: name, Action: IndexRecreate, index: index})
+		}
+	}
+
+	if dropUnknown {
+		for _, current := range existing {
+			if !known[current.Name] {
+				actions = append(actions, IndexAction{Collection: collection, Name: current.Name, Action: IndexDrop})
+			}
+		}
+	}
+
+	return actions
+}
+
+func (m *Migrator) planIndexes(ctx context.Context) ([]IndexAction, error) {
+	byCollection := map[string][]*Index{}
+	for i := range m.Indexes {
+		index := &m.Indexes[i]
+		byCollection[index.Collection] = append(byCollection[index.Collection], index)
+	}
+
+	collections := make([]string, 0, len(byCollection))
+	for collection := range byCollection {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	actions := []IndexAction{}
+	for _, collection := range collections {
+		existing, err := m.listIndexes(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, diffIndexes(collection, byCollection[collection], existing, m.DropUnknownIndexes)...)
+	}
+
+	return actions, nil
+}
+
+func (m *Migrator) listIndexes(ctx context.Context, collection string) ([]existingIndex, error) {
+	cur, err := m.DB.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	existing := []existingIndex{}
+	if err := cur.All(ctx, &existing); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, action IndexAction) error {
+	indexes := m.DB.Collection(action.Collection).Indexes()
+
+	if action.Action == IndexDrop || action.Action == IndexRecreate {
+		if _, err := indexes.DropOne(ctx, action.Name); err != nil {
+			return fmt.Errorf("drop index %s.%s: %w", action.Collection, action.Name, err)
+		}
+	}
+
+	if action.Action == IndexCreate || action.Action == IndexRecreate {
+		if _, err := indexes.CreateOne(ctx, action.index.model()); err != nil {
+			return fmt.Errorf("create index %s.%s: %w", action.Collection, action.Name, err)
+		}
+	}
+
+	return nil
+}
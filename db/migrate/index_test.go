@@ -0,0 +1,44 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	ttl := int64(3600)
+	existing := []existingIndex{
+		{Name: "_id_", Key: bson.D{{Key: "_id", Value: int32(1)}}},
+		{Name: "email_1", Key: bson.D{{Key: "email", Value: int32(1)}}, Unique: true},
+		{Name: "created_at_1", Key: bson.D{{Key: "created_at", Value: int32(1)}}, ExpireAfterSeconds: &ttl},
+		{Name: "legacy_1", Key: bson.D{{Key: "legacy", Value: int32(1)}}},
+	}
+	declared := []*Index{
+		{Collection: "users", Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+		{Collection: "users", Keys: bson.D{{Key: "created_at", Value: 1}}, TTL: 2 * time.Hour},
+		{Collection: "users", Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Partial: bson.D{{Key: "deleted_at", Value: nil}}},
+	}
+
+	actions := diffIndexes("users", declared, existing, true)
+
+	expected := map[string]IndexActionType{
+		"created_at_1":               IndexRecreate,
+		"account_id_1_created_at_-1": IndexCreate,
+		"legacy_1":                   IndexDrop,
+	}
+	if len(actions) != len(expected) {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	for _, action := range actions {
+		if expected[action.Name] != action.Action {
+			t.Errorf("Unexpected action for %s: %+v, expected %+v", action.Name, action.Action, expected[action.Name])
+		}
+	}
+
+	if actions := diffIndexes("users", declared[:1], existing, false); len(actions) != 0 {
+		t.Errorf("Unexpected actions without drop: %+v", actions)
+	}
+}
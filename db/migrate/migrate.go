@@ -0,0 +1,372 @@
+// Package migrate runs versioned database migrations and reconciles the
+// declared indexes of the collections on startup.
+//
+//	m := &migrate.Migrator{
+//		DB: db.DB(),
+//		Migrations: []migrate.Migration{
+//			{Version: 1, Name: "split user name", Up: splitUserName},
+//		},
+//		Indexes: []migrate.Index{
+//			{Collection: "users", Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+//			{Collection: "sessions", Keys: bson.D{{Key: "created_at", Value: 1}}, TTL: 24 * time.Hour},
+//		},
+//	}
+//	report, err := m.Run(ctx)
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/logger"
+)
+
+// Collection is the name of the collection the applied migrations and the
+// lock document are stored in.
+const Collection = "_migrations"
+
+const lockID = "lock"
+
+// ErrLocked is returned when another process is running the migrations.
+var ErrLocked = errors.New("migrations are locked by another process")
+
+// ErrLockLost is returned when the lock could not be renewed during a run,
+// the running migration is cancelled.
+var ErrLockLost = errors.New("migrations lock lost")
+
+// Migration is a versioned migration step. Versions must be unique and are
+// applied in ascending order.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, dbc *mongo.Database) error
+}
+
+// Migrator applies migrations and reconciles indexes of a database.
+type Migrator struct {
+	DB         *mongo.Database
+	Migrations []Migration
+	Indexes    []Index
+
+	// DryRun reports what would be done without changing anything.
+	DryRun bool
+	// DropUnknownIndexes drops the indexes of the declared collections that
+	// are not declared.
+	DropUnknownIndexes bool
+	// LockTTL is how long a lock is honoured, so a crashed process does not
+	// block the migrations forever. Defaults to 10 minutes. The lock is
+	// renewed every third of it while the migrations run.
+	LockTTL time.Duration
+
+	Logger *zap.Logger
+}
+
+// Report describes the migrations and index changes of a run.
+type Report struct {
+	Applied []MigrationStatus `json:"applied"`
+	Pending []MigrationStatus `json:"pending"`
+	Indexes []IndexAction     `json:"indexes"`
+	DryRun  bool              `json:"dry_run"`
+}
+
+// MigrationStatus is a migration with the time it was applied.
+type MigrationStatus struct {
+	Version   int           `json:"version" bson:"_id"`
+	Name      string        `json:"name" bson:"name"`
+	AppliedAt time.Time     `json:"applied_at,omitempty" bson:"applied_at"`
+	Duration  time.Duration `json:"duration,omitempty" bson:"duration"`
+}
+
+type lockDocument struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	LockedAt  time.Time `bson:"locked_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func (m *Migrator) logger() *zap.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return logger.Logger
+}
+
+func (m *Migrator) col() *mongo.Collection {
+	return m.DB.Collection(Collection)
+}
+
+// Status reports the applied and pending migrations and the index changes
+// a run would make, without changing anything.
+func (m *Migrator) Status(ctx context.Context) (*Report, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{DryRun: true}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Applied = applied
+	report.Pending = m.pending(applied)
+
+	report.Indexes, err = m.planIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Run applies the pending migrations and reconciles the indexes. It returns
+// ErrLocked if another process is running. With DryRun it works like Status.
+func (m *Migrator) Run(ctx context.Context) (*Report, error) {
+	if m.DryRun {
+		return m.Status(ctx)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	owner, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.unlock(owner)
+	ctx, stop := m.keepLock(ctx, owner)
+	defer stop()
+
+	report := &Report{}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range m.pending(applied) {
+		migration := m.migration(status.Version)
+		if err := ctx.Err(); err != nil {
+			report.Applied = applied
+			return report, lockErr(ctx, err)
+		}
+
+		m.logger().Info("applying migration",
+			zap.Int("version", migration.Version),
+			zap.String("name", migration.Name))
+
+		start := time.Now()
+		if err := migration.Up(ctx, m.DB); err != nil {
+			report.Applied = applied
+			return report, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, lockErr(ctx, err))
+		}
+
+		status.AppliedAt = time.Now()
+		status.Duration = status.AppliedAt.Sub(start)
+		if _, err := m.col().InsertOne(ctx, status); err != nil {
+			report.Applied = applied
+			return report, lockErr(ctx, err)
+		}
+		applied = append(applied, status)
+	}
+	report.Applied = applied
+
+	actions, err := m.planIndexes(ctx)
+	if err != nil {
+		return report, lockErr(ctx, err)
+	}
+	for _, action := range actions {
+		m.logger().Info("reconciling index",
+			zap.String("collection", action.Collection),
+			zap.String("index", action.Name),
+			zap.String("action", string(action.Action)))
+
+		if err := m.apply(ctx, action); err != nil {
+			return report, lockErr(ctx, err)
+		}
+		report.Indexes = append(report.Indexes, action)
+	}
+
+	return report, nil
+}
+
+func (m *Migrator) validate() error {
+	if m.DB == nil {
+		return errors.New("migrate: DB is nil")
+	}
+
+	versions := map[int]bool{}
+	for _, migration := range m.Migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("migrate: migration %q must have a positive version", migration.Name)
+		}
+		if versions[migration.Version] {
+			return fmt.Errorf("migrate: duplicate migration version %d", migration.Version)
+		}
+		if migration.Up == nil {
+			return fmt.Errorf("migrate: migration %d has no Up", migration.Version)
+		}
+		versions[migration.Version] = true
+	}
+
+	for _, index := range m.Indexes {
+		if err := index.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) ([]MigrationStatus, error) {
+	cur, err := m.col().Find(ctx,
+		bson.M{"_id": bson.M{"$type": "number"}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	applied := []MigrationStatus{}
+	if err := cur.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (m *Migrator) pending(applied []MigrationStatus) []MigrationStatus {
+	done := map[int]bool{}
+	for _, status := range applied {
+		done[status.Version] = true
+	}
+
+	pending := []MigrationStatus{}
+	for _, migration := range m.Migrations {
+		if !done[migration.Version] {
+			pending = append(pending, MigrationStatus{Version: migration.Version, Name: migration.Name})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+	return pending
+}
+
+func (m *Migrator) migration(version int) Migration {
+	for _, migration := range m.Migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return Migration{}
+}
+
+func (m *Migrator) lockTTL() time.Duration {
+	if m.LockTTL > 0 {
+		return m.LockTTL
+	}
+	return 10 * time.Minute
+}
+
+func (m *Migrator) lock(ctx context.Context) (string, error) {
+	ttl := m.lockTTL()
+
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%s", host, os.Getpid(), primitive.NewObjectID().Hex())
+	now := time.Now()
+	lock := lockDocument{ID: lockID, Owner: owner, LockedAt: now, ExpiresAt: now.Add(ttl)}
+
+	_, err := m.col().InsertOne(ctx, lock)
+	if err == nil {
+		return owner, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return "", err
+	}
+
+	// take over an expired lock
+	result, err := m.col().ReplaceOne(ctx, bson.M{"_id": lockID, "expires_at": bson.M{"$lt": now}}, lock)
+	if err != nil {
+		return "", err
+	}
+	if result.ModifiedCount == 0 {
+		return "", ErrLocked
+	}
+	return owner, nil
+}
+
+func (m *Migrator) unlock(owner string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := m.col().DeleteOne(ctx, bson.M{"_id": lockID, "owner": owner}); err != nil {
+		m.logger().Error("can not release migrations lock", zap.Error(err))
+	}
+}
+
+// keepLock renews the lock until stop is called. The returned context is
+// cancelled with ErrLockLost when the lock is taken over or can't be renewed
+// before it expires, so a migration never runs unlocked.
+func (m *Migrator) keepLock(ctx context.Context, owner string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	ttl := m.lockTTL()
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		expiresAt := time.Now().Add(ttl)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			now := time.Now()
+			result, err := m.col().UpdateOne(ctx,
+				bson.M{"_id": lockID, "owner": owner},
+				bson.M{"$set": bson.M{"expires_at": now.Add(ttl)}})
+			switch {
+			case err == nil && result.MatchedCount == 0:
+				m.logger().Error("migrations lock taken over", zap.String("owner", owner))
+				cancel(ErrLockLost)
+				return
+			case err == nil:
+				expiresAt = now.Add(ttl)
+			case now.Add(ttl / 3).After(expiresAt):
+				m.logger().Error("can not renew migrations lock", zap.Error(err))
+				cancel(fmt.Errorf("%w: %s", ErrLockLost, err.Error()))
+				return
+			default:
+				m.logger().Warn("can not renew migrations lock, retrying", zap.Error(err))
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
+
+// lockErr returns the ErrLockLost cause of the cancellation of ctx instead of
+// err.
+func lockErr(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrLockLost) {
+		return cause
+	}
+	return err
+}
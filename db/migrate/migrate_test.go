@@ -0,0 +1,19 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLockErr(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if err := lockErr(ctx, errors.New("failed")); err.Error() != "failed" {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, "failed")
+	}
+
+	cancel(ErrLockLost)
+	if err := lockErr(ctx, ctx.Err()); !errors.Is(err, ErrLockLost) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrLockLost)
+	}
+}
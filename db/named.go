@@ -0,0 +1,86 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// DefaultName is the name of the Default client in Named.
+const DefaultName = "default"
+
+var (
+	namedMu      sync.RWMutex
+	namedClients = map[string]*Client{}
+)
+
+// Register makes c available as Named(name), replacing and disconnecting a
+// client registered with the same name. A nil c unregisters the name.
+func Register(name string, c *Client) {
+	namedMu.Lock()
+	previous := namedClients[name]
+	if c == nil {
+		delete(namedClients, name)
+	} else {
+		namedClients[name] = c
+	}
+	namedMu.Unlock()
+
+	if previous != nil && previous != c && previous.HasClient() {
+		if err := previous.Disconnect(); err != nil {
+			previous.logger().Warn("MongoDB Disconnect Error",
+				zap.String("name", name),
+				zap.NamedError("error", err),
+			)
+		}
+	}
+}
+
+// Named returns the client registered with name, nil when there is none.
+// An empty name or DefaultName returns the Default client.
+func Named(name string) *Client {
+	if len(name) == 0 || name == DefaultName {
+		return defaultClient
+	}
+
+	namedMu.RLock()
+	defer namedMu.RUnlock()
+	return namedClients[name]
+}
+
+// ConnectNamed connects a new client using conf and registers it as name once
+// connected, e.g. one per cluster:
+//
+//	db.ConnectNamed("analytics", &db.Config{URL: url, DB: "events", ReadPreference: "secondaryPreferred"})
+//	...
+//	db.Named("analytics").DB().Collection("events")
+func ConnectNamed(name string, conf *Config) (*Client, error) {
+	if len(name) == 0 || name == DefaultName {
+		return nil, fmt.Errorf(`"%s" is the name of the default client`, name)
+	}
+
+	c := &Client{}
+	if err := c.ConnectConfig(conf); err != nil {
+		return nil, err
+	}
+	Register(name, c)
+	return c, nil
+}
+
+// NamedDB returns the database of the client registered with name, nil when
+// there is none or it is not connected.
+func NamedDB(name string) *mongo.Database {
+	c := Named(name)
+	if c == nil || !c.HasClient() {
+		return nil
+	}
+	return c.DB()
+}
+
+// Database returns another database of the Default client's cluster, for
+// handlers working outside the database they are given.
+func Database(name string) *mongo.Database {
+	return defaultClient.Database(name)
+}
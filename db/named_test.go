@@ -0,0 +1,83 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+)
+
+func TestConfigClientOptions(t *testing.T) {
+	conf := &Config{
+		URL:            "mongodb://127.0.0.1:27017",
+		AppName:        "reports",
+		ReadPreference: "secondaryPreferred",
+		WriteConcern:   "majority",
+		MaxPoolSize:    20,
+		MinPoolSize:    2,
+	}
+	opt, err := conf.ClientOptions()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if *opt.AppName != "reports" {
+		t.Errorf("Unexpected app name: %+v, expected %+v", *opt.AppName, "reports")
+	}
+	if opt.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Errorf("Unexpected read preference: %+v, expected %+v", opt.ReadPreference.Mode(), readpref.SecondaryPreferredMode)
+	}
+	if opt.WriteConcern.W != "majority" {
+		t.Errorf("Unexpected write concern: %+v, expected %+v", opt.WriteConcern.W, "majority")
+	}
+	if *opt.MaxPoolSize != 20 || *opt.MinPoolSize != 2 {
+		t.Errorf("Unexpected pool size: %+v-%+v, expected %+v-%+v", *opt.MinPoolSize, *opt.MaxPoolSize, 2, 20)
+	}
+
+	conf.WriteConcern = "2"
+	if opt, err = conf.ClientOptions(); err != nil || opt.WriteConcern.W != 2 {
+		t.Errorf("Unexpected write concern: %+v (%+v), expected %+v", opt, err, 2)
+	}
+
+	for _, invalid := range []*Config{
+		{},
+		{URL: "mongodb://127.0.0.1", ReadPreference: "fastest"},
+		{URL: "mongodb://127.0.0.1", WriteConcern: "all"},
+		{URL: "mongodb://127.0.0.1", MaxPoolSize: 1, MinPoolSize: 5},
+	} {
+		if _, err := invalid.ClientOptions(); err == nil {
+			t.Errorf("Unexpected valid config: %+v", invalid)
+		}
+	}
+}
+
+func TestNamed(t *testing.T) {
+	if Named("") != Default() || Named(DefaultName) != Default() {
+		t.Errorf("Unexpected client for the default name")
+	}
+	if Named("analytics") != nil {
+		t.Errorf("Unexpected client for an unregistered name")
+	}
+
+	c := &Client{}
+	Register("analytics", c)
+	defer Register("analytics", nil)
+	if Named("analytics") != c {
+		t.Errorf("Unexpected client: %+v, expected %+v", Named("analytics"), c)
+	}
+	if NamedDB("analytics") != nil {
+		t.Errorf("Unexpected database of an unconnected client")
+	}
+
+	// the replaced client is disconnected
+	replaced := unconnectedClient(t, "events")
+	replaced.Logger = zap.NewNop()
+	Register("analytics", replaced)
+	Register("analytics", c)
+	if replaced.HasClient() {
+		t.Errorf("Unexpected connected client after its replacement")
+	}
+
+	if _, err := ConnectNamed(DefaultName, &Config{URL: "mongodb://127.0.0.1"}); err == nil {
+		t.Errorf("Unexpected connection using the default name")
+	}
+}
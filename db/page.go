@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultPageSize is the page size when PageQuery.Limit is zero.
+var DefaultPageSize = 20
+
+// MaxPageSize is the largest page size, larger limits are reduced to it.
+var MaxPageSize = 100
+
+// ErrInvalidCursor is returned for a cursor that can not be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PageQuery selects a page of documents using keyset pagination. Documents
+// are sorted by SortField then _id, so pages stay stable while documents are
+// inserted, and no documents are skipped on the server.
+type PageQuery struct {
+	// Cursor is a token returned in PageInfo, empty for the first page.
+	Cursor string
+	Limit  int
+	// SortField defaults to _id.
+	SortField  string
+	Descending bool
+}
+
+// PageInfo describes the returned page.
+type PageInfo struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	HasNext    bool   `json:"has_next"`
+	HasPrev    bool   `json:"has_prev"`
+}
+
+// pageCursor is the content of a cursor token.
+type pageCursor struct {
+	Field    string      `bson:"f"`
+	Value    interface{} `bson:"v"`
+	ID       interface{} `bson:"i"`
+	Backward bool        `bson:"b,omitempty"`
+}
+
+func (pc *pageCursor) encode() (string, error) {
+	data, err := bson.Marshal(pc)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageCursor(token string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var raw struct {
+		Field    string        `bson:"f"`
+		Value    bson.RawValue `bson:"v"`
+		ID       bson.RawValue `bson:"i"`
+		Backward bool          `bson:"b"`
+	}
+	if err := bson.Unmarshal(data, &raw); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// the value is matched by equality, a document could hold operators
+	if raw.Value.Type == bson.TypeEmbeddedDocument || raw.Value.Type == bson.TypeArray {
+		return nil, ErrInvalidCursor
+	}
+
+	pc := &pageCursor{Field: raw.Field, Backward: raw.Backward}
+	if err := raw.Value.Unmarshal(&pc.Value); err != nil && raw.Value.Type != bson.TypeNull {
+		return nil, ErrInvalidCursor
+	}
+	if err := raw.ID.Unmarshal(&pc.ID); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return pc, nil
+}
+
+// keyset returns the filter of the documents after the cursor in the order of
+// operator, $gt or $lt. The null and missing values sort before the others.
+func (pc *pageCursor) keyset(operator string) primitive.M {
+	field := pc.Field
+	sameValue := primitive.M{field: primitive.M{"$eq": pc.Value}, "_id": primitive.M{operator: pc.ID}}
+	if pc.Value == nil {
+		if operator == "$lt" {
+			return sameValue
+		}
+		return primitive.M{"$or": primitive.A{
+			primitive.M{field: primitive.M{"$ne": nil}},
+			sameValue,
+		}}
+	}
+
+	clauses := primitive.A{
+		primitive.M{field: primitive.M{operator: pc.Value}},
+		sameValue,
+	}
+	if operator == "$lt" {
+		clauses = append(clauses, primitive.M{field: nil})
+	}
+	return primitive.M{"$or": clauses}
+}
+
+func (q *PageQuery) limit() int {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	return limit
+}
+
+func (q *PageQuery) field() string {
+	if len(q.SortField) == 0 {
+		return "_id"
+	}
+	return q.SortField
+}
+
+// Page finds a page of the documents matching filter and decodes them into
+// result, a pointer to a slice.
+func (c *Collection) Page(filter interface{}, query PageQuery, result interface{}) (*PageInfo, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.PageContext(ctx, filter, query, result)
+}
+
+// PageContext finds a page of the documents matching filter and decodes them
+// into result, a pointer to a slice.
+func (c *Collection) PageContext(ctx context.Context, filter interface{}, query PageQuery, result interface{}) (*PageInfo, error) {
+	filter, err := c.readFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	field := query.field()
+	limit := query.limit()
+
+	var after *pageCursor
+	if len(query.Cursor) > 0 {
+		var err error
+		if after, err = decodePageCursor(query.Cursor); err != nil {
+			return nil, err
+		}
+		if after.Field != field {
+			return nil, ErrInvalidCursor
+		}
+	}
+	backward := after != nil && after.Backward
+
+	// walking backward reverses the order, the page is reversed afterwards
+	ascending := !query.Descending
+	if backward {
+		ascending = !ascending
+	}
+	direction, operator := 1, "$gt"
+	if !ascending {
+		direction, operator = -1, "$lt"
+	}
+
+	sort := primitive.D{{Key: field, Value: direction}}
+	if field != "_id" {
+		sort = append(sort, primitive.E{Key: "_id", Value: direction})
+	}
+
+	if after != nil {
+		var keyset interface{}
+		if field == "_id" {
+			keyset = primitive.M{"_id": primitive.M{operator: after.ID}}
+		} else {
+			keyset = after.keyset(operator)
+		}
+		filter = primitive.M{"$and": primitive.A{filter, keyset}}
+	}
+
+	opts := options.Find().SetSort(sort).SetLimit(int64(limit + 1))
+	cur, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	docs := []bson.Raw{}
+	for cur.Next(ctx) {
+		docs = append(docs, append(bson.Raw{}, cur.Current...))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	more := len(docs) > limit
+	if more {
+		docs = docs[:limit]
+	}
+	if backward {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	if err := decodeRaws(c.keyRing(), docs, result); err != nil {
+		return nil, err
+	}
+
+	info := &PageInfo{}
+	if backward {
+		info.HasPrev = more
+		info.HasNext = true
+	} else {
+		info.HasNext = more
+		info.HasPrev = after != nil
+	}
+
+	if len(docs) > 0 {
+		if info.HasNext {
+			if info.NextCursor, err = rawCursor(docs[len(docs)-1], field, false); err != nil {
+				return nil, err
+			}
+		}
+		if info.HasPrev {
+			if info.PrevCursor, err = rawCursor(docs[0], field, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return info, nil
+}
+
+func rawCursor(doc bson.Raw, field string, backward bool) (string, error) {
+	pc := &pageCursor{Field: field, Backward: backward}
+
+	if err := doc.Lookup("_id").Unmarshal(&pc.ID); err != nil {
+		return "", err
+	}
+	if field != "_id" {
+		value, err := doc.LookupErr(strings.Split(field, ".")...)
+		if err == nil {
+			if err := value.Unmarshal(&pc.Value); err != nil && value.Type != bson.TypeNull {
+				return "", err
+			}
+		}
+	}
+
+	return pc.encode()
+}
+
+func decodeRaws(keys *KeyRing, docs []bson.Raw, result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return errors.New("result must be a pointer to a slice")
+	}
+
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), 0, len(docs))
+	elemt := slicev.Type().Elem()
+	for _, doc := range docs {
+		elemp := reflect.New(elemt)
+		if err := decodeRaw(keys, doc, elemp.Interface()); err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPageCursor(t *testing.T) {
+	id := primitive.NewObjectID()
+	createdAt := time.Now().Truncate(time.Millisecond)
+
+	doc, _ := bson.Marshal(bson.M{"_id": id, "created_at": createdAt, "name": "test"})
+	token, err := rawCursor(doc, "created_at", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	pc, err := decodePageCursor(token)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	if pc.Field != "created_at" || !pc.Backward {
+		t.Errorf("Unexpected cursor: %+v", pc)
+	}
+	if pc.ID != id {
+		t.Errorf("Unexpected id: %+v, expected %+v", pc.ID, id)
+	}
+	if value, _ := pc.Value.(primitive.DateTime); !value.Time().Equal(createdAt) {
+		t.Errorf("Unexpected value: %+v, expected %+v", pc.Value, createdAt)
+	}
+
+	if _, err := decodePageCursor("not a cursor"); err != ErrInvalidCursor {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrInvalidCursor)
+	}
+}
+
+func TestPageQueryLimit(t *testing.T) {
+	if limit := (&PageQuery{}).limit(); limit != DefaultPageSize {
+		t.Errorf("Unexpected limit: %+v, expected %+v", limit, DefaultPageSize)
+	}
+	if limit := (&PageQuery{Limit: MaxPageSize + 1}).limit(); limit != MaxPageSize {
+		t.Errorf("Unexpected limit: %+v, expected %+v", limit, MaxPageSize)
+	}
+}
+
+func TestPageNullValues(t *testing.T) {
+	m := NewMemory()
+	c := m.Col("scores").WithoutTimestamps()
+	for _, doc := range []primitive.M{
+		{"_id": 1, "score": nil}, {"_id": 2}, {"_id": 3, "score": 10}, {"_id": 4, "score": 5}, {"_id": 5, "score": nil},
+	} {
+		if _, err := c.Insert(doc); err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+	}
+
+	// the null and missing scores sort first
+	for _, test := range []struct {
+		descending bool
+		expected   []int32
+	}{
+		{false, []int32{1, 2, 5, 4, 3}},
+		{true, []int32{3, 4, 5, 2, 1}},
+	} {
+		ids, cursor := []int32{}, ""
+		for i := 0; i < 5; i++ {
+			docs := []struct {
+				ID int32 `bson:"_id"`
+			}{}
+			info, err := c.Page(nil, PageQuery{Cursor: cursor, Limit: 2, SortField: "score", Descending: test.descending}, &docs)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v, expected nil", err)
+			}
+			for _, doc := range docs {
+				ids = append(ids, doc.ID)
+			}
+			if !info.HasNext {
+				break
+			}
+			cursor = info.NextCursor
+		}
+		if len(ids) != len(test.expected) {
+			t.Fatalf("Unexpected ids: %+v, expected %+v", ids, test.expected)
+		}
+		for i := range ids {
+			if ids[i] != test.expected[i] {
+				t.Errorf("Unexpected ids: %+v, expected %+v", ids, test.expected)
+				break
+			}
+		}
+	}
+
+	// the values of a forged cursor are not interpreted as operators
+	for _, value := range []interface{}{primitive.M{"$ne": nil}, primitive.A{1}} {
+		data, _ := bson.Marshal(bson.M{"f": "score", "v": value, "i": 1})
+		if _, err := decodePageCursor(base64.RawURLEncoding.EncodeToString(data)); err != ErrInvalidCursor {
+			t.Errorf("Unexpected error of %+v: %+v, expected %+v", value, err, ErrInvalidCursor)
+		}
+	}
+}
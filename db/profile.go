@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/utils"
+)
+
+// Operations of the slow query reports.
+const (
+	OpFind          = "find"
+	OpFindOne       = "findOne"
+	OpInsert        = "insert"
+	OpInsertMany    = "insertMany"
+	OpUpdate        = "update"
+	OpUpdateMany    = "updateMany"
+	OpDelete        = "delete"
+	OpDeleteMany    = "deleteMany"
+	OpCount         = "count"
+	OpDistinct      = "distinct"
+	OpAggregate     = "aggregate"
+	OpFindAndModify = "findAndModify"
+	OpBulkWrite     = "bulkWrite"
+)
+
+// SlowQueryThreshold is the duration over which the Collection operations are
+// reported as slow, zero disables the reports. The collections of a client
+// with Config.SlowQueryThreshold use that one.
+var SlowQueryThreshold time.Duration
+
+// ExplainSlowQueries adds the query plan of the slow finds to their report,
+// as Config.ExplainSlowQueries does for the collections of a client.
+var ExplainSlowQueries bool
+
+// OnSlowQuery is called with the slow operations, by default they are
+// reported with utils.NotifyWarning. It is called in the background, out of
+// the request path.
+var OnSlowQuery = NotifySlowQuery
+
+// SlowQuery is a Collection operation that lasted longer than
+// SlowQueryThreshold.
+type SlowQuery struct {
+	Collection string
+	Operation  string
+	// Filter is the shape of the filter, or pipeline, with the values
+	// redacted, e.g. {"age": {"$gt": "?"}}.
+	Filter    string
+	Duration  time.Duration
+	RequestID string
+	// Explain is the winning plan of a find when ExplainSlowQueries is set.
+	Explain string
+}
+
+// NotifySlowQuery reports q with utils.NotifyWarning.
+func NotifySlowQuery(q *SlowQuery) {
+	if logger.Logger == nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"collection":  q.Collection,
+		"operation":   q.Operation,
+		"filter":      q.Filter,
+		"duration_ms": q.Duration.Milliseconds(),
+		"request_id":  q.RequestID,
+	}
+	if len(q.Explain) > 0 {
+		data["explain"] = q.Explain
+	}
+	utils.NotifyWarning(fmt.Errorf("slow mongo %s on %s", q.Operation, q.Collection), data)
+}
+
+// profile reports the operation started at start when it is slow. order is
+// the sort used to explain the finds. The explain and the report run in the
+// background so they don't slow down the operation further.
+func (c *Collection) profile(ctx context.Context, operation string, filter interface{}, order interface{}, start time.Time) {
+	took := time.Since(start)
+	threshold := c.slowQueryThreshold
+	if threshold <= 0 {
+		threshold = SlowQueryThreshold
+	}
+	onSlowQuery := OnSlowQuery
+	if threshold <= 0 || took < threshold || onSlowQuery == nil {
+		return
+	}
+
+	q := &SlowQuery{
+		Collection: c.Name(),
+		Operation:  operation,
+		Filter:     FilterShape(filter),
+		Duration:   took,
+		RequestID:  logger.RequestID(ctx),
+	}
+	explain := (c.explainSlowQueries || ExplainSlowQueries) && (operation == OpFind || operation == OpFindOne) && c.memory == nil
+
+	go func() {
+		if explain {
+			plan, err := c.explain(filter, order)
+			if err != nil {
+				plan = "explain failed: " + err.Error()
+			}
+			q.Explain = plan
+		}
+		onSlowQuery(q)
+	}()
+}
+
+// explain returns the winning plan of the find of filter.
+func (c *Collection) explain(filter interface{}, order interface{}) (string, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	find := bson.D{{Key: "find", Value: c.Name()}, {Key: "filter", Value: orEmpty(filter)}}
+	if order != nil {
+		find = append(find, bson.E{Key: "sort", Value: order})
+	}
+	cmd := bson.D{{Key: "explain", Value: find}, {Key: "verbosity", Value: "queryPlanner"}}
+
+	raw, err := c.Database().RunCommand(ctx, cmd).Raw()
+	if err != nil {
+		return "", err
+	}
+	plan, err := raw.LookupErr("queryPlanner", "winningPlan")
+	if err != nil {
+		return "", errors.New("no winning plan")
+	}
+	return plan.String(), nil
+}
+
+// FilterShape returns filter as extended JSON with its values replaced by
+// "?", and the fields sorted, so the reports of a query can be grouped
+// without leaking its data.
+func FilterShape(filter interface{}) string {
+	if filter == nil {
+		return "{}"
+	}
+	n, err := normalize(filter)
+	if err != nil {
+		return "?"
+	}
+
+	shaped := primitive.D{{Key: "filter", Value: shape(n)}}
+	data, err := bson.MarshalExtJSON(shaped, false, false)
+	if err != nil {
+		return "?"
+	}
+	// strip the {"filter": ...} wrapper, needed as filter can be a pipeline
+	return string(data[len(`{"filter":`) : len(data)-1])
+}
+
+func shape(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		d := primitive.D{}
+		for _, e := range t {
+			value := interface{}("?")
+			switch e.Value.(type) {
+			case primitive.D:
+				value = shape(e.Value)
+			case primitive.A:
+				// the documents of $and, $or or pipelines, the values of $in
+				if isDocs(e.Value.(primitive.A)) {
+					value = shape(e.Value)
+				}
+			}
+			d = append(d, primitive.E{Key: e.Key, Value: value})
+		}
+		sort.SliceStable(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+		return d
+	case primitive.A:
+		if !isDocs(t) {
+			return "?"
+		}
+		a := primitive.A{}
+		for _, e := range t {
+			a = append(a, shape(e))
+		}
+		return a
+	}
+	return "?"
+}
+
+func isDocs(a primitive.A) bool {
+	for _, e := range a {
+		if _, ok := e.(primitive.D); !ok {
+			return false
+		}
+	}
+	return len(a) > 0
+}
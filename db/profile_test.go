@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/vavas/go_services/db/query"
+	"github.com/vavas/go_services/logger"
+)
+
+func TestFilterShape(t *testing.T) {
+	for _, test := range []struct {
+		filter   interface{}
+		expected string
+	}{
+		{nil, `{}`},
+		{primitive.M{"name": "ann"}, `{"name":"?"}`},
+		{primitive.D{{Key: "name", Value: "ann"}, {Key: "age", Value: primitive.M{"$gt": 30}}}, `{"age":{"$gt":"?"},"name":"?"}`},
+		{query.In("status", "active", "trial"), `{"status":{"$in":"?"}}`},
+		{query.Or(query.Eq("a", 1), query.Exists("b", true)), `{"$or":[{"a":"?"},{"b":{"$exists":"?"}}]}`},
+		{query.NewPipeline().Match(query.Eq("a", 1)).Limit(5).Build(), `[{"$match":{"a":"?"}},{"$limit":"?"}]`},
+	} {
+		if shape := FilterShape(test.filter); shape != test.expected {
+			t.Errorf("Unexpected shape of %+v: %s, expected %s", test.filter, shape, test.expected)
+		}
+	}
+}
+
+// nextReport returns the next slow query report, nil when there is none
+// after a while.
+func nextReport(reports chan *SlowQuery) *SlowQuery {
+	select {
+	case q := <-reports:
+		return q
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestSlowQuery(t *testing.T) {
+	reports := make(chan *SlowQuery, 10)
+	defer func(threshold time.Duration, onSlowQuery func(*SlowQuery)) {
+		SlowQueryThreshold, OnSlowQuery = threshold, onSlowQuery
+	}(SlowQueryThreshold, OnSlowQuery)
+	OnSlowQuery = func(q *SlowQuery) { reports <- q }
+
+	c := NewMemory().Col("users")
+	ctx := logger.WithRequestID(context.Background(), "req-1")
+
+	SlowQueryThreshold = 0
+	_, _ = c.CountContext(ctx, query.Eq("name", "ann"))
+	if q := nextReport(reports); q != nil {
+		t.Fatalf("Unexpected report with no threshold: %+v", q)
+	}
+
+	SlowQueryThreshold = time.Nanosecond
+	_, _ = c.CountContext(ctx, query.Eq("name", "ann"))
+	q := nextReport(reports)
+	if q == nil {
+		t.Fatalf("Unexpected reports: none, expected one")
+	}
+	if q.Collection != "users" || q.Operation != OpCount || q.Filter != `{"name":"?"}` || q.RequestID != "req-1" {
+		t.Errorf("Unexpected report: %+v", q)
+	}
+
+	// the threshold of the client of the collection is used over the package one
+	SlowQueryThreshold = 0
+	c.slowQueryThreshold = time.Nanosecond
+	_, _ = c.CountContext(ctx, nil)
+	if q := nextReport(reports); q == nil || q.Operation != OpCount {
+		t.Errorf("Unexpected report: %+v, expected the count", q)
+	}
+	c.slowQueryThreshold = time.Hour
+	SlowQueryThreshold = time.Nanosecond
+	_, _ = c.CountContext(ctx, nil)
+	if q := nextReport(reports); q != nil {
+		t.Errorf("Unexpected report under the client threshold: %+v", q)
+	}
+}
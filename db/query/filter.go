@@ -0,0 +1,196 @@
+// Package query builds mongo filters, updates and aggregation pipelines
+// without writing the operators by hand. The built values can be passed to
+// the db.Collection methods and AggregatePipe.
+//
+//	filter := query.And(
+//		query.Eq("account_id", accountID),
+//		query.In("status", "active", "trial"),
+//		query.Range("created_at", from, to),
+//	)
+//	update := query.NewUpdate().Set("status", "closed").CurrentDate("closed_at")
+//	_, err := db.Col(dbc, "users").UpdateAll(filter, update)
+package query
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Filter is a query filter document.
+type Filter primitive.D
+
+// MarshalBSON implements the bson.Marshaler interface.
+func (f Filter) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(primitive.D(f))
+}
+
+// D returns the filter as a document.
+func (f Filter) D() primitive.D {
+	if f == nil {
+		return primitive.D{}
+	}
+	return primitive.D(f)
+}
+
+// And combines the filter with others, all must match.
+func (f Filter) And(others ...Filter) Filter {
+	return And(append([]Filter{f}, others...)...)
+}
+
+// Or combines the filter with others, one must match.
+func (f Filter) Or(others ...Filter) Filter {
+	return Or(append([]Filter{f}, others...)...)
+}
+
+func field(name string, operator string, value interface{}) Filter {
+	return Filter{{Key: name, Value: primitive.D{{Key: operator, Value: value}}}}
+}
+
+// All matches every document.
+func All() Filter {
+	return Filter{}
+}
+
+// Eq matches documents where field equals value.
+func Eq(name string, value interface{}) Filter {
+	return Filter{{Key: name, Value: value}}
+}
+
+// ID matches the document with id.
+func ID(id interface{}) Filter {
+	return Eq("_id", id)
+}
+
+// Ne matches documents where field does not equal value.
+func Ne(name string, value interface{}) Filter {
+	return field(name, "$ne", value)
+}
+
+// Gt matches documents where field is greater than value.
+func Gt(name string, value interface{}) Filter {
+	return field(name, "$gt", value)
+}
+
+// Gte matches documents where field is greater than or equal to value.
+func Gte(name string, value interface{}) Filter {
+	return field(name, "$gte", value)
+}
+
+// Lt matches documents where field is less than value.
+func Lt(name string, value interface{}) Filter {
+	return field(name, "$lt", value)
+}
+
+// Lte matches documents where field is less than or equal to value.
+func Lte(name string, value interface{}) Filter {
+	return field(name, "$lte", value)
+}
+
+// In matches documents where field equals one of values.
+func In(name string, values ...interface{}) Filter {
+	return field(name, "$in", primitive.A(values))
+}
+
+// Nin matches documents where field equals none of values.
+func Nin(name string, values ...interface{}) Filter {
+	return field(name, "$nin", primitive.A(values))
+}
+
+// Exists matches documents that have (or don't have) field.
+func Exists(name string, exists bool) Filter {
+	return field(name, "$exists", exists)
+}
+
+// Range matches documents where min <= field < max. A nil bound is left out.
+func Range(name string, min interface{}, max interface{}) Filter {
+	bounds := primitive.D{}
+	if min != nil {
+		bounds = append(bounds, primitive.E{Key: "$gte", Value: min})
+	}
+	if max != nil {
+		bounds = append(bounds, primitive.E{Key: "$lt", Value: max})
+	}
+	if len(bounds) == 0 {
+		return Filter{}
+	}
+	return Filter{{Key: name, Value: bounds}}
+}
+
+// Regex matches documents where field matches pattern, options like "i" are
+// the mongo regex options.
+func Regex(name string, pattern string, options string) Filter {
+	return Filter{{Key: name, Value: primitive.Regex{Pattern: pattern, Options: options}}}
+}
+
+// ElemMatch matches documents where an element of the array field matches filter.
+func ElemMatch(name string, filter Filter) Filter {
+	return field(name, "$elemMatch", filter.D())
+}
+
+// Size matches documents where the array field has size elements.
+func Size(name string, size int) Filter {
+	return field(name, "$size", size)
+}
+
+// Not negates a single field filter such as Gt. The other filters are
+// negated with Nor.
+func Not(f Filter) Filter {
+	if len(f) != 1 || strings.HasPrefix(f[0].Key, "$") {
+		return Nor(f)
+	}
+
+	// $not takes an operator expression or a regex, not a value
+	value := f[0].Value
+	switch v := value.(type) {
+	case primitive.Regex:
+	case primitive.D:
+		if len(v) == 0 || !strings.HasPrefix(v[0].Key, "$") {
+			value = primitive.D{{Key: "$eq", Value: v}}
+		}
+	default:
+		value = primitive.D{{Key: "$eq", Value: v}}
+	}
+	return Filter{{Key: f[0].Key, Value: primitive.D{{Key: "$not", Value: value}}}}
+}
+
+// And matches documents matching all filters. Empty filters are left out.
+func And(filters ...Filter) Filter {
+	return combine("$and", filters)
+}
+
+// Or matches documents matching one of filters.
+func Or(filters ...Filter) Filter {
+	return combine("$or", filters)
+}
+
+// Nor matches documents matching none of filters.
+func Nor(filters ...Filter) Filter {
+	return Filter{{Key: "$nor", Value: docs(filters)}}
+}
+
+func combine(operator string, filters []Filter) Filter {
+	nonEmpty := make([]Filter, 0, len(filters))
+	for _, f := range filters {
+		if len(f) > 0 {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+
+	switch len(nonEmpty) {
+	case 0:
+		return Filter{}
+	case 1:
+		return nonEmpty[0]
+	}
+	return Filter{{Key: operator, Value: docs(nonEmpty)}}
+}
+
+func docs(filters []Filter) primitive.A {
+	a := make(primitive.A, 0, len(filters))
+	for _, f := range filters {
+		a = append(a, f.D())
+	}
+	return a
+}
@@ -0,0 +1,174 @@
+package query
+
+import (
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Pipeline is an aggregation pipeline built stage by stage.
+//
+//	pipe := query.NewPipeline().
+//		Match(query.Eq("account_id", accountID)).
+//		Lookup("users", "user_id", "_id", "user").
+//		Group("$status", query.Count("total")).
+//		Build()
+//	err := db.Col(dbc, "orders").AggregatePipe(pipe, &result)
+type Pipeline struct {
+	stages mongo.Pipeline
+}
+
+// NewPipeline returns an empty pipeline.
+func NewPipeline() *Pipeline {
+	return &Pipeline{stages: mongo.Pipeline{}}
+}
+
+// Build returns the stages of the pipeline.
+func (p *Pipeline) Build() mongo.Pipeline {
+	return p.stages
+}
+
+// Stage adds a stage, e.g. Stage("$sample", primitive.D{{Key: "size", Value: 3}}).
+func (p *Pipeline) Stage(name string, value interface{}) *Pipeline {
+	p.stages = append(p.stages, primitive.D{{Key: name, Value: value}})
+	return p
+}
+
+// Match adds a $match stage.
+func (p *Pipeline) Match(filter Filter) *Pipeline {
+	return p.Stage("$match", filter.D())
+}
+
+// Lookup adds a $lookup stage joining from on localField = foreignField into as.
+func (p *Pipeline) Lookup(from string, localField string, foreignField string, as string) *Pipeline {
+	return p.Stage("$lookup", primitive.D{
+		{Key: "from", Value: from},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+// Unwind adds an $unwind stage of the array field, keeping documents where it is empty.
+func (p *Pipeline) Unwind(name string) *Pipeline {
+	return p.Stage("$unwind", primitive.D{
+		{Key: "path", Value: "$" + strings.TrimPrefix(name, "$")},
+		{Key: "preserveNullAndEmptyArrays", Value: true},
+	})
+}
+
+// Group adds a $group stage by id with the accumulators.
+func (p *Pipeline) Group(id interface{}, accumulators ...primitive.E) *Pipeline {
+	group := primitive.D{{Key: "_id", Value: id}}
+	group = append(group, accumulators...)
+	return p.Stage("$group", group)
+}
+
+// Project adds a $project stage including the fields. A field prefixed with
+// "-" is excluded.
+func (p *Pipeline) Project(names ...string) *Pipeline {
+	project := primitive.D{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "-") {
+			project = append(project, primitive.E{Key: name[1:], Value: 0})
+		} else {
+			project = append(project, primitive.E{Key: name, Value: 1})
+		}
+	}
+	return p.Stage("$project", project)
+}
+
+// ProjectExpr adds a $project stage with computed fields.
+func (p *Pipeline) ProjectExpr(project primitive.D) *Pipeline {
+	return p.Stage("$project", project)
+}
+
+// Sort adds a $sort stage. A field prefixed with "-" is sorted descending.
+func (p *Pipeline) Sort(names ...string) *Pipeline {
+	return p.Stage("$sort", SortBy(names...))
+}
+
+// Skip adds a $skip stage.
+func (p *Pipeline) Skip(n int64) *Pipeline {
+	return p.Stage("$skip", n)
+}
+
+// Limit adds a $limit stage.
+func (p *Pipeline) Limit(n int64) *Pipeline {
+	return p.Stage("$limit", n)
+}
+
+// Facet adds a $facet stage running the named sub pipelines.
+func (p *Pipeline) Facet(facets map[string]*Pipeline) *Pipeline {
+	names := make([]string, 0, len(facets))
+	for name := range facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	facet := primitive.D{}
+	for _, name := range names {
+		facet = append(facet, primitive.E{Key: name, Value: facets[name].Build()})
+	}
+	return p.Stage("$facet", facet)
+}
+
+// SortBy returns a sort document, a field prefixed with "-" is sorted
+// descending. It can be used with options.Find().SetSort.
+func SortBy(names ...string) primitive.D {
+	sort := primitive.D{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "-") {
+			sort = append(sort, primitive.E{Key: name[1:], Value: -1})
+		} else {
+			sort = append(sort, primitive.E{Key: name, Value: 1})
+		}
+	}
+	return sort
+}
+
+func accumulator(name string, operator string, expr interface{}) primitive.E {
+	return primitive.E{Key: name, Value: primitive.D{{Key: operator, Value: expr}}}
+}
+
+// Count accumulates the number of documents of a group into name.
+func Count(name string) primitive.E {
+	return accumulator(name, "$sum", 1)
+}
+
+// Sum accumulates the sum of expr, e.g. "$amount", into name.
+func Sum(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$sum", expr)
+}
+
+// Avg accumulates the average of expr into name.
+func Avg(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$avg", expr)
+}
+
+// Min accumulates the minimum of expr into name.
+func Min(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$min", expr)
+}
+
+// Max accumulates the maximum of expr into name.
+func Max(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$max", expr)
+}
+
+// First accumulates the first expr of a group into name.
+func First(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$first", expr)
+}
+
+// Last accumulates the last expr of a group into name.
+func Last(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$last", expr)
+}
+
+// PushAcc accumulates the values of expr into the array name.
+func PushAcc(name string, expr interface{}) primitive.E {
+	return accumulator(name, "$push", expr)
+}
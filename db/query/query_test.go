@@ -0,0 +1,92 @@
+package query
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func extJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := bson.MarshalExtJSON(v, false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	return string(data)
+}
+
+func TestFilter(t *testing.T) {
+	filter := And(
+		Eq("account_id", "a1"),
+		In("status", "active", "trial"),
+		Range("age", 18, nil),
+		All(),
+		Or(Regex("name", "^jo", "i"), ElemMatch("tags", Eq("name", "vip"))),
+	)
+
+	expected := `{"$and":[{"account_id":"a1"},{"status":{"$in":["active","trial"]}},{"age":{"$gte":18}},` +
+		`{"$or":[{"name":{"$regularExpression":{"pattern":"^jo","options":"i"}}},{"tags":{"$elemMatch":{"name":"vip"}}}]}]}`
+	if json := extJSON(t, filter); json != expected {
+		t.Errorf("Unexpected filter: %+v, expected %+v", json, expected)
+	}
+
+	if json := extJSON(t, Eq("a", 1).And()); json != `{"a":1}` {
+		t.Errorf("Unexpected filter: %+v, expected %+v", json, `{"a":1}`)
+	}
+	if json := extJSON(t, Not(Gt("a", 1))); json != `{"a":{"$not":{"$gt":1}}}` {
+		t.Errorf("Unexpected filter: %+v, expected %+v", json, `{"a":{"$not":{"$gt":1}}}`)
+	}
+
+	for _, tc := range []struct {
+		filter   Filter
+		expected string
+	}{
+		{Not(Eq("age", 25)), `{"age":{"$not":{"$eq":25}}}`},
+		{Not(Eq("profile", primitive.D{{Key: "city", Value: "Oslo"}})), `{"profile":{"$not":{"$eq":{"city":"Oslo"}}}}`},
+		{Not(Regex("name", "^jo", "")), `{"name":{"$not":{"$regularExpression":{"pattern":"^jo","options":""}}}}`},
+		{Not(Or(Eq("a", 1), Eq("b", 2))), `{"$nor":[{"$or":[{"a":1},{"b":2}]}]}`},
+	} {
+		if json := extJSON(t, tc.filter); json != tc.expected {
+			t.Errorf("Unexpected filter: %+v, expected %+v", json, tc.expected)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	update := NewUpdate().
+		Set("status", "closed").
+		Inc("visits", 1).
+		Set("reason", "done").
+		Push("history", "a", "b").
+		Pull("tags", Eq("name", "old")).
+		CurrentDate("updated_at")
+
+	expected := `{"$set":{"status":"closed","reason":"done"},"$inc":{"visits":1},` +
+		`"$push":{"history":{"$each":["a","b"]}},"$pull":{"tags":{"name":"old"}},"$currentDate":{"updated_at":true}}`
+	if json := extJSON(t, update); json != expected {
+		t.Errorf("Unexpected update: %+v, expected %+v", json, expected)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	pipe := NewPipeline().
+		Match(Eq("status", "active")).
+		Lookup("users", "user_id", "_id", "user").
+		Group("$status", Count("total"), Sum("amount", "$amount")).
+		Project("total", "-_id").
+		Facet(map[string]*Pipeline{
+			"top":   NewPipeline().Sort("-total").Limit(3),
+			"count": NewPipeline().Stage("$count", "n"),
+		}).
+		Build()
+
+	expected := `{"p":[{"$match":{"status":"active"}},` +
+		`{"$lookup":{"from":"users","localField":"user_id","foreignField":"_id","as":"user"}},` +
+		`{"$group":{"_id":"$status","total":{"$sum":1},"amount":{"$sum":"$amount"}}},` +
+		`{"$project":{"total":1,"_id":0}},` +
+		`{"$facet":{"count":[{"$count":"n"}],"top":[{"$sort":{"total":-1}},{"$limit":3}]}}]}`
+	if json := extJSON(t, bson.M{"p": pipe}); json != expected {
+		t.Errorf("Unexpected pipeline: %+v, expected %+v", json, expected)
+	}
+}
@@ -0,0 +1,100 @@
+package query
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Update is an update document built with operators.
+type Update struct {
+	ops primitive.D
+}
+
+// NewUpdate returns an empty update.
+func NewUpdate() *Update {
+	return &Update{ops: primitive.D{}}
+}
+
+// MarshalBSON implements the bson.Marshaler interface.
+func (u *Update) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(u.D())
+}
+
+// D returns the update as a document.
+func (u *Update) D() primitive.D {
+	if u == nil || u.ops == nil {
+		return primitive.D{}
+	}
+	return u.ops
+}
+
+// IsEmpty returns true if no operator has been added.
+func (u *Update) IsEmpty() bool {
+	return u == nil || len(u.ops) == 0
+}
+
+// Operator adds field: value to the operator, e.g. "$max".
+func (u *Update) Operator(operator string, name string, value interface{}) *Update {
+	for i, op := range u.ops {
+		if op.Key == operator {
+			fields, _ := op.Value.(primitive.D)
+			u.ops[i].Value = append(fields, primitive.E{Key: name, Value: value})
+			return u
+		}
+	}
+	u.ops = append(u.ops, primitive.E{Key: operator, Value: primitive.D{{Key: name, Value: value}}})
+	return u
+}
+
+// Set sets field to value.
+func (u *Update) Set(name string, value interface{}) *Update {
+	return u.Operator("$set", name, value)
+}
+
+// SetOnInsert sets field to value when an upsert inserts the document.
+func (u *Update) SetOnInsert(name string, value interface{}) *Update {
+	return u.Operator("$setOnInsert", name, value)
+}
+
+// Unset removes field.
+func (u *Update) Unset(name string) *Update {
+	return u.Operator("$unset", name, "")
+}
+
+// Inc increments field by n.
+func (u *Update) Inc(name string, n interface{}) *Update {
+	return u.Operator("$inc", name, n)
+}
+
+// Push appends values to the array field.
+func (u *Update) Push(name string, values ...interface{}) *Update {
+	if len(values) == 1 {
+		return u.Operator("$push", name, values[0])
+	}
+	return u.Operator("$push", name, primitive.D{{Key: "$each", Value: primitive.A(values)}})
+}
+
+// AddToSet appends values to the array field unless already present.
+func (u *Update) AddToSet(name string, values ...interface{}) *Update {
+	if len(values) == 1 {
+		return u.Operator("$addToSet", name, values[0])
+	}
+	return u.Operator("$addToSet", name, primitive.D{{Key: "$each", Value: primitive.A(values)}})
+}
+
+// Pull removes the elements of the array field equal to value or matching a
+// Filter.
+func (u *Update) Pull(name string, value interface{}) *Update {
+	if f, ok := value.(Filter); ok {
+		value = f.D()
+	}
+	return u.Operator("$pull", name, value)
+}
+
+// CurrentDate sets fields to the current date.
+func (u *Update) CurrentDate(names ...string) *Update {
+	for _, name := range names {
+		u.Operator("$currentDate", name, true)
+	}
+	return u
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNotFound is returned by Repo when no document matches. Its message is the
+// one utils.NotifyError and extsrv.RespError treat as a not found error.
+var ErrNotFound = errors.New("not found")
+
+// NotFound maps mongo.ErrNoDocuments to ErrNotFound.
+func NotFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Repo is a typed repository of the documents of a collection.
+type Repo[T any] struct {
+	*Collection
+}
+
+// NewRepo returns a repository of the named collection. The encrypted fields
+// of T are encrypted in the filters and updates.
+func NewRepo[T any](dbc *mongo.Database, name string) *Repo[T] {
+	return RepoOf[T](Col(dbc, name))
+}
+
+// RepoOf returns a repository using col, or a copy of it encrypting the
+// encrypted fields of T.
+func RepoOf[T any](col *Collection) *Repo[T] {
+	if len(fieldsOf(new(T))) > 0 {
+		col = col.WithEncryption(new(T))
+	}
+	return &Repo[T]{col}
+}
+
+// FindByID returns the document with id.
+func (r *Repo[T]) FindByID(ctx context.Context, id interface{}) (*T, error) {
+	return r.FindOne(ctx, primitive.M{"_id": id})
+}
+
+// FindOne returns the first document matching filter.
+func (r *Repo[T]) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (*T, error) {
+	filter, err := r.readFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := r.Collection.FindOne(ctx, filter, opts...).Raw()
+	if err != nil {
+		return nil, NotFound(err)
+	}
+	doc := new(T)
+	if err := decodeRaw(r.keyRing(), raw, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Find returns all documents matching filter.
+func (r *Repo[T]) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	filter, err := r.readFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := r.Collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	docs := []T{}
+	if err := decodeAll(ctx, r.keyRing(), cur, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// Insert inserts doc and returns its id.
+func (r *Repo[T]) Insert(ctx context.Context, doc *T) (interface{}, error) {
+	result, err := r.InsertContext(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	return result.InsertedID, nil
+}
+
+// UpdateByID applies update to the document with id. It returns ErrNotFound
+// when no document has the id.
+func (r *Repo[T]) UpdateByID(ctx context.Context, id interface{}, update interface{}) error {
+	selector, err := r.scope(ctx, primitive.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if update, err = r.scopeUpdate(ctx, update); err != nil {
+		return err
+	}
+	update, err = r.updateDocument(update)
+	if err != nil {
+		return err
+	}
+	matched := int64(0)
+	err = r.audited(ctx, AuditUpdate, selector, false, func(selector interface{}) (interface{}, error) {
+		result, err := r.UpdateOne(ctx, selector, update)
+		if err != nil {
+			return nil, err
+		}
+		matched = result.MatchedCount
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete deletes the document with id, or sets its deleted_at when the
+// collection uses soft delete. It returns ErrNotFound when no document has
+// the id.
+func (r *Repo[T]) Delete(ctx context.Context, id interface{}) error {
+	selector, err := r.scope(ctx, primitive.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	deleted := int64(0)
+	err = r.audited(ctx, AuditRemove, selector, false, func(selector interface{}) (interface{}, error) {
+		if r.SoftDelete {
+			n, err := r.softDelete(ctx, selector, false)
+			deleted = n
+			return nil, err
+		}
+		result, err := r.DeleteOne(ctx, selector)
+		if err != nil {
+			return nil, err
+		}
+		deleted = result.DeletedCount
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Count returns the number of documents matching filter.
+func (r *Repo[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.CountContext(ctx, filter)
+}
+
+// Exists returns true if a document matches filter.
+func (r *Repo[T]) Exists(ctx context.Context, filter interface{}) (bool, error) {
+	filter, err := r.readFilter(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	count, err := r.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// Iter returns an iterator over the documents matching filter. The iterator
+// must be closed.
+func (r *Repo[T]) Iter(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*Iterator[T], error) {
+	filter, err := r.readFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := r.Collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	it := NewIterator[T](ctx, cur)
+	it.keys = r.keyRing()
+	return it, nil
+}
+
+// Iterator decodes the documents of a cursor one at a time.
+//
+//	it, err := repo.Iter(ctx, filter)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		user := it.Value()
+//	}
+//	return it.Err()
+type Iterator[T any] struct {
+	ctx   context.Context
+	cur   *mongo.Cursor
+	value T
+	err   error
+	// keys decrypt the documents, EncryptionKeys when nil.
+	keys *KeyRing
+}
+
+// NewIterator returns an iterator over cur.
+func NewIterator[T any](ctx context.Context, cur *mongo.Cursor) *Iterator[T] {
+	return &Iterator[T]{ctx: ctx, cur: cur}
+}
+
+func (it *Iterator[T]) keyRing() *KeyRing {
+	if it.keys != nil {
+		return it.keys
+	}
+	return EncryptionKeys
+}
+
+// Next decodes the next document and returns false when there are no more
+// documents or an error happened.
+func (it *Iterator[T]) Next() bool {
+	if it.err != nil || !it.cur.Next(it.ctx) {
+		return false
+	}
+
+	var value T
+	if err := decodeRaw(it.keyRing(), it.cur.Current, &value); err != nil {
+		it.err = err
+		return false
+	}
+	it.value = value
+	return true
+}
+
+// Value returns the current document.
+func (it *Iterator[T]) Value() T {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration.
+func (it *Iterator[T]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.cur.Err()
+}
+
+// Close closes the cursor.
+func (it *Iterator[T]) Close() error {
+	return it.cur.Close(it.ctx)
+}
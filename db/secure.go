@@ -0,0 +1,300 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EncryptedSubtype is the binary subtype of the encrypted values.
+const EncryptedSubtype byte = 0x80
+
+// Encryption modes of the encrypted values. The deterministic one encrypts
+// equal values to equal ciphertexts so they can be looked up.
+const (
+	encryptRandom        byte = 1
+	encryptDeterministic byte = 2
+)
+
+// EncryptionKeys is the key ring of the fields tagged `secure:"encrypt"` of the
+// collections without their own, see Config.EncryptionKeys and
+// Collection.WithKeys.
+var EncryptionKeys *KeyRing
+
+// Errors of the field encryption.
+var (
+	ErrNoEncryptionKeys = errors.New("no encryption keys")
+	ErrUnknownKey       = errors.New("unknown encryption key")
+	ErrInvalidEncrypted = errors.New("invalid encrypted value")
+	// ErrEncryptedField is returned for the filters and updates of encrypted
+	// fields the encryption can't preserve, e.g. ranges or $inc, and the
+	// filters of the fields that are not deterministic.
+	ErrEncryptedField = errors.New("operator not supported on an encrypted field")
+)
+
+type encryptionKey struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// KeyRing holds the keys of the field encryption. The values are encrypted
+// with the current key and decrypted with the key they were encrypted with,
+// so keys are rotated by making a new key current and keeping the old ones
+// until the documents are re-encrypted, see Collection.Reencrypt.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string]*encryptionKey
+}
+
+// NewKeyRing returns a key ring whose current key is secret, with id.
+func NewKeyRing(id string, secret []byte) (*KeyRing, error) {
+	k := &KeyRing{keys: map[string]*encryptionKey{}}
+	if err := k.Rotate(id, secret); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ParseKeyRing returns the key ring of comma separated id:base64 secrets,
+// e.g. "2024-06:c2VjcmV0...,2023-01:b2xk...". The first key is the current
+// one.
+func ParseKeyRing(s string) (*KeyRing, error) {
+	var k *KeyRing
+	for _, entry := range strings.Split(s, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf(`"%s" is not a valid encryption key, expected id:base64`, id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf(`encryption key "%s": %w`, id, err)
+		}
+
+		if k == nil {
+			k, err = NewKeyRing(id, secret)
+		} else {
+			err = k.Add(id, secret)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add adds a key used to decrypt the values encrypted with it.
+func (k *KeyRing) Add(id string, secret []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf(`"%s" is not a valid encryption key id`, id)
+	}
+	if len(secret) < 16 {
+		return fmt.Errorf(`encryption key "%s" must have at least 16 bytes`, id)
+	}
+
+	// the AES and HMAC keys are derived from the secret
+	block, err := aes.NewCipher(derive(secret, "aes"))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = &encryptionKey{aead: aead, mac: derive(secret, "mac")}
+	return nil
+}
+
+// Rotate adds a key and makes it the current one.
+func (k *KeyRing) Rotate(id string, secret []byte) error {
+	if err := k.Add(id, secret); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = id
+	return nil
+}
+
+// Current returns the id of the current key.
+func (k *KeyRing) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// ids returns the ids of the keys, the current one first.
+func (k *KeyRing) ids() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	ids := []string{}
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return append([]string{k.current}, ids...)
+}
+
+func (k *KeyRing) key(id string) (*encryptionKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf(`%w "%s"`, ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+func derive(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// encryptValue returns v encrypted with the current key, as a binary of
+// EncryptedSubtype holding:
+//
+//	mode | key id length | key id | bson type | nonce | ciphertext
+//
+// The header is authenticated with the ciphertext. The nonce of the
+// deterministic mode is the HMAC of the header and value.
+func (k *KeyRing) encryptValue(v interface{}, deterministic bool) (interface{}, error) {
+	if v == nil || isEncrypted(v) {
+		return v, nil
+	}
+	if k == nil {
+		return nil, ErrNoEncryptionKeys
+	}
+
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return k.encrypt(k.Current(), t, data, deterministic)
+}
+
+// encryptValues returns v deterministically encrypted with each key, so the
+// values encrypted before a rotation are matched as well.
+func (k *KeyRing) encryptValues(v interface{}) (primitive.A, error) {
+	if v == nil {
+		return primitive.A{nil}, nil
+	}
+	if k == nil {
+		return nil, ErrNoEncryptionKeys
+	}
+
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	values := primitive.A{}
+	for _, id := range k.ids() {
+		value, err := k.encrypt(id, t, data, true)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (k *KeyRing) encrypt(id string, t bsontype.Type, data []byte, deterministic bool) (primitive.Binary, error) {
+	key, err := k.key(id)
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+
+	mode := encryptRandom
+	if deterministic {
+		mode = encryptDeterministic
+	}
+	header := append([]byte{mode, byte(len(id))}, id...)
+	header = append(header, byte(t))
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, key.mac)
+		mac.Write(header)
+		mac.Write(data)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return primitive.Binary{}, err
+	}
+
+	out := append(append([]byte{}, header...), nonce...)
+	out = key.aead.Seal(out, nonce, data, header)
+	return primitive.Binary{Subtype: EncryptedSubtype, Data: out}, nil
+}
+
+// encrypted is an encrypted value split in its parts.
+type encrypted struct {
+	mode       byte
+	keyID      string
+	t          bsontype.Type
+	header     []byte
+	nonce      []byte
+	ciphertext []byte
+}
+
+func parseEncrypted(data []byte) (*encrypted, error) {
+	if len(data) < 3 {
+		return nil, ErrInvalidEncrypted
+	}
+	n := int(data[1])
+	if len(data) < 3+n || (data[0] != encryptRandom && data[0] != encryptDeterministic) {
+		return nil, ErrInvalidEncrypted
+	}
+	e := &encrypted{mode: data[0], keyID: string(data[2 : 2+n]), t: bsontype.Type(data[2+n]), header: data[:3+n]}
+	e.nonce = data[3+n:]
+	return e, nil
+}
+
+// decryptValue returns the bson value of the data of an encrypted binary and
+// the encrypted parts.
+func (k *KeyRing) decryptValue(data []byte) (bson.RawValue, *encrypted, error) {
+	if k == nil {
+		return bson.RawValue{}, nil, ErrNoEncryptionKeys
+	}
+	e, err := parseEncrypted(data)
+	if err != nil {
+		return bson.RawValue{}, nil, err
+	}
+	key, err := k.key(e.keyID)
+	if err != nil {
+		return bson.RawValue{}, nil, err
+	}
+
+	size := key.aead.NonceSize()
+	if len(e.nonce) < size {
+		return bson.RawValue{}, nil, ErrInvalidEncrypted
+	}
+	e.nonce, e.ciphertext = e.nonce[:size], e.nonce[size:]
+	plain, err := key.aead.Open(nil, e.nonce, e.ciphertext, e.header)
+	if err != nil {
+		return bson.RawValue{}, nil, fmt.Errorf("%w: %s", ErrInvalidEncrypted, err.Error())
+	}
+	return bson.RawValue{Type: e.t, Value: plain}, e, nil
+}
+
+func isEncrypted(v interface{}) bool {
+	b, ok := v.(primitive.Binary)
+	return ok && b.Subtype == EncryptedSubtype
+}
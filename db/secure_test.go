@@ -0,0 +1,211 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/vavas/go_services/db/query"
+)
+
+type secureProfile struct {
+	Phone string `bson:"phone" secure:"encrypt"`
+	City  string `bson:"city"`
+}
+
+type secureUser struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Email   string             `bson:"email" secure:"encrypt,deterministic"`
+	Name    string             `bson:"name" secure:"encrypt"`
+	Age     int                `bson:"age"`
+	Profile secureProfile      `bson:"profile"`
+}
+
+func useKeys(t *testing.T, id string) *KeyRing {
+	keys, err := NewKeyRing(id, []byte("0123456789abcdef-"+id))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	previous := EncryptionKeys
+	EncryptionKeys = keys
+	t.Cleanup(func() { EncryptionKeys = previous })
+	return keys
+}
+
+func TestSecureFields(t *testing.T) {
+	fields := fieldsOf(&secureUser{})
+	expected := secureFields{"email": true, "name": false, "profile.phone": false}
+	if len(fields) != len(expected) {
+		t.Fatalf("Unexpected fields: %+v, expected %+v", fields, expected)
+	}
+	for path, deterministic := range expected {
+		if d, ok := fields[path]; !ok || d != deterministic {
+			t.Errorf("Unexpected field %s: %+v, expected %+v", path, fields, expected)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	useKeys(t, "k1")
+	m := NewMemory()
+	repo := RepoOf[secureUser](m.Col("users"))
+	ctx := context.Background()
+
+	user := &secureUser{Email: "ann@example.com", Name: "Ann", Age: 31, Profile: secureProfile{Phone: "555", City: "Oslo"}}
+	id, err := repo.Insert(ctx, user)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	raw := m.collections["users"][0].Map()
+	for _, field := range []string{"email", "name"} {
+		if !isEncrypted(raw[field]) {
+			t.Errorf("Unexpected %s: %+v, expected an encrypted value", field, raw[field])
+		}
+	}
+	if profile := raw["profile"].(primitive.D).Map(); !isEncrypted(profile["phone"]) || profile["city"] != "Oslo" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+
+	found, err := repo.FindOne(ctx, query.Eq("email", "ann@example.com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if found.ID != id || found.Name != "Ann" || found.Profile.Phone != "555" {
+		t.Errorf("Unexpected user: %+v", found)
+	}
+	if n, _ := repo.Count(ctx, query.In("email", "bob@example.com", "ann@example.com")); n != 1 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 1)
+	}
+	if _, err := repo.FindOne(ctx, query.Eq("name", "Ann")); !errors.Is(err, ErrEncryptedField) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrEncryptedField)
+	}
+	if _, err := repo.FindOne(ctx, query.Gt("email", "a")); !errors.Is(err, ErrEncryptedField) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrEncryptedField)
+	}
+
+	if err := repo.UpdateByID(ctx, id, query.NewUpdate().Set("name", "Anna")); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if err := repo.UpdateByID(ctx, id, primitive.M{"$push": primitive.M{"email": "x"}}); !errors.Is(err, ErrEncryptedField) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrEncryptedField)
+	}
+	users, err := repo.Find(ctx, nil)
+	if err != nil || len(users) != 1 || users[0].Name != "Anna" {
+		t.Errorf("Unexpected users: %+v (%+v)", users, err)
+	}
+	if !isEncrypted(m.collections["users"][0].Map()["name"]) {
+		t.Errorf("Unexpected updated name: %+v, expected an encrypted value", m.collections["users"][0].Map()["name"])
+	}
+}
+
+func TestEncryptionRotation(t *testing.T) {
+	keys := useKeys(t, "k1")
+	c := NewMemory().Col("users").WithEncryption(secureUser{})
+
+	if _, err := c.Insert(&secureUser{Email: "ann@example.com", Name: "Ann"}); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if err := keys.Rotate("k2", []byte("fedcba9876543210-k2")); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	// the old values are still read and looked up with each key
+	user := secureUser{}
+	if err := c.One(nil, nil, &user); err != nil || user.Email != "ann@example.com" {
+		t.Errorf("Unexpected user: %+v (%+v)", user, err)
+	}
+	user = secureUser{}
+	if err := c.One(query.Eq("email", "ann@example.com"), nil, &user); err != nil || user.Name != "Ann" {
+		t.Errorf("Unexpected user: %+v (%+v)", user, err)
+	}
+	if n, _ := c.Count(query.In("email", "bob@example.com", "ann@example.com")); n != 1 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 1)
+	}
+	if n, _ := c.Count(query.Ne("email", "ann@example.com")); n != 0 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 0)
+	}
+
+	n, err := c.Reencrypt(context.Background(), nil)
+	if err != nil || n != 1 {
+		t.Errorf("Unexpected re-encrypted count: %+v (%+v), expected %+v", n, err, 1)
+	}
+	if n, _ := c.Count(query.Eq("email", "ann@example.com")); n != 1 {
+		t.Errorf("Unexpected count: %+v, expected %+v", n, 1)
+	}
+	if n, _ := c.Reencrypt(context.Background(), nil); n != 0 {
+		t.Errorf("Unexpected re-encrypted count: %+v, expected %+v", n, 0)
+	}
+
+	EncryptionKeys, _ = NewKeyRing("k3", []byte("another key of 16b"))
+	if err := c.One(nil, nil, &user); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrUnknownKey)
+	}
+}
+
+func TestCollectionKeys(t *testing.T) {
+	useKeys(t, "k1")
+	keys, _ := NewKeyRing("own", []byte("0123456789abcdef-own"))
+	m := NewMemory()
+	c := m.Col("users").WithEncryption(secureUser{}).WithKeys(keys)
+
+	if _, err := c.Insert(&secureUser{Email: "ann@example.com", Name: "Ann"}); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	e, err := parseEncrypted(m.collections["users"][0].Map()["name"].(primitive.Binary).Data)
+	if err != nil || e.keyID != "own" {
+		t.Errorf("Unexpected encrypted name: %+v (%+v), expected key %+v", e, err, "own")
+	}
+
+	user := secureUser{}
+	if err := c.One(query.Eq("email", "ann@example.com"), nil, &user); err != nil || user.Name != "Ann" {
+		t.Errorf("Unexpected user: %+v (%+v)", user, err)
+	}
+	if err := m.Col("users").One(nil, nil, &user); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrUnknownKey)
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	keys, err := ParseKeyRing("k2:MDEyMzQ1Njc4OWFiY2RlZg==, k1:ZmVkY2JhOTg3NjU0MzIxMA==")
+	if err != nil || keys.Current() != "k2" || len(keys.keys) != 2 {
+		t.Errorf("Unexpected key ring: %+v (%+v)", keys, err)
+	}
+	for _, s := range []string{"", "k1", "k1:short", "k1:!!"} {
+		if _, err := ParseKeyRing(s); err == nil {
+			t.Errorf("Unexpected error of %s: %+v, expected an error", s, err)
+		}
+	}
+}
+
+func TestEncryptionUpdateStruct(t *testing.T) {
+	useKeys(t, "k1")
+	m := NewMemory()
+	c := m.Col("profiles")
+	if _, err := c.Insert(primitive.M{"city": "Oslo", "version": 0}); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	// the tagged fields of the structs set are encrypted without WithEncryption
+	update := primitive.D{{Key: "$set", Value: secureProfile{Phone: "555", City: "Bergen"}}}
+	if err := c.Update(query.Eq("city", "Oslo"), update); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	raw := m.collections["profiles"][0].Map()
+	if phone, ok := raw["phone"].(primitive.Binary); !ok || phone.Subtype != 0x80 || raw["city"] != "Bergen" {
+		t.Errorf("Unexpected profile: %+v, expected an encrypted phone", raw)
+	}
+
+	profile := secureProfile{}
+	if err := c.ModifyVersion(nil, 0, secureProfile{Phone: "556", City: "Oslo"}, &profile); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if profile.Phone != "556" || profile.City != "Oslo" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+	if raw := m.collections["profiles"][0].Map(); !isEncrypted(raw["phone"]) {
+		t.Errorf("Unexpected phone: %+v, expected an encrypted value", raw["phone"])
+	}
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeletedAtField is the field set by the removes of soft delete collections.
+var DeletedAtField = "deleted_at"
+
+// WithSoftDelete returns a copy of the collection whose removes set
+// deleted_at instead of deleting, and whose reads leave out the soft deleted
+// documents.
+func (c *Collection) WithSoftDelete() *Collection {
+	col := *c
+	col.SoftDelete = true
+	return &col
+}
+
+// WithDeleted returns a copy of the collection whose reads include the soft
+// deleted documents.
+func (c *Collection) WithDeleted() *Collection {
+	col := *c
+	col.withDeleted = true
+	return &col
+}
+
+// notDeleted returns filter restricted to the documents not soft deleted.
+func (c *Collection) notDeleted(filter interface{}) interface{} {
+	if !c.SoftDelete || c.withDeleted {
+		if filter == nil {
+			return primitive.D{}
+		}
+		return filter
+	}
+
+	notDeleted := primitive.M{DeletedAtField: nil}
+	if filter == nil {
+		return notDeleted
+	}
+	return primitive.M{"$and": primitive.A{filter, notDeleted}}
+}
+
+// notDeletedPipe returns pipe restricted to the documents not soft deleted,
+// see matchFirst.
+func (c *Collection) notDeletedPipe(pipe mongo.Pipeline) mongo.Pipeline {
+	if !c.SoftDelete || c.withDeleted {
+		return pipe
+	}
+	return matchFirst(pipe, primitive.M{DeletedAtField: nil})
+}
+
+// matchFirst returns a copy of pipe starting with a $match of cond. The stages
+// that must come first are kept first: cond is added to the query of a
+// $geoNear, and the $match follows a $search, $vectorSearch or $changeStream.
+func matchFirst(pipe mongo.Pipeline, cond primitive.M) mongo.Pipeline {
+	match := primitive.D{{Key: "$match", Value: cond}}
+	if len(pipe) == 0 || len(pipe[0]) == 0 {
+		return append(mongo.Pipeline{match}, pipe...)
+	}
+
+	first := pipe[0][0]
+	switch first.Key {
+	case "$geoNear":
+		stage, err := toD(first.Value)
+		if err != nil {
+			break
+		}
+		query := primitive.E{Key: "query", Value: cond}
+		for i, e := range stage {
+			if e.Key == "query" {
+				stage = append(stage[:i:i], stage[i+1:]...)
+				query.Value = primitive.M{"$and": primitive.A{e.Value, cond}}
+				break
+			}
+		}
+		geoNear := primitive.D{{Key: "$geoNear", Value: append(stage, query)}}
+		return append(mongo.Pipeline{geoNear}, pipe[1:]...)
+	case "$search", "$vectorSearch", "$changeStream":
+		return append(mongo.Pipeline{pipe[0], match}, pipe[1:]...)
+	}
+	return append(mongo.Pipeline{match}, pipe...)
+}
+
+// softDelete sets deleted_at of one or all documents matching selector and
+// returns the number of documents deleted.
+func (c *Collection) softDelete(ctx context.Context, selector interface{}, all bool) (int64, error) {
+	update, err := c.updateDocument(softDeleteUpdate())
+	if err != nil {
+		return 0, err
+	}
+
+	var result *mongo.UpdateResult
+	filter := (&Collection{SoftDelete: true}).notDeleted(selector)
+	if all {
+		result, err = c.UpdateMany(ctx, filter, update)
+	} else {
+		result, err = c.UpdateOne(ctx, filter, update)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+func softDeleteUpdate() primitive.D {
+	return primitive.D{{Key: "$set", Value: primitive.D{{Key: DeletedAtField, Value: now()}}}}
+}
+
+// Restore clears deleted_at of the soft deleted documents matching selector.
+func (c *Collection) Restore(selector interface{}) (*mongo.UpdateResult, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.RestoreContext(ctx, selector)
+}
+
+// RestoreContext clears deleted_at of the soft deleted documents matching
+// selector.
+func (c *Collection) RestoreContext(ctx context.Context, selector interface{}) (*mongo.UpdateResult, error) {
+	deleted := primitive.M{DeletedAtField: primitive.M{"$ne": nil}}
+	filter := interface{}(deleted)
+	if selector != nil {
+		filter = primitive.M{"$and": primitive.A{selector, deleted}}
+	}
+	filter, err := c.scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	update, err := c.updateDocument(primitive.D{{Key: "$unset", Value: primitive.D{{Key: DeletedAtField, Value: ""}}}})
+	if err != nil {
+		return nil, err
+	}
+	return c.UpdateMany(ctx, filter, update)
+}
+
+// Purge deletes the documents soft deleted more than days ago.
+func (c *Collection) Purge(days int) (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.PurgeContext(ctx, days)
+}
+
+// PurgeContext deletes the documents soft deleted more than days ago.
+func (c *Collection) PurgeContext(ctx context.Context, days int) (int64, error) {
+	before := time.Now().AddDate(0, 0, -days)
+	filter, err := c.scope(ctx, primitive.M{DeletedAtField: primitive.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	result, err := c.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNotDeleted(t *testing.T) {
+	c := &Collection{}
+	filter := primitive.M{"name": "test"}
+
+	if f := c.notDeleted(filter); f.(primitive.M)["name"] != "test" {
+		t.Errorf("Unexpected filter: %+v, expected %+v", f, filter)
+	}
+
+	soft := c.WithSoftDelete()
+	data, _ := bson.MarshalExtJSON(soft.notDeleted(filter), false, false)
+	expected := `{"$and":[{"name":"test"},{"deleted_at":null}]}`
+	if string(data) != expected {
+		t.Errorf("Unexpected filter: %s, expected %s", data, expected)
+	}
+
+	if f := soft.WithDeleted().notDeleted(nil); len(f.(primitive.D)) != 0 {
+		t.Errorf("Unexpected filter: %+v, expected an empty filter", f)
+	}
+
+	pipe := soft.notDeletedPipe(mongo.Pipeline{{{Key: "$limit", Value: 1}}})
+	if len(pipe) != 2 || pipe[0][0].Key != "$match" {
+		t.Errorf("Unexpected pipeline: %+v", pipe)
+	}
+
+	// the stages that must be first stay first
+	pipe = soft.notDeletedPipe(mongo.Pipeline{{{Key: "$search", Value: primitive.M{"text": primitive.M{"query": "a"}}}}})
+	if len(pipe) != 2 || pipe[0][0].Key != "$search" || pipe[1][0].Key != "$match" {
+		t.Errorf("Unexpected pipeline: %+v", pipe)
+	}
+	geoNear := primitive.D{{Key: "$geoNear", Value: primitive.M{"near": primitive.A{0, 0}, "distanceField": "d"}}}
+	pipe = soft.notDeletedPipe(mongo.Pipeline{geoNear})
+	data, _ = bson.MarshalExtJSON(pipe[0], false, false)
+	if len(pipe) != 1 || !strings.Contains(string(data), `"query":{"deleted_at":null}`) {
+		t.Errorf("Unexpected pipeline: %s", data)
+	}
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TenantField is the field holding the tenant of the documents of tenant
+// scoped collections.
+var TenantField = "tenant_id"
+
+// ErrNoTenant is returned by tenant scoped collections for a context without
+// tenant that does not bypass the scope.
+var ErrNoTenant = errors.New("query is not scoped to a tenant")
+
+// ErrTenantMismatch is returned when writing a document of another tenant or
+// changing the tenant of documents.
+var ErrTenantMismatch = errors.New("document belongs to another tenant")
+
+// ErrTenantUnscoped is returned by the operations of tenant scoped collections
+// that can not be scoped, unless the context bypasses the scope.
+var ErrTenantUnscoped = errors.New("operation can not be scoped to a tenant")
+
+type tenantKey struct{}
+
+type tenantBypassKey struct{}
+
+// WithTenant returns a copy of ctx scoping the queries of tenant scoped
+// collections to tenant.
+func WithTenant(ctx context.Context, tenant interface{}) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by ctx.
+func TenantFromContext(ctx context.Context) (interface{}, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	tenant := ctx.Value(tenantKey{})
+	return tenant, tenant != nil
+}
+
+// WithoutTenant returns a copy of ctx whose queries of tenant scoped
+// collections are explicitly not scoped, e.g. for maintenance jobs.
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantBypassKey{}, true)
+}
+
+func bypassesTenant(ctx context.Context) bool {
+	bypass, _ := ctx.Value(tenantBypassKey{}).(bool)
+	return bypass
+}
+
+// WithTenantScope returns a copy of the collection whose filters, inserts,
+// updates and aggregations are scoped to the tenant of the context. Its methods
+// without a context return ErrNoTenant, the *Context ones must be used.
+func (c *Collection) WithTenantScope() *Collection {
+	col := *c
+	col.TenantScoped = true
+	return &col
+}
+
+// tenant returns the tenant of ctx, nil when the collection is not scoped or
+// ctx bypasses the scope.
+func (c *Collection) tenant(ctx context.Context) (interface{}, error) {
+	if !c.TenantScoped || bypassesTenant(ctx) {
+		return nil, nil
+	}
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	return tenant, nil
+}
+
+// scope returns filter restricted to the tenant of ctx, with its encrypted
+// fields encrypted.
+func (c *Collection) scope(ctx context.Context, filter interface{}) (interface{}, error) {
+	tenant, err := c.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if filter, err = c.encryptFilter(filter); err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return orEmpty(filter), nil
+	}
+
+	scoped := primitive.M{TenantField: tenant}
+	if filter == nil {
+		return scoped, nil
+	}
+	return primitive.M{"$and": primitive.A{filter, scoped}}, nil
+}
+
+// readFilter returns filter restricted to the tenant of ctx and to the
+// documents not soft deleted.
+func (c *Collection) readFilter(ctx context.Context, filter interface{}) (interface{}, error) {
+	scoped, err := c.scope(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.notDeleted(scoped), nil
+}
+
+// scopePipe returns pipe restricted to the tenant of ctx, see matchFirst.
+func (c *Collection) scopePipe(ctx context.Context, pipe mongo.Pipeline) (mongo.Pipeline, error) {
+	tenant, err := c.tenant(ctx)
+	if err != nil || tenant == nil {
+		return pipe, err
+	}
+	return matchFirst(pipe, primitive.M{TenantField: tenant}), nil
+}
+
+// scopeUpdate returns update with the tenant of ctx set in a replacement, and
+// ErrTenantMismatch when it changes the tenant of the documents.
+func (c *Collection) scopeUpdate(ctx context.Context, update interface{}) (interface{}, error) {
+	tenant, err := c.tenant(ctx)
+	if err != nil || tenant == nil {
+		return update, err
+	}
+	doc, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) == 0 || !strings.HasPrefix(doc[0].Key, "$") {
+		return c.scopeDocument(ctx, update)
+	}
+
+	for _, op := range doc {
+		fields, err := toD(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			switch {
+			case op.Key == "$rename" && f.Value == TenantField:
+				return nil, ErrTenantMismatch
+			case f.Key != TenantField && !strings.HasPrefix(f.Key, TenantField+"."):
+			case (op.Key == "$set" || op.Key == "$setOnInsert") && f.Key == TenantField && sameValue(f.Value, tenant):
+			default:
+				return nil, ErrTenantMismatch
+			}
+		}
+	}
+	return update, nil
+}
+
+// scopeDocument sets the tenant of a document to insert.
+func (c *Collection) scopeDocument(ctx context.Context, document interface{}) (interface{}, error) {
+	tenant, err := c.tenant(ctx)
+	if err != nil || tenant == nil {
+		return document, err
+	}
+
+	// the fields to encrypt are known from the document type
+	if document, err = c.encryptDocument(document); err != nil {
+		return nil, err
+	}
+	doc, err := toD(document)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range doc {
+		if e.Key != TenantField {
+			continue
+		}
+		if e.Value != nil && !sameValue(e.Value, tenant) {
+			return nil, ErrTenantMismatch
+		}
+		doc[i].Value = tenant
+		return doc, nil
+	}
+	return append(doc, primitive.E{Key: TenantField, Value: tenant}), nil
+}
+
+func sameValue(a interface{}, b interface{}) bool {
+	ra, rb := rawValue(a), rawValue(b)
+	return ra.Type == rb.Type && string(ra.Value) == string(rb.Value)
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestTenantScope(t *testing.T) {
+	c := (&Collection{}).WithTenantScope()
+
+	if _, err := c.scope(context.Background(), nil); err != ErrNoTenant {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrNoTenant)
+	}
+	if err := c.AllContext(context.Background(), nil, nil, &[]bson.M{}); err != ErrNoTenant {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrNoTenant)
+	}
+
+	filter, err := c.scope(WithoutTenant(context.Background()), primitive.M{"name": "test"})
+	if err != nil || filter.(primitive.M)["name"] != "test" {
+		t.Errorf("Unexpected filter: %+v, error %+v", filter, err)
+	}
+
+	ctx := WithTenant(context.Background(), "t1")
+	filter, _ = c.WithSoftDelete().readFilter(ctx, primitive.M{"name": "test"})
+	data, _ := bson.MarshalExtJSON(filter, false, false)
+	expected := `{"$and":[{"$and":[{"name":"test"},{"tenant_id":"t1"}]},{"deleted_at":null}]}`
+	if string(data) != expected {
+		t.Errorf("Unexpected filter: %s, expected %s", data, expected)
+	}
+
+	pipe, _ := c.scopePipe(ctx, mongo.Pipeline{})
+	if len(pipe) != 1 || pipe[0][0].Key != "$match" {
+		t.Errorf("Unexpected pipeline: %+v", pipe)
+	}
+
+	// the query of a $geoNear is scoped, it must stay the first stage
+	geoNear := primitive.D{{Key: "$geoNear", Value: primitive.D{{Key: "near", Value: primitive.A{0, 0}}, {Key: "query", Value: primitive.M{"open": true}}}}}
+	pipe, _ = c.scopePipe(ctx, mongo.Pipeline{geoNear, {{Key: "$limit", Value: 1}}})
+	data, _ = bson.MarshalExtJSON(pipe[0], false, false)
+	expected = `{"$geoNear":{"near":[0,0],"query":{"$and":[{"open":true},{"tenant_id":"t1"}]}}}`
+	if len(pipe) != 2 || string(data) != expected {
+		t.Errorf("Unexpected pipeline: %s, expected %s", data, expected)
+	}
+}
+
+func TestTenantDocument(t *testing.T) {
+	c := (&Collection{}).WithTenantScope()
+	ctx := WithTenant(context.Background(), "t1")
+
+	doc, err := c.scopeDocument(ctx, primitive.M{"name": "test"})
+	if err != nil || doc.(primitive.D).Map()[TenantField] != "t1" {
+		t.Errorf("Unexpected document: %+v, error %+v", doc, err)
+	}
+
+	if _, err := c.scopeDocument(ctx, primitive.M{TenantField: "t2"}); err != ErrTenantMismatch {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrTenantMismatch)
+	}
+}
+
+func TestTenantUpdate(t *testing.T) {
+	c := (&Collection{}).WithTenantScope()
+	ctx := WithTenant(context.Background(), "t1")
+
+	for _, update := range []interface{}{
+		primitive.M{"$set": primitive.M{"name": "test"}},
+		primitive.M{"$set": primitive.M{TenantField: "t1"}},
+		primitive.D{{Key: "$inc", Value: primitive.M{"visits": 1}}},
+	} {
+		if _, err := c.scopeUpdate(ctx, update); err != nil {
+			t.Errorf("Unexpected error of %+v: %+v, expected nil", update, err)
+		}
+	}
+	for _, update := range []interface{}{
+		primitive.M{"$set": primitive.M{TenantField: "t2"}},
+		primitive.M{"$unset": primitive.M{TenantField: ""}},
+		primitive.M{"$rename": primitive.M{TenantField: "owner"}},
+		primitive.M{"$rename": primitive.M{"owner": TenantField}},
+		primitive.M{"name": "test", TenantField: "t2"},
+	} {
+		if _, err := c.scopeUpdate(ctx, update); err != ErrTenantMismatch {
+			t.Errorf("Unexpected error of %+v: %+v, expected %+v", update, err, ErrTenantMismatch)
+		}
+	}
+
+	replacement, err := c.scopeUpdate(ctx, primitive.M{"name": "test"})
+	if err != nil || replacement.(primitive.D).Map()[TenantField] != "t1" {
+		t.Errorf("Unexpected replacement: %+v, error %+v", replacement, err)
+	}
+}
+
+func TestTenantUnscoped(t *testing.T) {
+	m := NewMemory()
+	c := Col(m.DB(), "users").WithTenantScope().WithAudit()
+	t1 := WithTenant(context.Background(), "t1")
+
+	if _, err := c.Watch(t1, mongo.Pipeline{}); err != ErrTenantUnscoped {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrTenantUnscoped)
+	}
+	if _, err := c.Watch(WithoutTenant(t1), mongo.Pipeline{}); err != ErrMemoryUnsupported {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrMemoryUnsupported)
+	}
+
+	if err := c.UpdateContext(t1, nil, primitive.M{"$set": primitive.M{"name": "ann"}}, true); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if err := c.UpdateContext(WithTenant(context.Background(), "t2"), nil, primitive.M{"$set": primitive.M{"name": "bob"}}, true); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	entries, err := FindAudit(t1, m.DB(), AuditQuery{Collection: "users"})
+	if err != nil || len(entries) != 1 || entries[0].TenantID != "t1" {
+		t.Errorf("Unexpected audit entries: %+v (%+v)", entries, err)
+	}
+	if entries, _ := FindAudit(WithoutTenant(t1), m.DB(), AuditQuery{Collection: "users"}); len(entries) != 2 {
+		t.Errorf("Unexpected audit entries: %+v, expected 2", entries)
+	}
+}
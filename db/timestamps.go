@@ -0,0 +1,205 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Timestamp fields managed by the Collection write methods: created_at is
+// set when a document is inserted, updated_at on every write.
+var (
+	CreatedAtField = "created_at"
+	UpdatedAtField = "updated_at"
+)
+
+// WithoutTimestamps returns a copy of the collection whose write methods
+// leave created_at & updated_at alone.
+func (c *Collection) WithoutTimestamps() *Collection {
+	col := *c
+	col.NoTimestamps = true
+	return &col
+}
+
+// now is the timestamp of a write, at the precision stored by mongo.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// toD converts a document, e.g. a struct, to a primitive.D.
+func toD(document interface{}) (primitive.D, error) {
+	if doc, ok := document.(primitive.D); ok {
+		return append(primitive.D{}, doc...), nil
+	}
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	doc := primitive.D{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func isUnset(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case primitive.DateTime:
+		return v.Time().IsZero() || v == 0
+	case time.Time:
+		return v.IsZero()
+	}
+	return false
+}
+
+// stampDocument sets the timestamps of a document to insert, created_at is
+// kept if the document has one.
+func stampDocument(document interface{}, at time.Time) (primitive.D, error) {
+	doc, err := toD(document)
+	if err != nil {
+		return nil, err
+	}
+
+	hasCreatedAt := false
+	hasUpdatedAt := false
+	for i, e := range doc {
+		switch e.Key {
+		case CreatedAtField:
+			hasCreatedAt = true
+			if isUnset(e.Value) {
+				doc[i].Value = at
+			}
+		case UpdatedAtField:
+			hasUpdatedAt = true
+			doc[i].Value = at
+		}
+	}
+	if !hasCreatedAt {
+		doc = append(doc, primitive.E{Key: CreatedAtField, Value: at})
+	}
+	if !hasUpdatedAt {
+		doc = append(doc, primitive.E{Key: UpdatedAtField, Value: at})
+	}
+	return doc, nil
+}
+
+// insertDocument returns the document to insert.
+func (c *Collection) insertDocument(document interface{}) (interface{}, error) {
+	document, err := c.encryptDocument(document)
+	if err != nil || c.NoTimestamps {
+		return document, err
+	}
+	return stampDocument(document, now())
+}
+
+// insertDocuments returns the documents to insert.
+func (c *Collection) insertDocuments(documents []interface{}) ([]interface{}, error) {
+	at := now()
+	docs := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		doc, err := c.encryptDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		if c.NoTimestamps {
+			docs = append(docs, doc)
+			continue
+		}
+		doc, err = stampDocument(doc, at)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// updateDocument returns the update with updated_at set to the current date
+// and created_at set on upserts, unless update already sets them. Updates
+// that are not operator documents are returned unchanged, but for their
+// encrypted fields.
+func (c *Collection) updateDocument(update interface{}) (interface{}, error) {
+	update, err := c.encryptUpdate(update, merge(c.secure, updateFields(update)))
+	if err != nil || c.NoTimestamps {
+		return update, err
+	}
+
+	doc, err := toD(update)
+	if err != nil || (len(doc) > 0 && !strings.HasPrefix(doc[0].Key, "$")) {
+		return update, nil
+	}
+
+	touched := map[string]bool{}
+	for _, op := range doc {
+		fields, err := toD(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			touched[f.Key] = true
+		}
+	}
+
+	if !touched[UpdatedAtField] {
+		if doc, err = setOperator(doc, "$currentDate", UpdatedAtField, true); err != nil {
+			return nil, err
+		}
+	}
+	if !touched[CreatedAtField] {
+		if doc, err = setOperator(doc, "$setOnInsert", CreatedAtField, now()); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// modifyDocument returns the $set update of fields.
+func (c *Collection) modifyDocument(fields interface{}) (interface{}, error) {
+	secure := merge(c.secure, fieldsOf(fields))
+	if c.NoTimestamps {
+		return c.encryptUpdate(primitive.M{"$set": fields}, secure)
+	}
+
+	// the timestamps are managed, setting them would conflict
+	doc, err := toD(fields)
+	if err != nil {
+		return nil, err
+	}
+	set := primitive.D{}
+	for _, e := range doc {
+		if e.Key != CreatedAtField && e.Key != UpdatedAtField {
+			set = append(set, e)
+		}
+	}
+
+	if set, err = secure.encrypt(c.keyRing(), set, ""); err != nil {
+		return nil, err
+	}
+
+	update := primitive.D{}
+	if len(set) > 0 {
+		update = append(update, primitive.E{Key: "$set", Value: set})
+	}
+	return c.updateDocument(update)
+}
+
+// setOperator returns a copy of an update document with field: value added to
+// its operator.
+func setOperator(update primitive.D, operator string, field string, value interface{}) (primitive.D, error) {
+	out := append(primitive.D{}, update...)
+	for i, op := range out {
+		if op.Key == operator {
+			fields, err := toD(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			out[i].Value = append(fields, primitive.E{Key: field, Value: value})
+			return out, nil
+		}
+	}
+	return append(out, primitive.E{Key: operator, Value: primitive.D{{Key: field, Value: value}}}), nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStampDocument(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := now()
+
+	doc, err := stampDocument(struct {
+		Name      string    `bson:"name"`
+		CreatedAt time.Time `bson:"created_at"`
+		UpdatedAt time.Time `bson:"updated_at"`
+	}{Name: "test", CreatedAt: createdAt}, at)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	m := doc.Map()
+	if m[CreatedAtField].(primitive.DateTime).Time().UTC() != createdAt {
+		t.Errorf("Unexpected created_at: %+v, expected %+v", m[CreatedAtField], createdAt)
+	}
+	if m[UpdatedAtField] != at {
+		t.Errorf("Unexpected updated_at: %+v, expected %+v", m[UpdatedAtField], at)
+	}
+
+	doc, _ = stampDocument(primitive.M{"name": "test"}, at)
+	if m := doc.Map(); m[CreatedAtField] != at || m[UpdatedAtField] != at {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+}
+
+func TestUpdateDocument(t *testing.T) {
+	c := &Collection{}
+
+	update, err := c.updateDocument(primitive.M{"$set": primitive.M{"name": "test"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	data, _ := bson.Marshal(update)
+	raw := bson.Raw(data)
+	if !raw.Lookup("$currentDate", UpdatedAtField).Boolean() {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+	if _, err := raw.LookupErr("$setOnInsert", CreatedAtField); err != nil {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+
+	update, _ = c.modifyDocument(primitive.M{"name": "test", CreatedAtField: time.Now()})
+	data, _ = bson.Marshal(update)
+	raw = bson.Raw(data)
+	if _, err := raw.LookupErr("$set", CreatedAtField); err == nil {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+
+	at := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	update, _ = c.updateDocument(primitive.D{{Key: "$setOnInsert", Value: primitive.M{CreatedAtField: at}}})
+	data, _ = bson.Marshal(update)
+	raw = bson.Raw(data)
+	if elems, _ := raw.Lookup("$setOnInsert").Document().Elements(); len(elems) != 1 || !raw.Lookup("$setOnInsert", CreatedAtField).Time().Equal(at) {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+
+	replacement := primitive.M{"name": "test"}
+	if update, _ := c.WithoutTimestamps().updateDocument(replacement); update.(primitive.M)["name"] != "test" {
+		t.Errorf("Unexpected update: %+v", update)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// TransactionRetryTimeout is how long WithTransaction keeps retrying
+// transient transaction and unknown commit result errors.
+var TransactionRetryTimeout = 120 * time.Second
+
+// Transaction error labels that are retried.
+const (
+	TransientTransactionError      = "TransientTransactionError"
+	UnknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// TxFunc is the body of a transaction. Operations must use ctx, e.g. the
+// Collection *Context methods, to be part of the transaction.
+type TxFunc func(ctx context.Context) error
+
+// HasErrorLabel returns true if err is a mongo error with label.
+func HasErrorLabel(err error, label string) bool {
+	var labeled mongo.LabeledError
+	return errors.As(err, &labeled) && labeled.HasErrorLabel(label)
+}
+
+// WithTransaction runs fn in a transaction of the default client, see
+// Client.WithTransaction.
+func WithTransaction(ctx context.Context, fn TxFunc, opts ...*options.TransactionOptions) error {
+	return defaultClient.WithTransaction(ctx, fn, opts...)
+}
+
+// WithTransaction runs fn in a multi-document transaction and commits it.
+// fn is run again when the transaction fails with a TransientTransactionError
+// and the commit is retried on UnknownTransactionCommitResult, until
+// TransactionRetryTimeout. If ctx is already in a transaction fn joins it.
+// fn is run without a transaction by the client of a Memory, and
+// ErrNotConnected is returned when the client is not connected.
+func (c *Client) WithTransaction(ctx context.Context, fn TxFunc, opts ...*options.TransactionOptions) error {
+	if sess := mongo.SessionFromContext(ctx); sess != nil {
+		return fn(ctx)
+	}
+	if !c.HasClient() {
+		return ErrNotConnected
+	}
+	if c.memory != nil {
+		return fn(ctx)
+	}
+
+	sess, err := c.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(context.Background())
+
+	deadline := time.Now().Add(TransactionRetryTimeout)
+	sctx := mongo.NewSessionContext(ctx, sess)
+
+	for attempt := 1; ; attempt++ {
+		if err := sess.StartTransaction(opts...); err != nil {
+			return err
+		}
+
+		if err := fn(sctx); err != nil {
+			_ = sess.AbortTransaction(context.Background())
+			if HasErrorLabel(err, TransientTransactionError) && time.Now().Before(deadline) && ctx.Err() == nil {
+				c.logger().Debug("retrying transaction",
+					zap.Error(err),
+					zap.Int("attempt", attempt))
+				continue
+			}
+			return err
+		}
+
+		err := c.commit(sctx, sess, deadline)
+		if err != nil && HasErrorLabel(err, TransientTransactionError) && time.Now().Before(deadline) && ctx.Err() == nil {
+			c.logger().Debug("retrying transaction",
+				zap.Error(err),
+				zap.Int("attempt", attempt))
+			continue
+		}
+		return err
+	}
+}
+
+func (c *Client) commit(ctx context.Context, sess mongo.Session, deadline time.Time) error {
+	for {
+		err := sess.CommitTransaction(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.IsMaxTimeMSExpiredError() {
+			return err
+		}
+		if !HasErrorLabel(err, UnknownTransactionCommitResult) || time.Now().After(deadline) || ctx.Err() != nil {
+			return err
+		}
+
+		c.logger().Debug("retrying transaction commit", zap.Error(err))
+	}
+}
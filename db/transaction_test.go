@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestHasErrorLabel(t *testing.T) {
+	err := mongo.CommandError{Code: 112, Labels: []string{TransientTransactionError}}
+	if !HasErrorLabel(err, TransientTransactionError) {
+		t.Errorf("Unexpected label of %+v: false, expected true", err)
+	}
+	if !HasErrorLabel(fmt.Errorf("insert: %w", err), TransientTransactionError) {
+		t.Errorf("Unexpected label of the wrapped %+v: false, expected true", err)
+	}
+	if HasErrorLabel(err, UnknownTransactionCommitResult) {
+		t.Errorf("Unexpected label %s of %+v: true, expected false", UnknownTransactionCommitResult, err)
+	}
+	if HasErrorLabel(errors.New("failed"), TransientTransactionError) {
+		t.Errorf("Unexpected label of a plain error: true, expected false")
+	}
+}
+
+func TestWithTransactionNotConnected(t *testing.T) {
+	called := false
+	fn := func(ctx context.Context) error {
+		called = true
+		return nil
+	}
+
+	if err := (&Client{}).WithTransaction(context.Background(), fn); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrNotConnected)
+	}
+	var c *Client
+	if err := c.WithTransaction(context.Background(), fn); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, ErrNotConnected)
+	}
+	if called {
+		t.Errorf("Unexpected call of the transaction function")
+	}
+}
+
+func TestWithTransactionNested(t *testing.T) {
+	// the sessions are started without reaching a server
+	mc, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	defer mc.Disconnect(context.Background())
+	c := &Client{client: mc, database: "testing"}
+
+	sess, err := mc.StartSession()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	defer sess.EndSession(context.Background())
+	outer := mongo.NewSessionContext(context.Background(), sess)
+
+	// the inner calls join the session of the outer one, even of another client
+	var joined mongo.Session
+	err = c.WithTransaction(outer, func(ctx context.Context) error {
+		return (&Client{}).WithTransaction(ctx, func(ctx context.Context) error {
+			joined = mongo.SessionFromContext(ctx)
+			return nil
+		})
+	})
+	if err != nil || joined != sess {
+		t.Errorf("Unexpected session: %+v (%+v), expected %+v", joined, err, sess)
+	}
+}
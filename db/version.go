@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// VersionField is the field holding the version of versioned documents.
+var VersionField = "version"
+
+// ErrConflict is returned by the versioned updates when the document has been
+// changed since the expected version was read.
+var ErrConflict = errors.New("version conflict")
+
+// Versioned can be embedded in documents updated with the versioned helpers.
+// The version is incremented on each of their writes.
+type Versioned struct {
+	Version int64 `bson:"version" json:"version"`
+}
+
+// UpdateVersion updates the document matching selector if it is at version,
+// and increments its version. update must use update operators.
+func (c *Collection) UpdateVersion(selector interface{}, version int64, update interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.UpdateVersionContext(ctx, selector, version, update)
+}
+
+// UpdateVersionContext updates the document matching selector if it is at
+// version, and increments its version. It returns ErrConflict when the
+// version differs and ErrNotFound when no document matches selector.
+func (c *Collection) UpdateVersionContext(ctx context.Context, selector interface{}, version int64, update interface{}) error {
+	selector, err := c.scope(ctx, selector)
+	if err != nil {
+		return err
+	}
+
+	if update, err = c.scopeUpdate(ctx, update); err != nil {
+		return err
+	}
+	update, err = c.updateDocument(update)
+	if err != nil {
+		return err
+	}
+	versionUpdate, err := incVersion(update)
+	if err != nil {
+		return err
+	}
+
+	filter := versionFilter(selector, version)
+	matched := int64(0)
+	err = c.audited(ctx, AuditUpdate, filter, false, func(filter interface{}) (interface{}, error) {
+		result, err := c.UpdateOne(ctx, filter, versionUpdate)
+		if err != nil {
+			return nil, err
+		}
+		matched = result.MatchedCount
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return c.conflict(ctx, selector)
+	}
+	return nil
+}
+
+// UpdateIDVersion updates the document with id if it is at version.
+func (c *Collection) UpdateIDVersion(id interface{}, version int64, update interface{}) error {
+	return c.UpdateVersion(primitive.M{"_id": id}, version, update)
+}
+
+// UpdateIDVersionContext updates the document with id if it is at version.
+func (c *Collection) UpdateIDVersionContext(ctx context.Context, id interface{}, version int64, update interface{}) error {
+	return c.UpdateVersionContext(ctx, primitive.M{"_id": id}, version, update)
+}
+
+// ModifyVersion uses $set to modify the document matching filter if it is at
+// version, and decodes the modified document into result.
+func (c *Collection) ModifyVersion(filter interface{}, version int64, update interface{}, result interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.ModifyVersionContext(ctx, filter, version, update, result)
+}
+
+// ModifyVersionContext uses $set to modify the document matching filter if it
+// is at version, and decodes the modified document into result.
+func (c *Collection) ModifyVersionContext(ctx context.Context, filter interface{}, version int64, update interface{}, result interface{}) error {
+	filter, err := c.scope(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.scopeUpdate(ctx, primitive.M{"$set": update}); err != nil {
+		return err
+	}
+	update, err = c.modifyDocument(update)
+	if err != nil {
+		return err
+	}
+	updateQ, err := incVersion(update)
+	if err != nil {
+		return err
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var r *mongo.SingleResult
+	err = c.audited(ctx, AuditUpdate, versionFilter(filter, version), false, func(selector interface{}) (interface{}, error) {
+		r = c.FindOneAndUpdate(ctx, selector, updateQ, opts)
+		if err := r.Err(); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if errors.Is(r.Err(), mongo.ErrNoDocuments) {
+		return c.conflict(ctx, filter)
+	}
+	if result != nil {
+		raw, err := r.Raw()
+		if err != nil {
+			return err
+		}
+		return decodeRaw(c.keyRing(), raw, result)
+	}
+	return nil
+}
+
+// conflict tells apart a missing document from one at another version.
+func (c *Collection) conflict(ctx context.Context, selector interface{}) error {
+	n, err := c.CountDocuments(ctx, selector, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+func versionFilter(selector interface{}, version int64) primitive.M {
+	// version 0 also matches documents written before they were versioned
+	expected := primitive.M{VersionField: version}
+	if version == 0 {
+		expected = primitive.M{VersionField: primitive.M{"$in": primitive.A{0, nil}}}
+	}
+	return primitive.M{"$and": primitive.A{selector, expected}}
+}
+
+// incVersion adds the version increment to the operators of update.
+func incVersion(update interface{}) (primitive.D, error) {
+	doc, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range doc {
+		if !strings.HasPrefix(op.Key, "$") {
+			return nil, fmt.Errorf(`versioned update must use update operators, got "%s"`, op.Key)
+		}
+	}
+	return setOperator(doc, "$inc", VersionField, 1)
+}
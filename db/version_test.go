@@ -0,0 +1,42 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIncVersion(t *testing.T) {
+	update, err := incVersion(primitive.M{"$inc": primitive.M{"visits": 1}, "$set": primitive.M{"name": "test"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	data, _ := bson.Marshal(update)
+
+	raw := bson.Raw(data)
+	if raw.Lookup("$inc", "visits").Int32() != 1 || raw.Lookup("$inc", VersionField).Int32() != 1 {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+
+	update, _ = incVersion(primitive.D{{Key: "$set", Value: primitive.M{"name": "test"}}})
+	if len(update) != 2 || update[1].Key != "$inc" {
+		t.Errorf("Unexpected update: %+v", update)
+	}
+
+	// the map operators keep their fields, the update is not modified
+	original := primitive.D{{Key: "$inc", Value: primitive.M{"visits": 1}}}
+	update, _ = incVersion(original)
+	data, _ = bson.Marshal(update)
+	raw = bson.Raw(data)
+	if raw.Lookup("$inc", "visits").Int32() != 1 || raw.Lookup("$inc", VersionField).Int32() != 1 {
+		t.Errorf("Unexpected update: %s", raw)
+	}
+	if inc := original[0].Value.(primitive.M); len(inc) != 1 {
+		t.Errorf("Unexpected modified update: %+v", original)
+	}
+
+	if _, err := incVersion(primitive.M{"name": "test"}); err == nil {
+		t.Errorf("Unexpected error: %+v, expected an error", err)
+	}
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/logger"
+)
+
+// ResumeTokenCollection is the collection the watchers store their resume
+// token in, so a restarted watcher continues where it stopped.
+var ResumeTokenCollection = "_resume_tokens"
+
+// WatchRetryWait is the default time a watcher waits before opening the
+// change stream again after an error.
+var WatchRetryWait = 5 * time.Second
+
+// Mongo error codes meaning the stored resume token can't be used anymore.
+const (
+	errCodeInvalidResumeToken = 260
+	errCodeHistoryLost        = 286
+)
+
+// ChangeEvent is a change of a watched collection.
+type ChangeEvent struct {
+	OperationType     string              `bson:"operationType" json:"operation_type"`
+	Database          string              `bson:"-" json:"database"`
+	Collection        string              `bson:"-" json:"collection"`
+	DocumentKey       bson.M              `bson:"documentKey" json:"document_key"`
+	FullDocument      bson.M              `bson:"fullDocument,omitempty" json:"full_document,omitempty"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription,omitempty" json:"update_description,omitempty"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime" json:"cluster_time"`
+
+	NS struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns" json:"-"`
+}
+
+// UpdateDescription lists the fields changed by an update.
+type UpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields" json:"updated_fields"`
+	RemovedFields []string `bson:"removedFields" json:"removed_fields"`
+}
+
+// DecodeDocument decodes the full document of the event into v.
+func (e *ChangeEvent) DecodeDocument(v interface{}) error {
+	if e.FullDocument == nil {
+		return mongo.ErrNoDocuments
+	}
+	data, err := bson.Marshal(e.FullDocument)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, v)
+}
+
+// ChangeHandler handles a change event. When it returns an error the event
+// is delivered again after the change stream is reopened.
+type ChangeHandler func(ctx context.Context, event *ChangeEvent) error
+
+// Publisher publishes a message to a subject, transport.Transport is one.
+type Publisher interface {
+	Publish(subject string, v interface{}) error
+}
+
+// Watcher runs a change stream on a collection, calls its handler for each
+// change and stores the resume token of the handled changes. Errors are
+// logged and the change stream is opened again from the last token.
+//
+//	w := db.NewWatcher(db.Col(dbc, "users"), nil, onUserChange)
+//	w.Publisher = a.Transport
+//	w.Start()
+//	defer w.Stop()
+type Watcher struct {
+	Collection *Collection
+	Pipeline   mongo.Pipeline
+	Handler    ChangeHandler
+
+	// Name identifies the stored resume token, the collection name by default.
+	Name string
+	// FullDocument looks up the current document of update events.
+	FullDocument bool
+	// RetryWait is the time waited before reopening the change stream,
+	// WatchRetryWait when zero.
+	RetryWait time.Duration
+
+	// Publisher, when set, publishes every change to Subject followed by
+	// the operation type, e.g. "db.changes.users.insert".
+	Publisher Publisher
+	// Subject defaults to "db.changes.<collection>".
+	Subject string
+
+	// Logger is used for the watcher logs. When nil logger.Logger is used.
+	Logger *zap.Logger
+
+	token  bson.Raw
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// NewWatcher returns a watcher of col running pipeline, e.g. a $match on
+// operationType, and calling handler for each change. The changes of every
+// tenant of a tenant scoped collection are watched.
+func NewWatcher(col *Collection, pipeline mongo.Pipeline, handler ChangeHandler) *Watcher {
+	return &Watcher{Collection: col, Pipeline: pipeline, Handler: handler}
+}
+
+// Watch starts a watcher of col in the background, see Watcher.
+func Watch(col *Collection, pipeline mongo.Pipeline, handler ChangeHandler) *Watcher {
+	w := NewWatcher(col, pipeline, handler)
+	w.Start()
+	return w
+}
+
+func (w *Watcher) logger() *zap.Logger {
+	if w.Logger != nil {
+		return w.Logger
+	}
+	return logger.Logger
+}
+
+func (w *Watcher) name() string {
+	if len(w.Name) > 0 {
+		return w.Name
+	}
+	return w.Collection.Name()
+}
+
+func (w *Watcher) subject(operation string) string {
+	subject := w.Subject
+	if len(subject) == 0 {
+		subject = "db.changes." + w.Collection.Name()
+	}
+	return strings.TrimSuffix(subject, ".") + "." + operation
+}
+
+func (w *Watcher) retryWait() time.Duration {
+	if w.RetryWait > 0 {
+		return w.RetryWait
+	}
+	return WatchRetryWait
+}
+
+func (w *Watcher) tokens() *Collection {
+	return w.Collection.sibling(ResumeTokenCollection)
+}
+
+// Start runs the watcher in the background until Stop is called.
+func (w *Watcher) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		_ = w.Run(ctx)
+	}(w.done)
+}
+
+// Stop stops a started watcher and waits for the running handler to return.
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	cancel, done := w.cancel, w.done
+	w.cancel, w.done = nil, nil
+	w.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Run runs the watcher until ctx is done.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.loadToken(ctx); err != nil && ctx.Err() == nil {
+		w.logger().Warn("loading resume token failed",
+			zap.String("watcher", w.name()),
+			zap.Error(err))
+	}
+
+	for {
+		err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrMemoryUnsupported) {
+			return err
+		}
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == errCodeHistoryLost || cmdErr.Code == errCodeInvalidResumeToken) {
+			w.logger().Error("resume token is no longer valid, watching from now on",
+				zap.String("watcher", w.name()),
+				zap.Error(err))
+			w.token = nil
+			continue
+		}
+
+		w.logger().Warn("change stream error, reopening",
+			zap.String("watcher", w.name()),
+			zap.Duration("retry_wait", w.retryWait()),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.retryWait()):
+		}
+	}
+}
+
+func (w *Watcher) watch(ctx context.Context) error {
+	opts := options.ChangeStream()
+	if w.FullDocument {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+	if w.token != nil {
+		opts.SetResumeAfter(w.token)
+	}
+
+	pipeline := w.Pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+
+	stream, err := w.Collection.Watch(WithoutTenant(ctx), pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		event := &ChangeEvent{}
+		if err := stream.Decode(event); err != nil {
+			return err
+		}
+		event.Database, event.Collection = event.NS.DB, event.NS.Coll
+
+		if err := w.handle(ctx, event); err != nil {
+			return err
+		}
+		if err := w.saveToken(ctx, stream.ResumeToken()); err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
+
+func (w *Watcher) handle(ctx context.Context, event *ChangeEvent) error {
+	if w.Handler != nil {
+		if err := w.Handler(ctx, event); err != nil {
+			return err
+		}
+	}
+	if w.Publisher != nil {
+		if err := w.Publisher.Publish(w.subject(event.OperationType), event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) loadToken(ctx context.Context) error {
+	var stored struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := w.tokens().FindOne(ctx, bson.M{"_id": w.name()}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.token = stored.Token
+	return nil
+}
+
+func (w *Watcher) saveToken(ctx context.Context, token bson.Raw) error {
+	w.token = append(bson.Raw{}, token...)
+	_, err := w.tokens().UpdateOne(ctx,
+		bson.M{"_id": w.name()},
+		bson.M{"$set": bson.M{"token": w.token, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true))
+	return err
+}
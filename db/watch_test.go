@@ -0,0 +1,60 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestWatcherSubject(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	w := NewWatcher(Col(client.Database("testing"), "users"), nil, nil)
+
+	if subject := w.subject("insert"); subject != "db.changes.users.insert" {
+		t.Errorf("Unexpected subject: %+v, expected %+v", subject, "db.changes.users.insert")
+	}
+	w.Subject = "events.users."
+	if subject := w.subject("delete"); subject != "events.users.delete" {
+		t.Errorf("Unexpected subject: %+v, expected %+v", subject, "events.users.delete")
+	}
+	if name := w.name(); name != "users" {
+		t.Errorf("Unexpected name: %+v, expected %+v", name, "users")
+	}
+}
+
+func TestChangeEventDecode(t *testing.T) {
+	raw, _ := bson.Marshal(bson.M{
+		"operationType": "update",
+		"ns":            bson.M{"db": "testing", "coll": "users"},
+		"documentKey":   bson.M{"_id": "u1"},
+		"fullDocument":  bson.M{"_id": "u1", "name": "test"},
+		"updateDescription": bson.M{
+			"updatedFields": bson.M{"name": "test"},
+			"removedFields": bson.A{"nick"},
+		},
+	})
+
+	event := &ChangeEvent{}
+	if err := bson.Unmarshal(raw, event); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if event.NS.Coll != "users" || event.UpdateDescription.RemovedFields[0] != "nick" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	var user struct {
+		ID   string `bson:"_id"`
+		Name string `bson:"name"`
+	}
+	if err := event.DecodeDocument(&user); err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if user.Name != "test" {
+		t.Errorf("Unexpected name: %+v, expected %+v", user.Name, "test")
+	}
+}
@@ -0,0 +1,343 @@
+package gnats
+
+import (
+	"crypto/tls"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// DefaultEnvPrefix is the prefix used by ConfigFromEnv when no prefix is given.
+const DefaultEnvPrefix = "NATS_"
+
+// Config contains configuration options that can be used when connecting to
+// nats using this package. Zero values keep the nats.go defaults.
+type Config struct {
+	Name string
+	Urls []string
+
+	// TLS enables a secure connection to the servers.
+	TLS *TLSConfig
+
+	// Authentication. Only one of CredentialsFile, NKeyFile, Token or
+	// User/Password may be set.
+	CredentialsFile string
+	NKeyFile        string
+	Token           string
+	User            string
+	Password        string
+
+	Timeout         time.Duration // dial timeout
+	PingInterval    time.Duration
+	MaxPingsOut     int
+	ReconnectWait   time.Duration
+	ReconnectJitter time.Duration
+	// ReconnectJitterTLS is the jitter used for TLS connections; it defaults
+	// to ReconnectJitter, or the nats.go default when neither is set.
+	ReconnectJitterTLS time.Duration
+	// MaxReconnects is the number of reconnect attempts, zero means reconnect
+	// forever. Use NoReconnect to disable reconnecting.
+	MaxReconnects    int
+	NoReconnect      bool
+	ReconnectBufSize int // bytes buffered while reconnecting
+	SyncQueueLen     int // pending messages of synchronous subscriptions
+	DrainTimeout     time.Duration
+	InboxPrefix      string
+}
+
+// TLSConfig contains the TLS options of a connection.
+type TLSConfig struct {
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// ConfigFromEnv builds a Config from environment variables, for example
+// NATS_URLS="nats://a:4222,nats://b:4222" or NATS_PING_INTERVAL="20s".
+// The prefix defaults to DefaultEnvPrefix.
+func ConfigFromEnv(prefix ...string) (*Config, error) {
+	p := DefaultEnvPrefix
+	if len(prefix) > 0 {
+		p = prefix[0]
+	}
+	env := envReader{prefix: p}
+
+	conf := &Config{
+		Name:               env.str("NAME"),
+		CredentialsFile:    env.str("CREDS"),
+		NKeyFile:           env.str("NKEY"),
+		Token:              env.str("TOKEN"),
+		User:               env.str("USER"),
+		Password:           env.str("PASSWORD"),
+		Timeout:            env.duration("TIMEOUT"),
+		PingInterval:       env.duration("PING_INTERVAL"),
+		MaxPingsOut:        env.int("MAX_PINGS_OUT"),
+		ReconnectWait:      env.duration("RECONNECT_WAIT"),
+		ReconnectJitter:    env.duration("RECONNECT_JITTER"),
+		ReconnectJitterTLS: env.duration("RECONNECT_JITTER_TLS"),
+		MaxReconnects:      env.int("MAX_RECONNECTS"),
+		NoReconnect:        env.bool("NO_RECONNECT"),
+		ReconnectBufSize:   env.int("RECONNECT_BUF_SIZE"),
+		SyncQueueLen:       env.int("SYNC_QUEUE_LEN"),
+		DrainTimeout:       env.duration("DRAIN_TIMEOUT"),
+		InboxPrefix:        env.str("INBOX_PREFIX"),
+	}
+
+	if urls := env.str("URLS"); len(urls) > 0 {
+		for _, url := range strings.Split(urls, ",") {
+			if url = strings.TrimSpace(url); len(url) > 0 {
+				conf.Urls = append(conf.Urls, url)
+			}
+		}
+	}
+
+	certFile, keyFile, caFile := env.str("TLS_CERT"), env.str("TLS_KEY"), env.str("TLS_CA")
+	insecure := env.bool("TLS_INSECURE")
+	if len(certFile) > 0 || len(keyFile) > 0 || len(caFile) > 0 || insecure || env.bool("TLS") {
+		conf.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, InsecureSkipVerify: insecure}
+	}
+
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	return conf, nil
+}
+
+// Validate checks the config for invalid or conflicting options.
+func (conf *Config) Validate() error {
+	if conf == nil {
+		return errors.New("gnats: config is nil")
+	}
+	if len(conf.Urls) == 0 {
+		return errors.New("gnats: at least one url is required")
+	}
+	for _, url := range conf.Urls {
+		if len(strings.TrimSpace(url)) == 0 {
+			return errors.New("gnats: empty url")
+		}
+	}
+
+	auths := 0
+	for _, set := range []bool{
+		len(conf.CredentialsFile) > 0,
+		len(conf.NKeyFile) > 0,
+		len(conf.Token) > 0,
+		len(conf.User) > 0 || len(conf.Password) > 0,
+	} {
+		if set {
+			auths++
+		}
+	}
+	if auths > 1 {
+		return errors.New("gnats: only one of credentials file, nkey file, token or user/password may be set")
+	}
+	if len(conf.Password) > 0 && len(conf.User) == 0 {
+		return errors.New("gnats: password requires a user")
+	}
+	if err := fileExists("credentials file", conf.CredentialsFile); err != nil {
+		return err
+	}
+	if err := fileExists("nkey file", conf.NKeyFile); err != nil {
+		return err
+	}
+
+	if conf.TLS != nil {
+		if (len(conf.TLS.CertFile) > 0) != (len(conf.TLS.KeyFile) > 0) {
+			return errors.New("gnats: tls cert file and key file must be set together")
+		}
+		files := map[string]string{
+			"tls cert file": conf.TLS.CertFile,
+			"tls key file":  conf.TLS.KeyFile,
+			"tls ca file":   conf.TLS.CAFile,
+		}
+		for _, name := range sortedKeys(files) {
+			if err := fileExists(name, files[name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	durations := map[string]time.Duration{
+		"timeout":              conf.Timeout,
+		"ping interval":        conf.PingInterval,
+		"reconnect wait":       conf.ReconnectWait,
+		"reconnect jitter":     conf.ReconnectJitter,
+		"reconnect jitter tls": conf.ReconnectJitterTLS,
+		"drain timeout":        conf.DrainTimeout,
+	}
+	for _, name := range sortedKeys(durations) {
+		if durations[name] < 0 {
+			return errors.Errorf("gnats: %s must not be negative", name)
+		}
+	}
+	counts := map[string]int{
+		"max pings out":      conf.MaxPingsOut,
+		"max reconnects":     conf.MaxReconnects,
+		"reconnect buf size": conf.ReconnectBufSize,
+		"sync queue len":     conf.SyncQueueLen,
+	}
+	for _, name := range sortedKeys(counts) {
+		if counts[name] < 0 {
+			return errors.Errorf("gnats: %s must not be negative", name)
+		}
+	}
+
+	if conf.NoReconnect && conf.MaxReconnects > 0 {
+		return errors.New("gnats: max reconnects can not be used with no reconnect")
+	}
+	if strings.ContainsAny(conf.InboxPrefix, " *>") || strings.HasSuffix(conf.InboxPrefix, ".") {
+		return errors.Errorf("gnats: invalid inbox prefix %q", conf.InboxPrefix)
+	}
+
+	return nil
+}
+
+// options converts the config into nats.go connect options.
+func (conf *Config) options() ([]nats.Option, error) {
+	opts := []nats.Option{nats.Name(conf.Name)}
+
+	if conf.NoReconnect {
+		opts = append(opts, nats.NoReconnect())
+	} else if conf.MaxReconnects > 0 {
+		opts = append(opts, nats.MaxReconnects(conf.MaxReconnects))
+	} else {
+		opts = append(opts, nats.MaxReconnects(-1))
+	}
+
+	if conf.TLS != nil {
+		opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: conf.TLS.InsecureSkipVerify}))
+		if len(conf.TLS.CertFile) > 0 {
+			opts = append(opts, nats.ClientCert(conf.TLS.CertFile, conf.TLS.KeyFile))
+		}
+		if len(conf.TLS.CAFile) > 0 {
+			opts = append(opts, nats.RootCAs(conf.TLS.CAFile))
+		}
+	}
+
+	switch {
+	case len(conf.CredentialsFile) > 0:
+		opts = append(opts, nats.UserCredentials(conf.CredentialsFile))
+	case len(conf.NKeyFile) > 0:
+		opt, err := nats.NkeyOptionFromSeed(conf.NKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "gnats: nkey file")
+		}
+		opts = append(opts, opt)
+	case len(conf.Token) > 0:
+		opts = append(opts, nats.Token(conf.Token))
+	case len(conf.User) > 0:
+		opts = append(opts, nats.UserInfo(conf.User, conf.Password))
+	}
+
+	if conf.Timeout > 0 {
+		opts = append(opts, nats.Timeout(conf.Timeout))
+	}
+	if conf.PingInterval > 0 {
+		opts = append(opts, nats.PingInterval(conf.PingInterval))
+	}
+	if conf.MaxPingsOut > 0 {
+		opts = append(opts, nats.MaxPingsOutstanding(conf.MaxPingsOut))
+	}
+	if conf.ReconnectWait > 0 {
+		opts = append(opts, nats.ReconnectWait(conf.ReconnectWait))
+	}
+	if conf.ReconnectJitter > 0 || conf.ReconnectJitterTLS > 0 {
+		jitter, jitterTLS := conf.ReconnectJitter, conf.ReconnectJitterTLS
+		if jitter == 0 {
+			jitter = nats.DefaultReconnectJitter
+		}
+		if jitterTLS == 0 {
+			jitterTLS = conf.ReconnectJitter
+		}
+		if jitterTLS == 0 {
+			jitterTLS = nats.DefaultReconnectJitterTLS
+		}
+		opts = append(opts, nats.ReconnectJitter(jitter, jitterTLS))
+	}
+	if conf.ReconnectBufSize > 0 {
+		opts = append(opts, nats.ReconnectBufSize(conf.ReconnectBufSize))
+	}
+	if conf.SyncQueueLen > 0 {
+		opts = append(opts, nats.SyncQueueLen(conf.SyncQueueLen))
+	}
+	if conf.DrainTimeout > 0 {
+		opts = append(opts, nats.DrainTimeout(conf.DrainTimeout))
+	}
+	if len(conf.InboxPrefix) > 0 {
+		opts = append(opts, nats.CustomInboxPrefix(conf.InboxPrefix))
+	}
+
+	return opts, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fileExists(name string, path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return errors.Wrapf(err, "gnats: %s", name)
+	}
+	return nil
+}
+
+// envReader reads prefixed environment variables and keeps the first parse error.
+type envReader struct {
+	prefix string
+	err    error
+}
+
+func (e *envReader) str(key string) string {
+	return os.Getenv(e.prefix + key)
+}
+
+func (e *envReader) int(key string) int {
+	val := e.str(key)
+	if len(val) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil && e.err == nil {
+		e.err = errors.Wrapf(err, "gnats: invalid %s%s", e.prefix, key)
+	}
+	return n
+}
+
+func (e *envReader) bool(key string) bool {
+	val := e.str(key)
+	if len(val) == 0 {
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil && e.err == nil {
+		e.err = errors.Wrapf(err, "gnats: invalid %s%s", e.prefix, key)
+	}
+	return b
+}
+
+func (e *envReader) duration(key string) time.Duration {
+	val := e.str(key)
+	if len(val) == 0 {
+		return 0
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil && e.err == nil {
+		e.err = errors.Wrapf(err, "gnats: invalid %s%s", e.prefix, key)
+	}
+	return d
+}
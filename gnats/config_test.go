@@ -0,0 +1,109 @@
+package gnats
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  *Config
+		valid bool
+	}{
+		{"urls", &Config{Urls: []string{"nats://127.0.0.1:4222"}}, true},
+		{"no urls", &Config{}, false},
+		{"empty url", &Config{Urls: []string{" "}}, false},
+		{"token and user", &Config{Urls: []string{"nats://127.0.0.1:4222"}, Token: "t", User: "u"}, false},
+		{"password without user", &Config{Urls: []string{"nats://127.0.0.1:4222"}, Password: "p"}, false},
+		{"missing creds", &Config{Urls: []string{"nats://127.0.0.1:4222"}, CredentialsFile: "/nonexistent.creds"}, false},
+		{"cert without key", &Config{Urls: []string{"nats://127.0.0.1:4222"}, TLS: &TLSConfig{CertFile: "/nonexistent.pem"}}, false},
+		{"negative ping", &Config{Urls: []string{"nats://127.0.0.1:4222"}, PingInterval: -time.Second}, false},
+		{"no reconnect with max", &Config{Urls: []string{"nats://127.0.0.1:4222"}, NoReconnect: true, MaxReconnects: 3}, false},
+		{"wildcard inbox prefix", &Config{Urls: []string{"nats://127.0.0.1:4222"}, InboxPrefix: "_INBOX.*"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.conf.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %+v, expected nil", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: unexpected nil error", test.name)
+		}
+	}
+}
+
+func TestConfigValidateOrder(t *testing.T) {
+	conf := &Config{Urls: []string{"nats://127.0.0.1:4222"}, Timeout: -1, DrainTimeout: -1, PingInterval: -1}
+	for i := 0; i < 20; i++ {
+		if err := conf.Validate(); err == nil || err.Error() != "gnats: drain timeout must not be negative" {
+			t.Fatalf("Unexpected error: %+v, expected the drain timeout one", err)
+		}
+	}
+}
+
+func TestConfigJitter(t *testing.T) {
+	for _, test := range []struct {
+		conf      Config
+		jitter    time.Duration
+		jitterTLS time.Duration
+	}{
+		{Config{}, nats.DefaultReconnectJitter, nats.DefaultReconnectJitterTLS},
+		{Config{ReconnectJitterTLS: 5 * time.Second}, nats.DefaultReconnectJitter, 5 * time.Second},
+		{Config{ReconnectJitter: time.Second}, time.Second, time.Second},
+		{Config{ReconnectJitter: time.Second, ReconnectJitterTLS: 2 * time.Second}, time.Second, 2 * time.Second},
+	} {
+		opts, err := test.conf.options()
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+		o := nats.GetDefaultOptions()
+		for _, opt := range opts {
+			if err := opt(&o); err != nil {
+				t.Fatalf("Unexpected error: %+v, expected nil", err)
+			}
+		}
+		if o.ReconnectJitter != test.jitter || o.ReconnectJitterTLS != test.jitterTLS {
+			t.Errorf("Unexpected jitters of %+v: %+v, %+v, expected %+v, %+v",
+				test.conf, o.ReconnectJitter, o.ReconnectJitterTLS, test.jitter, test.jitterTLS)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	os.Setenv("TEST_NATS_URLS", "nats://a:4222, nats://b:4222")
+	os.Setenv("TEST_NATS_PING_INTERVAL", "20s")
+	os.Setenv("TEST_NATS_MAX_RECONNECTS", "5")
+	defer func() {
+		os.Unsetenv("TEST_NATS_URLS")
+		os.Unsetenv("TEST_NATS_PING_INTERVAL")
+		os.Unsetenv("TEST_NATS_MAX_RECONNECTS")
+	}()
+
+	conf, err := ConfigFromEnv("TEST_NATS_")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	if len(conf.Urls) != 2 || conf.Urls[1] != "nats://b:4222" {
+		t.Errorf("Unexpected urls: %+v", conf.Urls)
+	}
+	if conf.PingInterval != 20*time.Second {
+		t.Errorf("Unexpected ping interval: %+v, expected 20s", conf.PingInterval)
+	}
+	if conf.MaxReconnects != 5 {
+		t.Errorf("Unexpected max reconnects: %+v, expected 5", conf.MaxReconnects)
+	}
+	if conf.TLS != nil {
+		t.Errorf("Unexpected tls config: %+v, expected nil", conf.TLS)
+	}
+
+	os.Setenv("TEST_NATS_PING_INTERVAL", "often")
+	if _, err := ConfigFromEnv("TEST_NATS_"); err == nil {
+		t.Errorf("Unexpected nil error for invalid duration")
+	}
+}
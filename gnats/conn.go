@@ -0,0 +1,203 @@
+package gnats
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/logger"
+)
+
+// Conn is a gnatsd connection together with its OnActiveHandlers and event
+// handlers. Several Conn can be used in one process; the package level
+// functions use the Default one.
+type Conn struct {
+	// Logger is used for connection logs. When nil logger.Logger is used.
+	Logger *zap.Logger
+
+	connection lockedConnection
+	events     eventHandlers
+
+	handlersMu       sync.Mutex
+	onActiveHandlers map[string]OnActiveHandler
+}
+
+var defaultConn = New()
+
+// New returns a new, not yet connected Conn.
+func New() *Conn {
+	return &Conn{onActiveHandlers: map[string]OnActiveHandler{}}
+}
+
+// Default returns the Conn used by the package level functions.
+func Default() *Conn {
+	return defaultConn
+}
+
+// Log returns the logger of the connection, falling back to logger.Logger.
+func (c *Conn) Log() *zap.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logger.Logger
+}
+
+// IsConnected returns true if connection to gnatsd server is OK.
+func (c *Conn) IsConnected() bool {
+	conn := c.connection.getBare()
+	return conn != nil && conn.IsConnected()
+}
+
+// Bare returns the underlying nats connection, nil if not connected.
+func (c *Conn) Bare() *nats.Conn {
+	return c.connection.getBare()
+}
+
+// JSONConn returns the JSON encoded connection.
+func (c *Conn) JSONConn() (*nats.EncodedConn, error) {
+	if encodedConnection := c.connection.getEncoded(); encodedConnection != nil {
+		return encodedConnection, nil
+	}
+
+	encodedConnection, err := nats.NewEncodedConn(c.connection.getBare(), nats.JSON_ENCODER)
+	if err != nil {
+		return nil, err
+	}
+
+	c.connection.setEncoded(encodedConnection)
+
+	return encodedConnection, nil
+}
+
+// AddOnActiveHandler adds a function to run when connection to gnatsd server becomes active
+// (after connected or re-connected).
+func (c *Conn) AddOnActiveHandler(name string, onActiveHandler OnActiveHandler) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+
+	if _, ok := c.onActiveHandlers[name]; ok {
+		c.Log().Sugar().Fatalf("OnActiveHandler for '%s' has been registered", name)
+	}
+	c.onActiveHandlers[name] = onActiveHandler
+}
+
+// ClearOnActiveHandlers removes all onActiveHandlers
+func (c *Conn) ClearOnActiveHandlers() {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+
+	// set to initial condition (empty map)
+	c.onActiveHandlers = map[string]OnActiveHandler{}
+}
+
+// Connect takes a config object and creates a new nats connection. The config is
+// validated first and any invalid option is returned as an error.
+func (c *Conn) Connect(conf *Config) error {
+	log := c.Log()
+
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	opts, err := conf.options()
+	if err != nil {
+		return err
+	}
+
+	opts = append(opts,
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			log.Debug("nats connection lost", zap.Error(err))
+			c.events.onDisconnect(conn, err)
+		}),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			log.Sugar().Debugf("nats connection closed: %s", conn.LastError())
+			c.events.onClosed(conn)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Debug("nats connection re-established")
+			c.runOnActiveHandlers()
+			c.events.onReconnect(conn)
+		}),
+		nats.DiscoveredServersHandler(func(conn *nats.Conn) {
+			log.Sugar().Debugf("nats found new server at url %s", conn.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
+			subject := ""
+			if subscription != nil {
+				subject = subscription.Subject
+			}
+			log.Error("nats communication error",
+				zap.Error(err),
+				zap.String("subject", subject),
+				zap.String("url", conn.ConnectedUrl()),
+			)
+			c.events.onError(conn, subscription, err)
+		}),
+		nats.LameDuckModeHandler(func(conn *nats.Conn) {
+			log.Sugar().Warnf("nats server at url %s entered lame duck mode", conn.ConnectedUrl())
+			c.events.onLameDuck(conn)
+		}),
+	)
+
+	conn, err := nats.Connect(strings.Join(conf.Urls, ","), opts...)
+	if err != nil {
+		return errors.Wrap(err, "nats.Connect")
+	}
+
+	c.connection.setBare(conn)
+	c.connection.setEncoded(nil)
+
+	c.runOnActiveHandlers()
+
+	return nil
+}
+
+func (c *Conn) runOnActiveHandlers() {
+	c.handlersMu.Lock()
+	handlers := make(map[string]OnActiveHandler, len(c.onActiveHandlers))
+	for name, onActiveHandler := range c.onActiveHandlers {
+		handlers[name] = onActiveHandler
+	}
+	c.handlersMu.Unlock()
+
+	for name, onActiveHandler := range handlers {
+		if err := onActiveHandler(); err != nil {
+			c.Log().Error("Error running onActiveHandler",
+				zap.String("name", name),
+				zap.Error(err))
+		}
+	}
+}
+
+// SetConnection is a function that allows setting an already established
+// connection for use.
+func (c *Conn) SetConnection(conn *nats.Conn) error {
+	if conn == nil || !conn.IsConnected() {
+		return errors.New("Connection must already be established")
+	}
+
+	c.connection.setBare(conn)
+	c.connection.setEncoded(nil)
+
+	return nil
+}
+
+// Disconnect disconnects the current nats connection.
+func (c *Conn) Disconnect() {
+	c.Log().Warn("called disconnect")
+	if conn := c.connection.getBare(); conn != nil {
+		conn.Close()
+	}
+	c.UnsetConnection()
+}
+
+// UnsetConnection clears the connection without disconnecting. This is meant
+// for use with SetConnection. It's here so if you need to run teardown logic
+// on your connection you can do so without this package interfering.
+func (c *Conn) UnsetConnection() {
+	c.connection.setBare(nil)
+	c.connection.setEncoded(nil)
+}
@@ -2,155 +2,74 @@
 package gnats
 
 import (
-	"go.uber.org/zap"
-	"strings"
+	"os"
 
 	"github.com/nats-io/nats.go"
-
-	"github.com/pkg/errors"
-	"github.com/vavas/go_services/logger"
 )
 
-var connection = &lockedConnection{}
-var onActiveHandlers = map[string]OnActiveHandler{}
-
 // OnActiveHandler is a function that can passed to AddOnActiveHandler. When
-// A nats connection is established this function will be executed.
+// A nats connection is established or re-established this function will be
+// executed. nats.go keeps the subscriptions across reconnects, so the
+// handlers must not subscribe again while their subscription is valid.
 type OnActiveHandler func() error
 
-// Config contains configuration options that can be used when connecting to
-// nats using this package.
-type Config struct {
-	Name string
-	Urls []string
-}
-
 // IsConnected returns true if connection to gnatsd server is OK.
 func IsConnected() bool {
-	return connection.getBare().IsConnected()
+	return defaultConn.IsConnected()
 }
 
 // JSONConn returns the JSON encoded connection.
 func JSONConn() (*nats.EncodedConn, error) {
-	if encodedConnection := connection.getEncoded(); encodedConnection != nil {
-		return encodedConnection, nil
-	}
-
-	encodedConnection, err := nats.NewEncodedConn(connection.getBare(), nats.JSON_ENCODER)
-	if err != nil {
-		return nil, err
-	}
-
-	connection.setEncoded(encodedConnection)
-
-	return encodedConnection, nil
+	return defaultConn.JSONConn()
 }
 
 // AddOnActiveHandler adds a function to run when connection to gnatsd server becomes active
 // (after connected or re-connected).
 func AddOnActiveHandler(name string, onActiveHandler OnActiveHandler) {
-	if _, ok := onActiveHandlers[name]; ok {
-		logger.Logger.Sugar().Fatalf("OnActiveHandler for '%s' has been registered", name)
-	}
-	onActiveHandlers[name] = onActiveHandler
+	defaultConn.AddOnActiveHandler(name, onActiveHandler)
 }
 
 // ClearOnActiveHandlers removes all onActiveHandlers
 func ClearOnActiveHandlers() {
-	// set to initial condition (empty map)
-	onActiveHandlers = map[string]OnActiveHandler{}
+	defaultConn.ClearOnActiveHandlers()
 }
 
 // Connect takes a config object and creates a new nats connection, using it for all nats
-// communication required by this package.
+// communication required by this package. The config is validated first and any invalid
+// option is returned as an error.
 func Connect(conf *Config) error {
-	log := logger.Logger
-
-	opts := nats.GetDefaultOptions()
-	opts.Servers = conf.Urls
-
-	conn, err := nats.Connect(
-		strings.Join(conf.Urls, ","),
-		nats.Name(conf.Name),
-		nats.MaxReconnects(-1),
-		// TODO: define these handlers outside of Connect
-		// How to insert handlers
-		// nc, err = nats.Connect(servers,
-		// 	nats.DisconnectHandler(func(_ *nats.Conn) {
-		// 		fmt.Printf("Got disconnected!\n")
-		// 	}),
-		// 	nats.ReconnectHandler(func(nc *nats.Conn) {
-		// 		fmt.Printf("Got reconnected to %v!\n", nc.ConnectedUrl())
-		// 	}),
-		// nats.ClosedHandler(func(nc *nats.Conn) {
-		// fmt.Printf("Connection closed. Reason: %q\n", nc.LastError())
-		// })
-		// )
-		nats.ClosedHandler(func(conn *nats.Conn) {
-			log.Sugar().Debugf("nats connection closed: %s", conn.LastError())
-		}),
-		nats.ReconnectHandler(func(_ *nats.Conn) {
-			log.Debug("nats connection re-established")
-		}),
-		nats.DiscoveredServersHandler(func(conn *nats.Conn) {
-			log.Sugar().Debugf("nats found new server at url %s", conn.ConnectedUrl())
-		}),
-		nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
-			log.Sugar().Errorf(
-				"nats communication error on subject %s: with server at %s",
-				subscription.Subject,
-				conn.ConnectedUrl(),
-			)
-		}),
-	)
-	if err != nil {
-		return errors.Wrap(err, "nats.Connect")
-	}
-
-	for name, onActiveHandler := range onActiveHandlers {
-		if err := onActiveHandler(); err != nil {
-			log.Sugar().Errorf("Error running onActiveHandler '%s'", name,
-				zap.Error(err))
-		}
-	}
-
-	connection.setBare(conn)
-
-	return nil
+	return defaultConn.Connect(conf)
 }
 
 // TestConnect is a connect method used for testing purposes. Do not use this
-// method in production code.
-func TestConnect() {
-	conf := &Config{Urls: []string{"nats://127.0.0.1:4222"}}
-	_ = Connect(conf)
+// method in production code. It connects to NATS_URL, nats://127.0.0.1:4222 by
+// default; gnatstest.NewServer boots an embedded server instead.
+func TestConnect() error {
+	url := os.Getenv("NATS_URL")
+	if len(url) == 0 {
+		url = "nats://127.0.0.1:4222"
+	}
+
+	conf := &Config{Urls: []string{url}}
+	return Connect(conf)
 }
 
 // SetConnection is a function that allows setting an already established
 // connection for use.
 func SetConnection(conn *nats.Conn) error {
-	if !connection.getBare().IsConnected() {
-		return errors.New("Connection must already be established")
-	}
-
-	connection.setBare(conn)
-
-	return nil
+	return defaultConn.SetConnection(conn)
 }
 
 // Disconnect disconnects the current nats connection.
 func Disconnect() {
-	logger.Logger.Warn("called disconnect")
-	connection.getBare().Close()
-	UnsetConnection()
+	defaultConn.Disconnect()
 }
 
 // UnsetConnection clears the connection without disconnecting. This is meant
 // for use with SetConnection. It's here so if you need to run teardown logic
 // on your connection you can do so without this package interfering.
 func UnsetConnection() {
-	connection.setBare(nil)
-	connection.setEncoded(nil)
+	defaultConn.UnsetConnection()
 }
 
 // StartReconnectMonitor was used to start a reconnect loop for nats.
@@ -0,0 +1,301 @@
+package gnats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// DisconnectHandler is called when the connection to gnatsd server is lost.
+// err is nil if the disconnect was requested.
+type DisconnectHandler func(err error)
+
+// ReconnectHandler is called when the connection is re-established to the server at url.
+type ReconnectHandler func(url string)
+
+// ClosedHandler is called when the connection is closed and will not reconnect.
+type ClosedHandler func(err error)
+
+// ErrorHandler is called on asynchronous errors. subject is empty when the
+// error is not related to a subscription.
+type ErrorHandler func(subject string, err error)
+
+// LameDuckHandler is called when the connected server enters lame duck mode.
+type LameDuckHandler func(url string)
+
+// handlerList is a list of event handlers in registration order.
+type handlerList[H any] []handlerEntry[H]
+
+type handlerEntry[H any] struct {
+	id      int
+	handler H
+}
+
+func (l handlerList[H]) remove(id int) handlerList[H] {
+	for i, e := range l {
+		if e.id == id {
+			return append(l[:i:i], l[i+1:]...)
+		}
+	}
+	return l
+}
+
+func (l handlerList[H]) list() []H {
+	list := make([]H, 0, len(l))
+	for _, e := range l {
+		list = append(list, e.handler)
+	}
+	return list
+}
+
+// eventHandlers holds the subscribers of connection events. The handlers of
+// an event run in the order they were added.
+type eventHandlers struct {
+	sync.RWMutex
+	nextID       int
+	disconnect   handlerList[DisconnectHandler]
+	reconnect    handlerList[ReconnectHandler]
+	closed       handlerList[ClosedHandler]
+	err          handlerList[ErrorHandler]
+	slowConsumer handlerList[ErrorHandler]
+	lameDuck     handlerList[LameDuckHandler]
+}
+
+// add registers a handler through set and returns a function that removes it.
+func (e *eventHandlers) add(set func(id int), remove func(id int)) func() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.nextID++
+	id := e.nextID
+	set(id)
+
+	return func() {
+		e.Lock()
+		defer e.Unlock()
+		remove(id)
+	}
+}
+
+// OnDisconnect adds a handler to run when the connection is lost. The returned
+// function removes the handler.
+func (c *Conn) OnDisconnect(handler DisconnectHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.disconnect = append(e.disconnect, handlerEntry[DisconnectHandler]{id, handler})
+	}, func(id int) {
+		e.disconnect = e.disconnect.remove(id)
+	})
+}
+
+// OnReconnect adds a handler to run when the connection is re-established.
+// The returned function removes the handler.
+func (c *Conn) OnReconnect(handler ReconnectHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.reconnect = append(e.reconnect, handlerEntry[ReconnectHandler]{id, handler})
+	}, func(id int) {
+		e.reconnect = e.reconnect.remove(id)
+	})
+}
+
+// OnClosed adds a handler to run when the connection is closed for good.
+// The returned function removes the handler.
+func (c *Conn) OnClosed(handler ClosedHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.closed = append(e.closed, handlerEntry[ClosedHandler]{id, handler})
+	}, func(id int) {
+		e.closed = e.closed.remove(id)
+	})
+}
+
+// OnError adds a handler to run on asynchronous errors other than slow
+// consumers. The returned function removes the handler.
+func (c *Conn) OnError(handler ErrorHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.err = append(e.err, handlerEntry[ErrorHandler]{id, handler})
+	}, func(id int) {
+		e.err = e.err.remove(id)
+	})
+}
+
+// OnSlowConsumer adds a handler to run when a subscription drops messages
+// because it can not keep up. The returned function removes the handler.
+func (c *Conn) OnSlowConsumer(handler ErrorHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.slowConsumer = append(e.slowConsumer, handlerEntry[ErrorHandler]{id, handler})
+	}, func(id int) {
+		e.slowConsumer = e.slowConsumer.remove(id)
+	})
+}
+
+// OnLameDuck adds a handler to run when the server is about to shut down.
+// The returned function removes the handler.
+func (c *Conn) OnLameDuck(handler LameDuckHandler) (remove func()) {
+	e := &c.events
+	return e.add(func(id int) {
+		e.lameDuck = append(e.lameDuck, handlerEntry[LameDuckHandler]{id, handler})
+	}, func(id int) {
+		e.lameDuck = e.lameDuck.remove(id)
+	})
+}
+
+// ClearEventHandlers removes all connection event handlers.
+func (c *Conn) ClearEventHandlers() {
+	e := &c.events
+	e.Lock()
+	defer e.Unlock()
+
+	e.disconnect = nil
+	e.reconnect = nil
+	e.closed = nil
+	e.err = nil
+	e.slowConsumer = nil
+	e.lameDuck = nil
+}
+
+// OnDisconnect adds a handler to the default connection, see Conn.OnDisconnect.
+func OnDisconnect(handler DisconnectHandler) (remove func()) {
+	return defaultConn.OnDisconnect(handler)
+}
+
+// OnReconnect adds a handler to the default connection, see Conn.OnReconnect.
+func OnReconnect(handler ReconnectHandler) (remove func()) {
+	return defaultConn.OnReconnect(handler)
+}
+
+// OnClosed adds a handler to the default connection, see Conn.OnClosed.
+func OnClosed(handler ClosedHandler) (remove func()) {
+	return defaultConn.OnClosed(handler)
+}
+
+// OnError adds a handler to the default connection, see Conn.OnError.
+func OnError(handler ErrorHandler) (remove func()) {
+	return defaultConn.OnError(handler)
+}
+
+// OnSlowConsumer adds a handler to the default connection, see Conn.OnSlowConsumer.
+func OnSlowConsumer(handler ErrorHandler) (remove func()) {
+	return defaultConn.OnSlowConsumer(handler)
+}
+
+// OnLameDuck adds a handler to the default connection, see Conn.OnLameDuck.
+func OnLameDuck(handler LameDuckHandler) (remove func()) {
+	return defaultConn.OnLameDuck(handler)
+}
+
+// ClearEventHandlers removes all event handlers of the default connection.
+func ClearEventHandlers() {
+	defaultConn.ClearEventHandlers()
+}
+
+func (e *eventHandlers) onDisconnect(_ *nats.Conn, err error) {
+	e.RLock()
+	handlers := e.disconnect.list()
+	e.RUnlock()
+
+	for _, h := range handlers {
+		h(err)
+	}
+}
+
+func (e *eventHandlers) onReconnect(conn *nats.Conn) {
+	e.RLock()
+	handlers := e.reconnect.list()
+	e.RUnlock()
+
+	for _, h := range handlers {
+		h(conn.ConnectedUrlRedacted())
+	}
+}
+
+func (e *eventHandlers) onClosed(conn *nats.Conn) {
+	e.RLock()
+	handlers := e.closed.list()
+	e.RUnlock()
+
+	for _, h := range handlers {
+		h(conn.LastError())
+	}
+}
+
+func (e *eventHandlers) onError(_ *nats.Conn, subscription *nats.Subscription, err error) {
+	subject := ""
+	if subscription != nil {
+		subject = subscription.Subject
+	}
+
+	e.RLock()
+	source := e.err
+	if errors.Is(err, nats.ErrSlowConsumer) {
+		source = e.slowConsumer
+	}
+	handlers := source.list()
+	e.RUnlock()
+
+	for _, h := range handlers {
+		h(subject, err)
+	}
+}
+
+func (e *eventHandlers) onLameDuck(conn *nats.Conn) {
+	e.RLock()
+	handlers := e.lameDuck.list()
+	e.RUnlock()
+
+	for _, h := range handlers {
+		h(conn.ConnectedUrlRedacted())
+	}
+}
+
+// ConnectionStatus is a snapshot of the gnatsd connection.
+type ConnectionStatus struct {
+	Status       string        `json:"status"`
+	ConnectedURL string        `json:"connected_url,omitempty"`
+	ServerID     string        `json:"server_id,omitempty"`
+	RTT          time.Duration `json:"rtt,omitempty"`
+	InMsgs       uint64        `json:"in_msgs"`
+	OutMsgs      uint64        `json:"out_msgs"`
+	InBytes      uint64        `json:"in_bytes"`
+	OutBytes     uint64        `json:"out_bytes"`
+	Reconnects   uint64        `json:"reconnects"`
+}
+
+// Status returns a snapshot of the default connection.
+func Status() *ConnectionStatus {
+	return defaultConn.Status()
+}
+
+// Status returns a snapshot of the current connection. RTT is only measured
+// while connected.
+func (c *Conn) Status() *ConnectionStatus {
+	conn := c.connection.getBare()
+	if conn == nil {
+		return &ConnectionStatus{Status: nats.DISCONNECTED.String()}
+	}
+
+	stats := conn.Stats()
+	status := &ConnectionStatus{
+		Status:       conn.Status().String(),
+		ConnectedURL: conn.ConnectedUrlRedacted(),
+		ServerID:     conn.ConnectedServerId(),
+		InMsgs:       stats.InMsgs,
+		OutMsgs:      stats.OutMsgs,
+		InBytes:      stats.InBytes,
+		OutBytes:     stats.OutBytes,
+		Reconnects:   stats.Reconnects,
+	}
+
+	if conn.IsConnected() {
+		if rtt, err := conn.RTT(); err == nil {
+			status.RTT = rtt
+		}
+	}
+
+	return status
+}
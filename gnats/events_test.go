@@ -0,0 +1,71 @@
+package gnats
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestEventHandlersOnError(t *testing.T) {
+	defer ClearEventHandlers()
+
+	var errs, slow []string
+	OnError(func(subject string, err error) {
+		errs = append(errs, subject)
+	})
+	removeSlow := OnSlowConsumer(func(subject string, err error) {
+		slow = append(slow, subject)
+	})
+
+	// A nil subscription must not panic.
+	defaultConn.events.onError(nil, nil, errors.New("boom"))
+	defaultConn.events.onError(nil, &nats.Subscription{Subject: "users.internal"}, nats.ErrSlowConsumer)
+
+	if len(errs) != 1 || errs[0] != "" {
+		t.Errorf("Unexpected error subjects: %+v", errs)
+	}
+	if len(slow) != 1 || slow[0] != "users.internal" {
+		t.Errorf("Unexpected slow consumer subjects: %+v", slow)
+	}
+
+	removeSlow()
+	defaultConn.events.onError(nil, nil, nats.ErrSlowConsumer)
+	if len(slow) != 1 {
+		t.Errorf("Unexpected slow consumer calls after remove: %+v", slow)
+	}
+}
+
+func TestStatusWithoutConnection(t *testing.T) {
+	status := Status()
+	if status.Status != nats.DISCONNECTED.String() {
+		t.Errorf("Unexpected status: %+v, expected %+v", status.Status, nats.DISCONNECTED.String())
+	}
+}
+
+func TestEventHandlersOrder(t *testing.T) {
+	defer ClearEventHandlers()
+
+	calls := []int{}
+	for i := 0; i < 5; i++ {
+		i := i
+		remove := OnDisconnect(func(err error) {
+			calls = append(calls, i)
+		})
+		if i == 2 {
+			remove()
+		}
+	}
+
+	defaultConn.events.onDisconnect(nil, nil)
+	expected := []int{0, 1, 3, 4}
+	if len(calls) != len(expected) {
+		t.Fatalf("Unexpected calls: %+v, expected %+v", calls, expected)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("Unexpected calls: %+v, expected %+v", calls, expected)
+			break
+		}
+	}
+}
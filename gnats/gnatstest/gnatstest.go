@@ -0,0 +1,136 @@
+// Package gnatstest boots an embedded nats-server for tests.
+package gnatstest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/vavas/go_services/gnats"
+)
+
+// ReadyTimeout is the time to wait for the server to accept connections.
+var ReadyTimeout = 10 * time.Second
+
+// Server is an embedded nats-server with a gnats connection to it.
+type Server struct {
+	*server.Server
+
+	// Conn is connected to the server, see Options.Conn.
+	Conn *gnats.Conn
+
+	opts *server.Options
+	t    testing.TB
+}
+
+// Options of NewServer.
+type Options struct {
+	// JetStream enables JetStream with storage in a temporary directory.
+	JetStream bool
+	// Conn is the gnats connection to connect, a new one when nil. Pass
+	// gnats.Default() to use the package level functions.
+	Conn *gnats.Conn
+	// Config is used to connect, Urls is set to the server url.
+	Config *gnats.Config
+}
+
+// NewServer starts a server on a random port and connects gnats to it. The
+// server is shut down and the connection closed when the test ends.
+func NewServer(t testing.TB, options ...Options) *Server {
+	t.Helper()
+
+	var o Options
+	if len(options) > 0 {
+		o = options[0]
+	}
+
+	opts := &server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	}
+	if o.JetStream {
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+	}
+
+	s := &Server{opts: opts, t: t}
+	s.start()
+
+	// keep the port, so a restarted server is found by the reconnect logic
+	opts.Port = s.Addr().(*net.TCPAddr).Port
+
+	s.Conn = o.Conn
+	if s.Conn == nil {
+		s.Conn = gnats.New()
+		s.Conn.Logger = zaptest.NewLogger(t)
+	}
+
+	conf := &gnats.Config{Name: t.Name()}
+	if o.Config != nil {
+		c := *o.Config
+		conf = &c
+	}
+	conf.Urls = []string{s.ClientURL()}
+	if conf.ReconnectWait == 0 {
+		conf.ReconnectWait = 50 * time.Millisecond
+	}
+
+	if err := s.Conn.Connect(conf); err != nil {
+		s.Shutdown()
+		t.Fatalf("gnatstest: connect: %+v", err)
+	}
+
+	t.Cleanup(func() {
+		s.Conn.Disconnect()
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+
+	return s
+}
+
+func (s *Server) start() {
+	s.t.Helper()
+
+	srv, err := server.NewServer(s.opts)
+	if err != nil {
+		s.t.Fatalf("gnatstest: new server: %+v", err)
+	}
+	s.Server = srv
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(ReadyTimeout) {
+		s.t.Fatalf("gnatstest: server not ready after %s", ReadyTimeout)
+	}
+}
+
+// Restart shuts the server down and starts it again on the same port. It
+// returns once the connection has reconnected.
+func (s *Server) Restart() {
+	s.t.Helper()
+
+	reconnected := make(chan struct{}, 1)
+	remove := s.Conn.OnReconnect(func(_ string) {
+		select {
+		case reconnected <- struct{}{}:
+		default:
+		}
+	})
+	defer remove()
+
+	s.Shutdown()
+	s.WaitForShutdown()
+	s.start()
+
+	select {
+	case <-reconnected:
+	case <-time.After(ReadyTimeout):
+		s.t.Fatalf("gnatstest: not reconnected after %s", ReadyTimeout)
+	}
+}
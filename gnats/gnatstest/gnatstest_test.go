@@ -0,0 +1,70 @@
+package gnatstest
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/services/intsrv"
+)
+
+func TestRestartKeepsSubscriptions(t *testing.T) {
+	a := app.New("users")
+	a.Logger = zaptest.NewLogger(t)
+	a.NATS.Logger = a.Logger
+
+	srv := NewServer(t, Options{Conn: a.NATS})
+
+	intsrv.QueueSubscribeApp(a, "users").AddHandler("Ping", func(_ *mongo.Database, _ *intsrv.Request) (*intsrv.Response, error) {
+		return &intsrv.Response{Body: "pong"}, nil
+	})
+
+	call := func() {
+		t.Helper()
+		resp := &intsrv.Response{}
+		if err := intsrv.NewClient(a).RequestReply(&intsrv.Request{Service: "users", Function: "Ping"}, resp); err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+		if resp.Body != "pong" {
+			t.Errorf("Unexpected body: %+v, expected pong", resp.Body)
+		}
+	}
+
+	active := make(chan struct{}, 2)
+	a.NATS.AddOnActiveHandler("test", func() error {
+		active <- struct{}{}
+		return nil
+	})
+
+	call()
+	subscriptions := srv.Conn.Bare().NumSubscriptions()
+	srv.Restart()
+	call()
+
+	if status := srv.Conn.Status(); status.Reconnects != 1 {
+		t.Errorf("Unexpected reconnects: %+v, expected 1", status.Reconnects)
+	}
+	// the OnActiveHandlers run again, without subscribing twice
+	select {
+	case <-active:
+	default:
+		t.Errorf("Unexpected OnActiveHandler not run after the reconnect")
+	}
+	if n := srv.Conn.Bare().NumSubscriptions(); n != subscriptions {
+		t.Errorf("Unexpected subscriptions: %+v, expected %+v", n, subscriptions)
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	srv := NewServer(t, Options{JetStream: true})
+
+	js, err := srv.Conn.Bare().JetStream()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+	if _, err := js.AccountInfo(); err != nil {
+		t.Errorf("Unexpected error: %+v, expected nil", err)
+	}
+}
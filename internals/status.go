@@ -6,25 +6,31 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 
-	"github.com/vavas/go_services/db"
-	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/app"
 	"github.com/vavas/go_services/services/intsrv"
+	"github.com/vavas/go_services/utils"
 )
 
 // SetupStatus adds "Status" internal service. It will return a json `"OK"`.
+// When called with the `details` argument set to true it returns the status
+// together with a snapshot of the nats connection.
 func SetupStatus(sub *intsrv.Subscription) {
-	sub.AddHandler("Status", status)
+	sub.AddHandler("Status", statusHandler(sub.App()))
 }
 
-func status(_ *mongo.Database, _ *intsrv.Request) (*intsrv.Response, error) {
-	log := logger.Logger
-	status := "OK"
+func statusHandler(a *app.App) intsrv.HandlerFunc {
+	return func(dbc *mongo.Database, req *intsrv.Request) (*intsrv.Response, error) {
+		return status(a, dbc, req)
+	}
+}
 
-	if db.HasClient() {
-		db := db.DB()
+func status(a *app.App, db *mongo.Database, req *intsrv.Request) (*intsrv.Response, error) {
+	log := a.Log()
+	status := "OK"
 
+	if db != nil {
 		result := primitive.M{}
-		if err := db.RunCommand(nil, primitive.D{{"isMaster", 1}}).Decode(&result); err != nil {
+		if err := db.RunCommand(nil, primitive.D{{Key: "isMaster", Value: 1}}).Decode(&result); err != nil {
 			log.Error("Status check reported DBDOWN",
 				zap.Error(err))
 			status = "DBDOWN"
@@ -43,5 +49,9 @@ func status(_ *mongo.Database, _ *intsrv.Request) (*intsrv.Response, error) {
 		log.Info("Status check reported OK")
 	}
 
+	if details, _ := req.Param("details").(bool); details {
+		return &intsrv.Response{Body: utils.M{"status": status, "nats": a.NATS.Status()}}, nil
+	}
+
 	return &intsrv.Response{Body: status}, nil
 }
@@ -10,10 +10,15 @@ var Logger *zap.Logger
 
 // Init global logger
 func InitLogging(serviceName string) {
+	Logger = New(serviceName)
+}
+
+// New returns a logger named after the service, without touching the global Logger.
+func New(serviceName string) *zap.Logger {
 	config := zap.NewDevelopmentConfig()
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	logger, _ := config.Build()
 
 	// Add service name
-	Logger = logger.Named("service:" + serviceName)
+	return logger.Named("service:" + serviceName)
 }
@@ -7,6 +7,8 @@ type Auth struct {
 	Admin      *Administrator `json:"administrator,omitempty"`
 	UserToken  *Token         `json:"user_token,omitempty"`
 	AdminToken *Token         `json:"admin_token,omitempty"`
+	// TenantID is the tenant of the authenticated user or admin.
+	TenantID string `json:"tenant_id,omitempty"`
 }
 
 // IsAdmin returns true if the request is using an account token or comes from a user with admin permission.
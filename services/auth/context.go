@@ -0,0 +1,19 @@
+package auth
+
+import "context"
+
+type authKey struct{}
+
+// NewContext returns a copy of ctx carrying the auth info.
+func NewContext(ctx context.Context, auth *Auth) context.Context {
+	return context.WithValue(ctx, authKey{}, auth)
+}
+
+// FromContext returns the auth info carried by ctx, nil if none.
+func FromContext(ctx context.Context) *Auth {
+	if ctx == nil {
+		return nil
+	}
+	auth, _ := ctx.Value(authKey{}).(*Auth)
+	return auth
+}
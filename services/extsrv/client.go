@@ -1,6 +1,7 @@
 package extsrv
 
 import (
+	"context"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
@@ -9,7 +10,8 @@ import (
 	"net/http"
 	"net/url"
 
-	"github.com/vavas/go_services/gnats"
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/db"
 	"github.com/vavas/go_services/logger"
 	"github.com/vavas/go_services/services/auth"
 	"github.com/vavas/go_services/services/internal"
@@ -32,6 +34,8 @@ type Request struct {
 	BodyMap map[string]interface{} `json:"-"` // Most of the time the body is a map, so it's made ready here
 
 	RawRequest json.RawMessage `json:"-"` // The raw []byte of the request
+
+	maxPayload int64 // max size of the reply, see MaxFileSize
 }
 
 // Response structure
@@ -41,19 +45,28 @@ type Response struct {
 	Body       interface{}       `json:"body,omitempty"`    // The response body
 }
 
+// Client makes requests to external services using the connections of an app.
+type Client struct {
+	app *app.App
+}
+
+// NewClient returns a client using the connections of the app.
+func NewClient(a *app.App) *Client {
+	return &Client{app: a}
+}
+
 // RequestReply makes a request and expects a reply from a service
 func RequestReply(req *Request, resp interface{}) error {
-	enc, err := gnats.JSONConn()
-
-	if err != nil {
-		return err
-	}
+	return NewClient(app.Default()).RequestReply(req, resp)
+}
 
-	enc.Flush()
+// RequestReply makes a request and expects a reply from a service
+func (c *Client) RequestReply(req *Request, resp interface{}) error {
+	c.app.Transport.Flush()
 
 	// Services like billing service can be slow because it depends on 3rd party server (Stripe server)
-	if err := enc.Request(req.subject(), req, resp, internal.DefaultTimeout); err != nil {
-		logger.Logger.Info("ext.RequestReply() > enc.Request() error",
+	if err := c.app.Transport.Request(req.subject(), req, resp, internal.DefaultTimeout); err != nil {
+		c.app.Log().Info("ext.RequestReply() > Transport.Request() error",
 			zap.Error(err),
 			zap.String("request_id", req.RequestID),
 			zap.String("request_ip", req.RequestIP),
@@ -93,6 +106,51 @@ func (req *Request) ParamObjectID(key string) (primitive.ObjectID, error) {
 	return id, nil
 }
 
+// TenantHeader is the request header read by the default TenantFunc when the
+// auth info has no tenant. It is not read when empty, the default: any client
+// can send a header, so only set it when a trusted gateway sets it and drops
+// the one of the clients.
+var TenantHeader = ""
+
+// TenantFunc returns the tenant of a request, used by Request.Context for the
+// tenant scoped collections. nil means the request has no tenant and the
+// queries of these collections return db.ErrNoTenant. The default one returns
+// the tenant of the auth info, or the TenantHeader one.
+var TenantFunc = func(req *Request) interface{} {
+	if req.Auth != nil && len(req.Auth.TenantID) > 0 {
+		return req.Auth.TenantID
+	}
+	if len(TenantHeader) == 0 {
+		return nil
+	}
+	if tenant := req.HeaderValue(TenantHeader); len(tenant) > 0 {
+		return tenant
+	}
+	return nil
+}
+
+// Context returns a context carrying the request id, the tenant and the auth
+// info of the request. The user and admin of the auth info are the db.Actor
+// of the writes made with it.
+func (req *Request) Context() context.Context {
+	ctx := logger.WithRequestID(context.Background(), req.RequestID)
+	if tenant := TenantFunc(req); tenant != nil {
+		ctx = db.WithTenant(ctx, tenant)
+	}
+	if req.Auth == nil {
+		return ctx
+	}
+
+	actor := db.Actor{}
+	if req.Auth.User != nil && len(req.Auth.User.ID) > 0 {
+		actor.UserID = req.Auth.User.ID.Hex()
+	}
+	if req.Auth.Admin != nil && len(req.Auth.Admin.ID) > 0 {
+		actor.AdminID = req.Auth.Admin.ID.Hex()
+	}
+	ctx = db.WithActor(ctx, actor)
+	return auth.NewContext(ctx, req.Auth)
+}
 
 // SetAuth set json encoded auth data to the request.
 func (req *Request) SetAuth(authData *auth.Auth) (err error) {
@@ -0,0 +1,57 @@
+package extsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/vavas/go_services/db"
+	"github.com/vavas/go_services/services/auth"
+)
+
+type tenantDoc struct {
+	Name     string `bson:"name"`
+	TenantID string `bson:"tenant_id"`
+}
+
+func TestRequestTenant(t *testing.T) {
+	m := db.NewMemory()
+	col := m.Col("docs").WithTenantScope()
+	for _, tenant := range []string{"t1", "t2"} {
+		ctx := db.WithTenant(context.Background(), tenant)
+		if _, err := col.InsertContext(ctx, &tenantDoc{Name: "doc of " + tenant, TenantID: tenant}); err != nil {
+			t.Fatalf("Unexpected error: %+v, expected nil", err)
+		}
+	}
+	names := func(req *Request) ([]string, error) {
+		docs := []tenantDoc{}
+		if err := col.AllContext(req.Context(), nil, nil, &docs); err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, doc := range docs {
+			names = append(names, doc.Name)
+		}
+		return names, nil
+	}
+	forged := http.Header{"X-Tenant-Id": []string{"t2"}}
+
+	// the tenant of the auth info is used, not the one of a forged header
+	req := &Request{Header: forged, Auth: &auth.Auth{TenantID: "t1"}}
+	if got, err := names(req); err != nil || len(got) != 1 || got[0] != "doc of t1" {
+		t.Errorf("Unexpected documents: %+v (%+v), expected %+v", got, err, []string{"doc of t1"})
+	}
+
+	req = &Request{Header: forged}
+	if got, err := names(req); !errors.Is(err, db.ErrNoTenant) {
+		t.Errorf("Unexpected documents: %+v (%+v), expected %+v", got, err, db.ErrNoTenant)
+	}
+
+	// the header of a trusted gateway
+	TenantHeader = "X-Tenant-ID"
+	defer func() { TenantHeader = "" }()
+	if got, err := names(req); err != nil || len(got) != 1 || got[0] != "doc of t2" {
+		t.Errorf("Unexpected documents: %+v (%+v), expected %+v", got, err, []string{"doc of t2"})
+	}
+}
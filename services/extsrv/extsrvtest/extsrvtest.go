@@ -0,0 +1,241 @@
+// Package extsrvtest provides utilities for testing external service handlers.
+// Requests go through the real Subscription routing, auth check and body
+// parsing over an in-memory transport, so no gnatsd server is needed.
+package extsrvtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/services/auth"
+	"github.com/vavas/go_services/services/extsrv"
+	"github.com/vavas/go_services/services/internal/golden"
+	"github.com/vavas/go_services/transport"
+)
+
+// Server is an external service running on an in-memory transport.
+type Server struct {
+	*extsrv.Subscription
+
+	App *app.App
+	Bus *transport.Memory
+
+	t testing.TB
+}
+
+// NewServer subscribes service on a new in-memory transport. Handlers are
+// added to the returned server like to any Subscription. The transport is
+// closed when the test ends.
+func NewServer(t testing.TB, service string) *Server {
+	t.Helper()
+
+	if logger.Logger == nil {
+		// utils.NotifyError logs through the global logger.
+		logger.Logger = zap.NewNop()
+	}
+
+	bus := transport.NewMemory()
+	t.Cleanup(bus.Close)
+
+	a := app.NewWithTransport(service, bus)
+	a.Logger = zaptest.NewLogger(t)
+
+	return &Server{
+		Subscription: extsrv.QueueSubscribeApp(a, service),
+		App:          a,
+		Bus:          bus,
+		t:            t,
+	}
+}
+
+// Do sends the request built by rb to the server and records the response.
+func (s *Server) Do(rb *RequestBuilder) *Recorder {
+	s.t.Helper()
+
+	req := rb.Request()
+	req.Service = s.Service
+
+	raw := &rawResponse{}
+	if err := extsrv.NewClient(s.App).RequestReply(req, raw); err != nil {
+		s.t.Fatalf("extsrvtest: %s %s: %+v", req.Method, req.Path, err)
+	}
+
+	return &Recorder{
+		StatusCode: raw.StatusCode,
+		Headers:    raw.Headers,
+		Body:       raw.Body,
+		t:          s.t,
+	}
+}
+
+// RequestBuilder builds an extsrv.Request.
+type RequestBuilder struct {
+	req  *extsrv.Request
+	auth *auth.Auth
+}
+
+// NewRequest starts building a request.
+func NewRequest(method string, path string) *RequestBuilder {
+	return &RequestBuilder{req: &extsrv.Request{
+		RequestID: primitive.NewObjectID().Hex(),
+		RequestIP: "127.0.0.1",
+		Method:    method,
+		Path:      path,
+		Query:     url.Values{},
+		Header:    http.Header{},
+	}}
+}
+
+// Get starts building a GET request.
+func Get(path string) *RequestBuilder { return NewRequest(http.MethodGet, path) }
+
+// Post starts building a POST request.
+func Post(path string) *RequestBuilder { return NewRequest(http.MethodPost, path) }
+
+// Put starts building a PUT request.
+func Put(path string) *RequestBuilder { return NewRequest(http.MethodPut, path) }
+
+// Patch starts building a PATCH request.
+func Patch(path string) *RequestBuilder { return NewRequest(http.MethodPatch, path) }
+
+// Delete starts building a DELETE request.
+func Delete(path string) *RequestBuilder { return NewRequest(http.MethodDelete, path) }
+
+// Body sets the request body. It is sent as JSON, so a struct arrives as
+// the map the real gateway would send.
+func (rb *RequestBuilder) Body(body interface{}) *RequestBuilder {
+	rb.req.Body = body
+	return rb
+}
+
+// Query adds a query string value.
+func (rb *RequestBuilder) Query(key string, value string) *RequestBuilder {
+	rb.req.Query.Add(key, value)
+	return rb
+}
+
+// Header adds a header value.
+func (rb *RequestBuilder) Header(key string, value string) *RequestBuilder {
+	rb.req.Header.Add(key, value)
+	return rb
+}
+
+// Auth sets the auth data of the request.
+func (rb *RequestBuilder) Auth(authData *auth.Auth) *RequestBuilder {
+	rb.auth = authData
+	return rb
+}
+
+// Request returns the built request.
+func (rb *RequestBuilder) Request() *extsrv.Request {
+	if rb.auth != nil {
+		if err := rb.req.SetAuth(rb.auth); err != nil {
+			panic(err)
+		}
+	}
+	return rb.req
+}
+
+// UserAuth returns the auth data of a regular user.
+func UserAuth() *auth.Auth {
+	return &auth.Auth{
+		PlainToken: "user-token",
+		User: &auth.User{
+			ID:        bson.NewObjectId(),
+			Email:     "user@example.com",
+			FirstName: "Test",
+			LastName:  "User",
+		},
+		UserToken: &auth.Token{ID: primitive.NewObjectID(), Scope: []string{"user"}},
+	}
+}
+
+// SiteAdminAuth returns the auth data of a site admin, Auth.IsAdmin is true.
+func SiteAdminAuth() *auth.Auth {
+	authData := UserAuth()
+	authData.PlainToken = "site-admin-token"
+	authData.User.IsSiteAdmin = true
+	authData.UserToken.Scope = []string{"site_admin"}
+	return authData
+}
+
+type rawResponse struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+}
+
+// Recorder holds the response of a request.
+type Recorder struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       json.RawMessage
+
+	t testing.TB
+}
+
+// AssertStatus fails the test if the status code is not status.
+func (r *Recorder) AssertStatus(status int) *Recorder {
+	r.t.Helper()
+	if r.StatusCode != status {
+		r.t.Errorf("Unexpected status: %+v, expected %+v, body: %s", r.StatusCode, status, r.Body)
+	}
+	return r
+}
+
+// AssertHeader fails the test if the header key is not value.
+func (r *Recorder) AssertHeader(key string, value string) *Recorder {
+	r.t.Helper()
+	if r.Headers[key] != value {
+		r.t.Errorf("Unexpected header %s: %+v, expected %+v", key, r.Headers[key], value)
+	}
+	return r
+}
+
+// AssertBodyMatches fails the test if the body does not match the regular expression.
+func (r *Recorder) AssertBodyMatches(pattern string) *Recorder {
+	r.t.Helper()
+	if !regexp.MustCompile(pattern).Match(r.Body) {
+		r.t.Errorf("Unexpected body: %s, expected to match %s", r.Body, pattern)
+	}
+	return r
+}
+
+// Decode decodes the body into v.
+func (r *Recorder) Decode(v interface{}) *Recorder {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.t.Fatalf("extsrvtest: can not decode body %s: %+v", r.Body, err)
+	}
+	return r
+}
+
+// AssertGolden compares the status, headers and body with testdata/<name>.golden.
+// Run the tests with -update-golden to write the file.
+func (r *Recorder) AssertGolden(name string) *Recorder {
+	r.t.Helper()
+	golden.AssertJSON(r.t, name, r.snapshot())
+	return r
+}
+
+func (r *Recorder) snapshot() interface{} {
+	var body interface{}
+	if len(r.Body) > 0 {
+		_ = json.Unmarshal(r.Body, &body)
+	}
+	return map[string]interface{}{
+		"status_code": r.StatusCode,
+		"headers":     r.Headers,
+		"body":        body,
+	}
+}
@@ -0,0 +1,83 @@
+package extsrvtest
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/vavas/go_services/db"
+	"github.com/vavas/go_services/services/extsrv"
+)
+
+func newUserServer(t *testing.T) *Server {
+	srv := NewServer(t, "users")
+
+	srv.AddHandler(http.MethodGet, regexp.MustCompile(`^/users/(?P<id>\w+)$`), func(_ *mongo.Database, req *extsrv.Request) *extsrv.Response {
+		return extsrv.Success(map[string]interface{}{"id": req.Param("id"), "admin": req.Auth.IsAdmin()})
+	})
+	srv.AddPublicHandler(http.MethodPost, regexp.MustCompile(`^/users$`), func(_ *mongo.Database, req *extsrv.Request) *extsrv.Response {
+		resp := extsrv.Created(req.BodyMap)
+		resp.Headers = map[string]string{"Location": "/users/1"}
+		return resp
+	})
+
+	return srv
+}
+
+func TestServerRouting(t *testing.T) {
+	srv := newUserServer(t)
+
+	var body struct {
+		ID    string `json:"id"`
+		Admin bool   `json:"admin"`
+	}
+	srv.Do(Get("/users/42").Auth(SiteAdminAuth())).
+		AssertStatus(http.StatusOK).
+		Decode(&body)
+
+	if body.ID != "42" || !body.Admin {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+
+	srv.Do(Get("/users/42")).AssertStatus(http.StatusUnauthorized)
+	srv.Do(Get("/accounts/42").Auth(UserAuth())).AssertStatus(http.StatusNotFound)
+	srv.Do(Post("/users").Body([]string{"not", "a", "map"})).AssertStatus(http.StatusBadRequest)
+}
+
+func TestServerGolden(t *testing.T) {
+	srv := newUserServer(t)
+
+	srv.Do(Post("/users").Body(map[string]interface{}{"email": "user@example.com"})).
+		AssertStatus(http.StatusCreated).
+		AssertHeader("Location", "/users/1").
+		AssertGolden("create_user")
+}
+
+func TestServerIfMatch(t *testing.T) {
+	srv := NewServer(t, "users")
+
+	var current int64 = 3
+	srv.AddPublicHandler(http.MethodPut, regexp.MustCompile(`^/users/(?P<id>\w+)$`), func(_ *mongo.Database, req *extsrv.Request) *extsrv.Response {
+		version, ok, err := req.IfMatch()
+		if err != nil {
+			return extsrv.BadRequest(err)
+		}
+		if !ok {
+			return extsrv.PreconditionRequired()
+		}
+		if version != current {
+			return extsrv.RespError(db.ErrConflict)
+		}
+		current++
+		return extsrv.NoContent().WithETag(current)
+	})
+
+	srv.Do(Put("/users/1")).AssertStatus(http.StatusPreconditionRequired)
+	srv.Do(Put("/users/1").Header("If-Match", "nope")).AssertStatus(http.StatusBadRequest)
+	srv.Do(Put("/users/1").Header("If-Match", extsrv.ETag(2))).AssertStatus(http.StatusPreconditionFailed)
+	srv.Do(Put("/users/1").Header("If-Match", extsrv.ETag(3))).
+		AssertStatus(http.StatusNoContent).
+		AssertHeader("ETag", `"4"`)
+}
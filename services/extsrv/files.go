@@ -0,0 +1,145 @@
+package extsrv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vavas/go_services/db/files"
+	"github.com/vavas/go_services/utils"
+)
+
+// DefaultMaxPayload is the max size of the replies of the requests not
+// received over a NATS connection, the NATS server default.
+const DefaultMaxPayload = 1 << 20
+
+// replyOverhead is the room of the replies left for the status and headers.
+const replyOverhead = 4 << 10
+
+// MaxFileSize returns the max size of the file content a response to the
+// request can hold: the content is base64 encoded in the reply, which can't
+// exceed the max payload of the NATS connection.
+func (req *Request) MaxFileSize() int64 {
+	payload := req.maxPayload
+	if payload <= 0 {
+		payload = DefaultMaxPayload
+	}
+	return (payload - replyOverhead) / 4 * 3
+}
+
+// File response with the content of a stored file, sent as an attachment
+// or inline. The body is the content, so it is base64 encoded in the JSON of
+// the response, see Request.MaxFileSize.
+func File(file *files.File, content []byte, attachment bool) *Response {
+	return &Response{StatusCode: http.StatusOK, Headers: fileHeaders(file, len(content), attachment), Body: content}
+}
+
+// ServeFile responds with the file with id of bucket, or the part of it
+// asked by the Range header of the request. The responses are sent in a
+// single NATS message, so a file or range larger than req.MaxFileSize is
+// refused with 413 Request Entity Too Large and must be read in ranges.
+func ServeFile(req *Request, bucket *files.Bucket, id interface{}, attachment bool) *Response {
+	ctx := req.Context()
+
+	file, err := bucket.Find(ctx, id)
+	if errors.Is(err, files.ErrNotFound) {
+		return NotFound()
+	}
+	if err != nil {
+		return RespError(err)
+	}
+
+	offset, length, ok, err := parseRange(req.HeaderValue("Range"), file.Length)
+	if err != nil {
+		headers := map[string]string{"Content-Range": fmt.Sprintf("bytes */%d", file.Length)}
+		return &Response{StatusCode: http.StatusRequestedRangeNotSatisfiable, Headers: headers, Body: utils.M{"errors": []string{err.Error()}}}
+	}
+	if !ok {
+		offset, length = 0, file.Length
+	}
+	if limit := req.MaxFileSize(); length > limit {
+		headers := map[string]string{"Accept-Ranges": "bytes"}
+		err := fmt.Sprintf("the %d bytes can't be sent in a response of at most %d bytes, request a range", length, limit)
+		return &Response{StatusCode: http.StatusRequestEntityTooLarge, Headers: headers, Body: utils.M{"errors": []string{err}}}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	if _, err := bucket.DownloadRange(ctx, id, buf, offset, length); err != nil {
+		return RespError(err)
+	}
+
+	resp := File(file, buf.Bytes(), attachment)
+	resp.Headers["Accept-Ranges"] = "bytes"
+	if ok {
+		resp.StatusCode = http.StatusPartialContent
+		resp.Headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, file.Length)
+	}
+	return resp
+}
+
+func fileHeaders(file *files.File, length int, attachment bool) map[string]string {
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	if len(file.Name) > 0 {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": file.Name})
+	}
+
+	return map[string]string{
+		"Content-Type":        file.ContentType(),
+		"Content-Disposition": disposition,
+		"Content-Length":      strconv.Itoa(length),
+	}
+}
+
+// parseRange returns the offset & length of a single "bytes=" range header
+// of a file of size bytes. ok is false when there is no header.
+func parseRange(header string, size int64) (offset int64, length int64, ok bool, err error) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return 0, 0, false, nil
+	}
+	if size <= 0 {
+		return 0, 0, false, fmt.Errorf(`"%s" is not satisfiable by an empty file`, header)
+	}
+
+	spec := strings.TrimPrefix(header, "bytes=")
+	start, end, found := strings.Cut(spec, "-")
+	if spec == header || !found || strings.Contains(spec, ",") {
+		return 0, 0, false, fmt.Errorf(`"%s" is not a valid range`, header)
+	}
+	start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+
+	if len(start) == 0 {
+		// the last end bytes
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, fmt.Errorf(`"%s" is not a valid range`, header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	offset, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 || offset >= size {
+		return 0, 0, false, fmt.Errorf(`"%s" is not a valid range`, header)
+	}
+	last := size - 1
+	if len(end) > 0 {
+		last, err = strconv.ParseInt(end, 10, 64)
+		if err != nil || last < offset {
+			return 0, 0, false, fmt.Errorf(`"%s" is not a valid range`, header)
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return offset, last - offset + 1, true, nil
+}
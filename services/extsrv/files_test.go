@@ -0,0 +1,53 @@
+package extsrv
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		size   int64
+		offset int64
+		length int64
+		ok     bool
+		err    bool
+	}{
+		{"", 100, 0, 0, false, false},
+		{"bytes=0-", 100, 0, 100, true, false},
+		{"bytes=10-19", 100, 10, 10, true, false},
+		{"bytes=90-", 100, 90, 10, true, false},
+		{"bytes=-10", 100, 90, 10, true, false},
+		{"bytes=-200", 100, 0, 100, true, false},
+		{"bytes=50-500", 100, 50, 50, true, false},
+		{"bytes=100-", 100, 0, 0, false, true},
+		{"bytes=20-10", 100, 0, 0, false, true},
+		{"bytes=-0", 100, 0, 0, false, true},
+		{"bytes=0-10,20-30", 100, 0, 0, false, true},
+		{"0-10", 100, 0, 0, false, true},
+		{"items=0-10", 100, 0, 0, false, true},
+		{"bytes=a-b", 100, 0, 0, false, true},
+		{"bytes=0-", 0, 0, 0, false, true},
+		{"bytes=-10", 0, 0, 0, false, true},
+		{"", 0, 0, 0, false, false},
+	} {
+		offset, length, ok, err := parseRange(test.header, test.size)
+		if (err != nil) != test.err {
+			t.Errorf("Unexpected error of %q of %d bytes: %+v, expected an error %+v", test.header, test.size, err, test.err)
+			continue
+		}
+		if offset != test.offset || length != test.length || ok != test.ok {
+			t.Errorf("Unexpected range of %q of %d bytes: %d, %d, %+v, expected %d, %d, %+v",
+				test.header, test.size, offset, length, ok, test.offset, test.length, test.ok)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	if size := (&Request{}).MaxFileSize(); size != (DefaultMaxPayload-replyOverhead)/4*3 {
+		t.Errorf("Unexpected default max file size: %+v, expected %+v", size, (DefaultMaxPayload-replyOverhead)/4*3)
+	}
+	// the base64 content and the reply overhead fit in the payload
+	req := &Request{maxPayload: 8 << 20}
+	if size := req.MaxFileSize(); (size+2)/3*4+replyOverhead > req.maxPayload {
+		t.Errorf("Unexpected max file size: %+v, larger than the payload %+v", size, req.maxPayload)
+	}
+}
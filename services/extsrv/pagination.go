@@ -0,0 +1,70 @@
+package extsrv
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vavas/go_services/db"
+	"github.com/vavas/go_services/utils"
+)
+
+// PageQuery reads the `cursor` and `limit` params into a db.PageQuery sorted
+// by sortField. A limit above db.MaxPageSize is reduced, an invalid one is an error.
+func (req *Request) PageQuery(sortField string, descending bool) (db.PageQuery, error) {
+	query := db.PageQuery{
+		Cursor:     req.Param("cursor"),
+		SortField:  sortField,
+		Descending: descending,
+	}
+
+	if limit := req.Param("limit"); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return query, fmt.Errorf(`"%s" is not a valid limit`, limit)
+		}
+		query.Limit = n
+	}
+
+	return query, nil
+}
+
+// Paginated response with the items of a page, the page cursors in the body
+// and a Link header pointing to the next & previous pages.
+func Paginated(req *Request, items interface{}, page *db.PageInfo) *Response {
+	body := utils.M{"data": items, "has_next": page.HasNext, "has_prev": page.HasPrev}
+	if len(page.NextCursor) > 0 {
+		body["next_cursor"] = page.NextCursor
+	}
+	if len(page.PrevCursor) > 0 {
+		body["prev_cursor"] = page.PrevCursor
+	}
+
+	resp := Success(body)
+	if link := pageLink(req, page); len(link) > 0 {
+		resp.Headers = map[string]string{"Link": link}
+	}
+	return resp
+}
+
+func pageLink(req *Request, page *db.PageInfo) string {
+	links := []string{}
+	for _, l := range []struct{ rel, cursor string }{
+		{"next", page.NextCursor},
+		{"prev", page.PrevCursor},
+	} {
+		if len(l.cursor) == 0 {
+			continue
+		}
+
+		query := url.Values{}
+		for key, values := range req.Query {
+			query[key] = values
+		}
+		query.Set("cursor", l.cursor)
+
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, req.Path, query.Encode(), l.rel))
+	}
+	return strings.Join(links, ", ")
+}
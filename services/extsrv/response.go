@@ -1,12 +1,14 @@
 package extsrv
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strings"
 
+	"github.com/vavas/go_services/db"
 	"github.com/vavas/go_services/utils"
 )
 
@@ -89,6 +91,10 @@ func Redirect(redirectURL *url.URL) *Response {
 
 // RespError responses with error
 func RespError(err error, rawData ...map[string]interface{}) *Response {
+	if errors.Is(err, db.ErrConflict) {
+		return PreconditionFailed("The document has been modified")
+	}
+
 	errorMsg := strings.ToLower(err.Error())
 
 	utils.NotifyError(err, rawData...)
@@ -4,7 +4,6 @@
 package extsrv
 
 import (
-
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,8 +16,7 @@ import (
 
 	"github.com/nats-io/nats.go"
 
-	"github.com/vavas/go_services/db"
-	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/app"
 	"github.com/vavas/go_services/services/auth"
 	"github.com/vavas/go_services/services/internal"
 	"github.com/vavas/go_services/utils"
@@ -42,6 +40,7 @@ type Subscription struct {
 	Service  string
 	Subject  string
 	Queue    string
+	app      *app.App
 	handlers []*Handler
 }
 
@@ -49,10 +48,10 @@ func subject(service string) string {
 	return service + ".external"
 }
 
-func subscribe(service string, subject string, queue string) (sub *Subscription) {
-	sub = &Subscription{Service: service, Subject: subject, Queue: queue, handlers: []*Handler{}}
+func subscribe(a *app.App, service string, subject string, queue string) (sub *Subscription) {
+	sub = &Subscription{Service: service, Subject: subject, Queue: queue, app: a, handlers: []*Handler{}}
 
-	internal.Subscribe(subject, queue, func(msg *nats.Msg) {
+	internal.Subscribe(a, subject, queue, func(msg *nats.Msg) {
 
 		start := time.Now()
 
@@ -69,17 +68,20 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 					meta["subject"] = msg.Subject
 				}
 				utils.NotifyError(err, meta)
-				internal.Reply(msg, &Response{StatusCode: http.StatusInternalServerError})
+				internal.Reply(a, msg, &Response{StatusCode: http.StatusInternalServerError})
 			}
 		}()
 
 		req := &Request{}
 		if err := json.Unmarshal(msg.Data, req); err != nil {
-			internal.LogError(err, msg, "ext.subscribe() > json.Unmarshal() error")
-			internal.Reply(msg, &Response{StatusCode: http.StatusBadRequest})
+			internal.LogError(a, err, msg, "ext.subscribe() > json.Unmarshal() error")
+			internal.Reply(a, msg, &Response{StatusCode: http.StatusBadRequest})
 			return
 		}
 		req.RawRequest = msg.Data
+		if a.NATS != nil && a.NATS.Bare() != nil {
+			req.maxPayload = a.NATS.Bare().MaxPayload()
+		}
 
 		logFields := map[string]interface{}{
 			"request":    "external",
@@ -90,7 +92,7 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 		if len(req.Query) > 0 {
 			logFields["query"] = req.Query
 		}
-		logger.Logger.Debug("External request is handling",
+		a.Log().Debug("External request is handling",
 			zap.String("request",    "external"),
 			zap.String("request_id", req.RequestID))
 
@@ -98,8 +100,8 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 
 		if handler == nil {
 			err := errors.New("handler not found")
-			internal.LogError(err, msg, "ext.subscribe() error")
-			internal.Reply(msg, &Response{StatusCode: http.StatusNotFound})
+			internal.LogError(a, err, msg, "ext.subscribe() error")
+			internal.Reply(a, msg, &Response{StatusCode: http.StatusNotFound})
 			return
 		}
 
@@ -112,8 +114,8 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 		if !handler.NoAuth {
 			if req.Auth == nil {
 				err := errors.New("request is unauthorized")
-				internal.LogError(err, msg, "request is unauthorized")
-				internal.Reply(msg, &Response{StatusCode: http.StatusUnauthorized})
+				internal.LogError(a, err, msg, "request is unauthorized")
+				internal.Reply(a, msg, &Response{StatusCode: http.StatusUnauthorized})
 				return
 			}
 		}
@@ -123,22 +125,17 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 				req.BodyMap = body
 			} else {
 				err := errors.New("request is bad request")
-				internal.LogError(err, msg, "request is bad request")
-				internal.Reply(msg, &Response{StatusCode: http.StatusBadRequest})
+				internal.LogError(a, err, msg, "request is bad request")
+				internal.Reply(a, msg, &Response{StatusCode: http.StatusBadRequest})
 				return
 			}
 		}
 
 		req.Params = params
 
-		var dbc *mongo.Database
-		if db.HasClient() {
-			dbc = db.DB()
-		}
-
-		resp := handler.HandlerFunc(dbc, req)
+		resp := handler.HandlerFunc(a.DB(), req)
 
-		internal.Reply(msg, resp)
+		internal.Reply(a, msg, resp)
 
 		end := time.Now()
 		latency := end.Sub(start)
@@ -151,7 +148,7 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 			logFields["headers"] = resp.Headers
 		}
 
-		logger.Logger.Debug("External request completed",
+		a.Log().Debug("External request completed",
 			zap.Any("logFields",    logFields))
 
 		if latency > internal.DefaultTimeout {
@@ -210,7 +207,17 @@ func (s *Subscription) getHandler(req *Request) (*Handler, map[string]string) {
 	return handler, params
 }
 
+// App returns the app the subscription runs on.
+func (s *Subscription) App() *app.App {
+	return s.app
+}
+
 // QueueSubscribe create a queued subscription to gnats, which only one server will receive the message.
 func QueueSubscribe(service string) (sub *Subscription) {
-	return subscribe(service, subject(service), subject(service))
+	return QueueSubscribeApp(app.Default(), service)
+}
+
+// QueueSubscribeApp create a queued subscription to gnatsd using the connections of the app.
+func QueueSubscribeApp(a *app.App, service string) (sub *Subscription) {
+	return subscribe(a, service, subject(service), subject(service))
 }
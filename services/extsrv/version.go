@@ -0,0 +1,67 @@
+package extsrv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vavas/go_services/utils"
+)
+
+// ETag returns the ETag header value of a document version.
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// WithETag sets the ETag header of the response to the document version.
+func (resp *Response) WithETag(version int64) *Response {
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["ETag"] = ETag(version)
+	return resp
+}
+
+// HeaderValue returns the first value of the request header key, the key is
+// case insensitive.
+func (req *Request) HeaderValue(key string) string {
+	if value := req.Header.Get(key); len(value) > 0 {
+		return value
+	}
+	for k, values := range req.Header {
+		if strings.EqualFold(k, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// IfMatch returns the document version of the If-Match header. ok is false
+// when the header is missing or "*".
+func (req *Request) IfMatch() (version int64, ok bool, err error) {
+	value := strings.TrimSpace(req.HeaderValue("If-Match"))
+	if len(value) == 0 || value == "*" {
+		return 0, false, nil
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	version, err = strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf(`"%s" is not a valid If-Match header`, value)
+	}
+	return version, true, nil
+}
+
+// PreconditionFailed response, for an If-Match version that is not the
+// current one.
+func PreconditionFailed(messages ...interface{}) *Response {
+	msg := errMessage(http.StatusPreconditionFailed, messages...)
+	return &Response{StatusCode: http.StatusPreconditionFailed, Body: utils.M{"errors": []string{msg}}}
+}
+
+// PreconditionRequired response, for an update without If-Match header.
+func PreconditionRequired(messages ...interface{}) *Response {
+	msg := errMessage(http.StatusPreconditionRequired, messages...)
+	return &Response{StatusCode: http.StatusPreconditionRequired, Body: utils.M{"errors": []string{msg}}}
+}
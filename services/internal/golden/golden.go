@@ -0,0 +1,50 @@
+// Package golden compares test output with golden files under testdata.
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update-golden", false, "update golden files under testdata")
+
+// Path returns the golden file path of name.
+func Path(name string) string {
+	return filepath.Join("testdata", name+".golden")
+}
+
+// AssertJSON compares v, encoded as indented JSON, with the golden file of
+// name. Running the tests with -update-golden rewrites the file instead.
+func AssertJSON(t testing.TB, name string, v interface{}) {
+	t.Helper()
+
+	actual, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatalf("golden: can not encode %s: %+v", name, err)
+	}
+	actual = append(actual, '\n')
+
+	path := Path(name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("golden: %+v", err)
+		}
+		if err := os.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("golden: %+v", err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("golden: %+v (run with -update-golden to create it)", err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("golden: %s does not match\n--- expected\n%s\n--- actual\n%s", path, expected, actual)
+	}
+}
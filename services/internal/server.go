@@ -3,14 +3,13 @@ package internal
 import (
 	"errors"
 	"fmt"
-	"github.com/vavas/go_services/logger"
-	"go.uber.org/zap"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
-	"github.com/vavas/go_services/gnats"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/app"
 )
 
 // DefaultTimeout is 15s
@@ -19,64 +18,27 @@ var DefaultTimeout = 15 * time.Second
 // ErrTooLong is the error thrown if the service took more than DefaultTimeout.
 var ErrTooLong = errors.New("Service took too long to finish")
 
-func buildSubscriber(subject string, queue string, handler nats.MsgHandler) gnats.OnActiveHandler {
-	return func() error {
-		enc, err := gnats.JSONConn()
-		if err != nil {
-			return err
-		}
-
-		log.Printf(`subscribe to subject="%s" queue="%s"`, subject, queue)
-
-		sub, err := enc.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
-			handler(msg)
-		})
-		if err != nil {
-			return err
-		}
-
-		if err := sub.SetPendingLimits(10*nats.DefaultSubPendingMsgsLimit, 10*nats.DefaultSubPendingBytesLimit); err != nil {
-			return err
-		}
-
-		return nil
-	}
-}
-
 // Subscribe makes subscription to gnatsd.
-func Subscribe(subject string, queue string, handler nats.MsgHandler) {
-	name := subject + " subscriber"
-	subscriber := buildSubscriber(subject, queue, handler)
-
-	gnats.AddOnActiveHandler(name, subscriber)
-
-	if gnats.IsConnected() {
-		if err := subscriber(); err != nil {
-			logger.Logger.Error("subscriber() error",
-				zap.NamedError("error", err),
-				zap.String("name", name),
-			)
-		}
+func Subscribe(a *app.App, subject string, queue string, handler nats.MsgHandler) {
+	if err := a.Transport.QueueSubscribe(subject, queue, handler); err != nil {
+		a.Log().Error("subscriber() error",
+			zap.NamedError("error", err),
+			zap.String("name", subject+" subscriber"),
+		)
 	}
 }
 
 // Reply sends a reply to gnatsd server.
-func Reply(in *nats.Msg, out interface{}) {
+func Reply(a *app.App, in *nats.Msg, out interface{}) {
 	if len(in.Reply) == 0 {
 		return
 	}
 
-	enc, err := gnats.JSONConn()
-	if err != nil {
-		LogError(err, in, "reply() > gnats.JSONConn() error")
-		return
-	}
-
-	if err := enc.Publish(in.Reply, out); err != nil {
-		LogError(err, in, "reply() > enc.Publish() error")
+	if err := a.Transport.Publish(in.Reply, out); err != nil {
+		LogError(a, err, in, "reply() > Publish() error")
 		if strings.Contains(err.Error(), "json") {
 			dataStr := fmt.Sprintf("%#v", out)
-			logger.Logger.Error("reply() > enc.Publish() error",
+			a.Log().Error("reply() > Publish() error",
 				zap.NamedError("error", err),
 				zap.Any("data", out),
 				zap.Any("string_data", dataStr),
@@ -87,8 +49,8 @@ func Reply(in *nats.Msg, out interface{}) {
 }
 
 // LogError logs an error.
-func LogError(err error, in *nats.Msg, text string) {
-	logger.Logger.Error(text,
+func LogError(a *app.App, err error, in *nats.Msg, text string) {
+	a.Log().Error(text,
 		zap.NamedError("error", err),
 		zap.String("subject", in.Subject),
 		zap.String("reply", in.Reply),
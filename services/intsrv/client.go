@@ -1,16 +1,17 @@
 package intsrv
 
 import (
+	"context"
 	"fmt"
-	"github.com/pkg/errors"
-	"github.com/vavas/go_services/logger"
-	"go.uber.org/zap"
 	"strings"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
 
-	"github.com/vavas/go_services/gnats"
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/logger"
 	"github.com/vavas/go_services/services/internal"
 )
 
@@ -49,35 +50,49 @@ func (req *Request) ParamObjectID(key string) (bson.ObjectId, error) {
 	return bson.ObjectIdHex(valStr), nil
 }
 
+// Context returns a context carrying the request id.
+func (req *Request) Context() context.Context {
+	return logger.WithRequestID(context.Background(), req.RequestID)
+}
+
+// Client makes requests to internal services using the connections of an app.
+type Client struct {
+	app *app.App
+}
+
+// NewClient returns a client using the connections of the app.
+func NewClient(a *app.App) *Client {
+	return &Client{app: a}
+}
+
 // Publish makes a request and does not expect a reply from a service
 func Publish(req *Request) error {
-	enc, err := gnats.JSONConn()
-	if err != nil {
-		return err
-	}
-	logger.Logger.Debug("Request internal without reply",
-		zap.Error(err),
+	return NewClient(app.Default()).Publish(req)
+}
+
+// RequestReply makes a request and expects a reply from a service
+func RequestReply(req *Request, resp interface{}, customTimeout ...time.Duration) error {
+	return NewClient(app.Default()).RequestReply(req, resp, customTimeout...)
+}
+
+// Publish makes a request and does not expect a reply from a service
+func (c *Client) Publish(req *Request) error {
+	c.app.Log().Debug("Request internal without reply",
 		zap.String("request", "internal"),
 		zap.String("service", req.Service),
 		zap.String("method", req.Function),
 		zap.String("request_id", req.RequestID),
 	)
-	if err := enc.Publish(req.subject(), req); err != nil {
-		return errors.Wrap(err, "enc.Publish")
+	if err := c.app.Transport.Publish(req.subject(), req); err != nil {
+		return errors.Wrap(err, "Transport.Publish")
 	}
 
 	return nil
 }
 
 // RequestReply makes a request and expects a reply from a service
-func RequestReply(req *Request, resp interface{}, customTimeout ...time.Duration) error {
-	enc, err := gnats.JSONConn()
-	if err != nil {
-		return err
-	}
-
-	logger.Logger.Debug("Request internal with reply",
-		zap.Error(err),
+func (c *Client) RequestReply(req *Request, resp interface{}, customTimeout ...time.Duration) error {
+	c.app.Log().Debug("Request internal with reply",
 		zap.String("request", "internal"),
 		zap.String("service", req.Service),
 		zap.String("method", req.Function),
@@ -88,17 +103,17 @@ func RequestReply(req *Request, resp interface{}, customTimeout ...time.Duration
 		realTimeout = customTimeout[0]
 	}
 
-	if err := enc.Flush(); err != nil {
-		return errors.Wrap(err, "enc.Flush")
+	if err := c.app.Transport.Flush(); err != nil {
+		return errors.Wrap(err, "Transport.Flush")
 	}
 
-	if err := enc.Request(req.subject(), req, resp, realTimeout); err != nil {
+	if err := c.app.Transport.Request(req.subject(), req, resp, realTimeout); err != nil {
 		if strings.Contains(err.Error(), "nats: timeout") {
-			if err := enc.Request(req.subject(), req, resp, realTimeout); err != nil {
-				return errors.Wrap(err, "enc.Request")
+			if err := c.app.Transport.Request(req.subject(), req, resp, realTimeout); err != nil {
+				return errors.Wrap(err, "Transport.Request")
 			}
 		} else {
-			return errors.Wrap(err, "enc.Request")
+			return errors.Wrap(err, "Transport.Request")
 		}
 	}
 
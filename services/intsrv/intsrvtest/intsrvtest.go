@@ -0,0 +1,131 @@
+// Package intsrvtest provides utilities for testing internal service handlers.
+// Requests go through the real Subscription dispatching over an in-memory
+// transport, so no gnatsd server is needed.
+package intsrvtest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/services/internal/golden"
+	"github.com/vavas/go_services/services/intsrv"
+	"github.com/vavas/go_services/transport"
+)
+
+// Timeout is the time Call waits for a reply.
+var Timeout = 5 * time.Second
+
+// Server is an internal service running on an in-memory transport.
+type Server struct {
+	*intsrv.Subscription
+
+	App *app.App
+	Bus *transport.Memory
+
+	t testing.TB
+}
+
+// NewServer subscribes service on a new in-memory transport. Handlers are
+// added to the returned server like to any Subscription. The transport is
+// closed when the test ends.
+func NewServer(t testing.TB, service string) *Server {
+	t.Helper()
+
+	if logger.Logger == nil {
+		// utils.NotifyError logs through the global logger.
+		logger.Logger = zap.NewNop()
+	}
+
+	bus := transport.NewMemory()
+	t.Cleanup(bus.Close)
+
+	a := app.NewWithTransport(service, bus)
+	a.Logger = zaptest.NewLogger(t)
+
+	return &Server{
+		Subscription: intsrv.QueueSubscribeApp(a, service),
+		App:          a,
+		Bus:          bus,
+		t:            t,
+	}
+}
+
+// Call calls function with arguments and records the response.
+func (s *Server) Call(function string, arguments interface{}) *Recorder {
+	s.t.Helper()
+
+	req := &intsrv.Request{
+		Service:   s.Service,
+		Function:  function,
+		Arguments: arguments,
+		RequestID: primitive.NewObjectID().Hex(),
+	}
+
+	raw := &rawResponse{}
+	if err := intsrv.NewClient(s.App).RequestReply(req, raw, Timeout); err != nil {
+		s.t.Fatalf("intsrvtest: %s.%s: %+v", s.Service, function, err)
+	}
+
+	return &Recorder{Error: raw.Error, Body: raw.Body, t: s.t}
+}
+
+type rawResponse struct {
+	Error string          `json:"error,omitempty"`
+	Body  json.RawMessage `json:"body,omitempty"`
+}
+
+// Recorder holds the response of a call.
+type Recorder struct {
+	Error string
+	Body  json.RawMessage
+
+	t testing.TB
+}
+
+// AssertNoError fails the test if the response has an error.
+func (r *Recorder) AssertNoError() *Recorder {
+	r.t.Helper()
+	if len(r.Error) > 0 {
+		r.t.Errorf("Unexpected error: %+v, expected none", r.Error)
+	}
+	return r
+}
+
+// AssertError fails the test if the response error is not message.
+func (r *Recorder) AssertError(message string) *Recorder {
+	r.t.Helper()
+	if r.Error != message {
+		r.t.Errorf("Unexpected error: %+v, expected %+v", r.Error, message)
+	}
+	return r
+}
+
+// Decode decodes the body into v.
+func (r *Recorder) Decode(v interface{}) *Recorder {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.t.Fatalf("intsrvtest: can not decode body %s: %+v", r.Body, err)
+	}
+	return r
+}
+
+// AssertGolden compares the error and body with testdata/<name>.golden.
+// Run the tests with -update-golden to write the file.
+func (r *Recorder) AssertGolden(name string) *Recorder {
+	r.t.Helper()
+
+	var body interface{}
+	if len(r.Body) > 0 {
+		_ = json.Unmarshal(r.Body, &body)
+	}
+	golden.AssertJSON(r.t, name, map[string]interface{}{"error": r.Error, "body": body})
+
+	return r
+}
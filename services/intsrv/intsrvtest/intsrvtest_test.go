@@ -0,0 +1,56 @@
+package intsrvtest
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/vavas/go_services/services/intsrv"
+)
+
+func newUserServer(t *testing.T) *Server {
+	srv := NewServer(t, "users")
+
+	srv.AddHandler("GetUser", func(_ *mongo.Database, req *intsrv.Request) (*intsrv.Response, error) {
+		id, _ := req.Param("id").(string)
+		if len(id) == 0 {
+			return nil, errors.New("id is required")
+		}
+		return &intsrv.Response{Body: map[string]interface{}{"id": id, "email": "user@example.com"}}, nil
+	})
+	srv.AddHandler("Panic", func(_ *mongo.Database, _ *intsrv.Request) (*intsrv.Response, error) {
+		panic("boom")
+	})
+
+	return srv
+}
+
+func TestServerRouting(t *testing.T) {
+	srv := newUserServer(t)
+
+	var body struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	}
+	srv.Call("GetUser", map[string]interface{}{"id": "42"}).
+		AssertNoError().
+		Decode(&body)
+
+	if body.ID != "42" || body.Email != "user@example.com" {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+
+	srv.Call("GetUser", nil).AssertError("id is required")
+	srv.Call("DeleteUser", nil).AssertError("handler not found")
+	srv.Call("Panic", nil).AssertError("boom")
+}
+
+func TestServerGolden(t *testing.T) {
+	srv := newUserServer(t)
+
+	srv.Call("GetUser", map[string]interface{}{"id": "42"}).
+		AssertNoError().
+		AssertGolden("get_user")
+	srv.Call("GetUser", nil).AssertGolden("get_user_error")
+}
@@ -3,7 +3,6 @@
 package intsrv
 
 import (
-
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,8 +13,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"go.mongodb.org/mongo-driver/mongo"
 
-	"github.com/vavas/go_services/db"
-	"github.com/vavas/go_services/logger"
+	"github.com/vavas/go_services/app"
 	"github.com/vavas/go_services/services/internal"
 	"github.com/vavas/go_services/utils"
 )
@@ -35,6 +33,7 @@ type Subscription struct {
 	Service  string
 	Subject  string
 	Queue    string
+	app      *app.App
 	handlers map[string]*Handler
 }
 
@@ -42,10 +41,10 @@ func subject(service string) string {
 	return service + ".internal"
 }
 
-func subscribe(service string, subject string, queue string) (sub *Subscription) {
-	sub = &Subscription{Service: service, Subject: subject, Queue: queue, handlers: map[string]*Handler{}}
+func subscribe(a *app.App, service string, subject string, queue string) (sub *Subscription) {
+	sub = &Subscription{Service: service, Subject: subject, Queue: queue, app: a, handlers: map[string]*Handler{}}
 
-	internal.Subscribe(subject, queue, func(msg *nats.Msg) {
+	internal.Subscribe(a, subject, queue, func(msg *nats.Msg) {
 
 		start := time.Now()
 
@@ -53,8 +52,8 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 
 		req := &Request{}
 		if err := json.Unmarshal(msg.Data, req); err != nil {
-			internal.LogError(err, msg, "int.subscribe() > json.Unmarshal() error")
-			internal.Reply(msg, &Response{Error: err.Error()})
+			internal.LogError(a, err, msg, "int.subscribe() > json.Unmarshal() error")
+			internal.Reply(a, msg, &Response{Error: err.Error()})
 			respErr = err.Error()
 			return
 		}
@@ -65,7 +64,7 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 			"request_id": req.RequestID,
 		}
 
-		logger.Logger.Debug("Internal request is handling",
+		a.Log().Debug("Internal request is handling",
 			zap.Any("logFields", logFields))
 
 		defer func() {
@@ -81,7 +80,7 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 					meta["subject"] = msg.Subject
 				}
 				utils.NotifyError(err, meta)
-				internal.Reply(msg, &Response{Error: err.Error()})
+				internal.Reply(a, msg, &Response{Error: err.Error()})
 			}
 
 			end := time.Now()
@@ -94,7 +93,7 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 				logFields["error"] = respErr
 			}
 
-			logger.Logger.Debug("Internal request is completed",
+			a.Log().Debug("Internal request is completed",
 				zap.Any("logFields", logFields))
 
 			if latency > internal.DefaultTimeout {
@@ -106,28 +105,22 @@ func subscribe(service string, subject string, queue string) (sub *Subscription)
 		h := sub.getHandler(req)
 		if h == nil {
 			err := errors.New("handler not found")
-			internal.LogError(err, msg, "int.subscribe() > json.Unmarshal() error")
-			internal.Reply(msg, &Response{Error: err.Error()})
+			internal.LogError(a, err, msg, "int.subscribe() > json.Unmarshal() error")
+			internal.Reply(a, msg, &Response{Error: err.Error()})
 			respErr = err.Error()
 			return
 		}
 
-		var dbc *mongo.Database
-		if db.HasClient() {
-			dbc = db.DB()
-			//defer dbc.Session.Close()
-		}
-
-		resp, err := h.HandlerFunc(dbc, req)
+		resp, err := h.HandlerFunc(a.DB(), req)
 		if err != nil {
-			internal.LogError(err, msg, "int.subscribe() > handler() error")
+			internal.LogError(a, err, msg, "int.subscribe() > handler() error")
 			if resp == nil {
 				resp = &Response{}
 			}
 			resp.Error = err.Error()
 		}
 
-		internal.Reply(msg, resp)
+		internal.Reply(a, msg, resp)
 
 		if resp != nil {
 			respErr = resp.Error
@@ -156,12 +149,27 @@ func (s *Subscription) getHandler(req *Request) *Handler {
 	return h
 }
 
+// App returns the app the subscription runs on.
+func (s *Subscription) App() *app.App {
+	return s.app
+}
+
 // Subscribe create a subscription to gnatsd.
 func Subscribe(service string) (sub *Subscription) {
-	return subscribe(service, subject(service), "")
+	return SubscribeApp(app.Default(), service)
 }
 
 // QueueSubscribe create a queued subscription to gnats, which only one server will receive the message.
 func QueueSubscribe(service string) (sub *Subscription) {
-	return subscribe(service, subject(service), subject(service))
+	return QueueSubscribeApp(app.Default(), service)
+}
+
+// SubscribeApp create a subscription to gnatsd using the connections of the app.
+func SubscribeApp(a *app.App, service string) (sub *Subscription) {
+	return subscribe(a, service, subject(service), "")
+}
+
+// QueueSubscribeApp create a queued subscription to gnatsd using the connections of the app.
+func QueueSubscribeApp(a *app.App, service string) (sub *Subscription) {
+	return subscribe(a, service, subject(service), subject(service))
 }
@@ -0,0 +1,210 @@
+package transport
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/encoders/builtin"
+)
+
+// MemoryPendingLimit is the number of messages a Memory subscription buffers
+// before dropping new ones, like a nats slow consumer.
+var MemoryPendingLimit = 65536
+
+const memoryInboxPrefix = "_INBOX."
+
+// Memory is an in-process transport. Several apps sharing one Memory can make
+// requests to each other without a gnatsd server. Subjects are matched
+// literally, wildcards are not supported.
+type Memory struct {
+	sync.RWMutex
+	encoder builtin.JsonEncoder
+	subs    map[string][]*memorySub
+	inboxes map[string]chan *nats.Msg
+	nextID  uint64
+	closed  bool
+}
+
+type memorySub struct {
+	queue   string
+	handler nats.MsgHandler
+	msgs    chan *nats.Msg
+	done    chan struct{}
+}
+
+// NewMemory returns an empty in-process transport.
+func NewMemory() *Memory {
+	return &Memory{subs: map[string][]*memorySub{}, inboxes: map[string]chan *nats.Msg{}}
+}
+
+// QueueSubscribe subscribes handler to subject. Messages are handled in order
+// on a goroutine per subscription.
+func (m *Memory) QueueSubscribe(subject string, queue string, handler nats.MsgHandler) error {
+	if len(subject) == 0 {
+		return nats.ErrBadSubject
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nats.ErrConnectionClosed
+	}
+
+	sub := &memorySub{
+		queue:   queue,
+		handler: handler,
+		msgs:    make(chan *nats.Msg, MemoryPendingLimit),
+		done:    make(chan struct{}),
+	}
+	m.subs[subject] = append(m.subs[subject], sub)
+
+	go sub.run()
+
+	return nil
+}
+
+func (s *memorySub) run() {
+	for {
+		select {
+		case msg := <-s.msgs:
+			s.handler(msg)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Publish sends v to every plain subscriber of subject and to one subscriber
+// of each queue group.
+func (m *Memory) Publish(subject string, v interface{}) error {
+	return m.publish(subject, "", v)
+}
+
+func (m *Memory) publish(subject string, reply string, v interface{}) error {
+	if len(subject) == 0 {
+		return nats.ErrBadSubject
+	}
+
+	data, err := m.encoder.Encode(subject, v)
+	if err != nil {
+		return err
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.closed {
+		return nats.ErrConnectionClosed
+	}
+
+	if inbox, ok := m.inboxes[subject]; ok {
+		select {
+		case inbox <- &nats.Msg{Subject: subject, Data: data}:
+		default:
+		}
+		return nil
+	}
+
+	groups := map[string][]*memorySub{}
+	for _, sub := range m.subs[subject] {
+		if len(sub.queue) == 0 {
+			sub.deliver(&nats.Msg{Subject: subject, Reply: reply, Data: data})
+			continue
+		}
+		groups[sub.queue] = append(groups[sub.queue], sub)
+	}
+	for _, group := range groups {
+		group[rand.Intn(len(group))].deliver(&nats.Msg{Subject: subject, Reply: reply, Data: data})
+	}
+
+	return nil
+}
+
+func (s *memorySub) deliver(msg *nats.Msg) {
+	select {
+	case s.msgs <- msg:
+	default:
+		// slow consumer, the message is dropped
+	}
+}
+
+// Request sends v to subject and decodes the first reply into resp. It
+// returns nats.ErrNoResponders when nobody is subscribed and nats.ErrTimeout
+// when no reply arrives in time.
+func (m *Memory) Request(subject string, v interface{}, resp interface{}, timeout time.Duration) error {
+	inbox := m.newInbox()
+
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return nats.ErrConnectionClosed
+	}
+	if len(m.subs[subject]) == 0 {
+		m.Unlock()
+		return nats.ErrNoResponders
+	}
+	replies := make(chan *nats.Msg, 1)
+	m.inboxes[inbox] = replies
+	m.Unlock()
+
+	defer func() {
+		m.Lock()
+		delete(m.inboxes, inbox)
+		m.Unlock()
+	}()
+
+	if err := m.publish(subject, inbox, v); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-replies:
+		return m.encoder.Decode(msg.Subject, msg.Data, resp)
+	case <-timer.C:
+		return nats.ErrTimeout
+	}
+}
+
+func (m *Memory) newInbox() string {
+	id := atomic.AddUint64(&m.nextID, 1)
+	return memoryInboxPrefix + strconv.FormatUint(id, 10)
+}
+
+// Flush is a noop, messages are delivered as soon as they are published.
+func (m *Memory) Flush() error {
+	return nil
+}
+
+// HasSubscribers returns true if anything is subscribed to subject.
+func (m *Memory) HasSubscribers(subject string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.subs[subject]) > 0
+}
+
+// Close stops all subscriptions. Later calls fail with nats.ErrConnectionClosed.
+func (m *Memory) Close() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+
+	for _, subs := range m.subs {
+		for _, sub := range subs {
+			close(sub.done)
+		}
+	}
+	m.subs = map[string][]*memorySub{}
+}
@@ -0,0 +1,107 @@
+package transport_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+
+	"github.com/vavas/go_services/app"
+	"github.com/vavas/go_services/services/intsrv"
+	"github.com/vavas/go_services/transport"
+)
+
+func TestMemoryQueueGroup(t *testing.T) {
+	bus := transport.NewMemory()
+	defer bus.Close()
+
+	var queued, plain int32
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 2; i++ {
+		_ = bus.QueueSubscribe("users.internal", "users.internal", func(msg *nats.Msg) {
+			atomic.AddInt32(&queued, 1)
+			wg.Done()
+		})
+	}
+	_ = bus.QueueSubscribe("users.internal", "", func(msg *nats.Msg) {
+		atomic.AddInt32(&plain, 1)
+		wg.Done()
+	})
+
+	_ = bus.Publish("users.internal", "a")
+	_ = bus.Publish("users.internal", "b")
+	wg.Wait()
+
+	if queued != 2 {
+		t.Errorf("Unexpected queue group deliveries: %+v, expected 2", queued)
+	}
+	if plain != 2 {
+		t.Errorf("Unexpected plain deliveries: %+v, expected 2", plain)
+	}
+}
+
+func TestMemoryRequest(t *testing.T) {
+	bus := transport.NewMemory()
+	defer bus.Close()
+
+	if err := bus.Request("nobody", "ping", nil, time.Second); err != nats.ErrNoResponders {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, nats.ErrNoResponders)
+	}
+
+	_ = bus.QueueSubscribe("ping", "", func(msg *nats.Msg) {
+		_ = bus.Publish(msg.Reply, "pong")
+	})
+	_ = bus.QueueSubscribe("silent", "", func(msg *nats.Msg) {})
+
+	var out string
+	if err := bus.Request("ping", "ping", &out, time.Second); err != nil {
+		t.Errorf("Unexpected error: %+v, expected nil", err)
+	}
+	if out != "pong" {
+		t.Errorf("Unexpected reply: %+v, expected pong", out)
+	}
+
+	if err := bus.Request("silent", "ping", &out, 10*time.Millisecond); err != nats.ErrTimeout {
+		t.Errorf("Unexpected error: %+v, expected %+v", err, nats.ErrTimeout)
+	}
+}
+
+func TestMemoryServiceChain(t *testing.T) {
+	bus := transport.NewMemory()
+	defer bus.Close()
+
+	users := app.NewWithTransport("users", bus)
+	users.Logger = zap.NewNop()
+	accounts := app.NewWithTransport("accounts", bus)
+	accounts.Logger = zap.NewNop()
+
+	intsrv.QueueSubscribeApp(users, "users").AddHandler("Get", func(_ *mongo.Database, req *intsrv.Request) (*intsrv.Response, error) {
+		return &intsrv.Response{Body: map[string]interface{}{"id": req.Param("id")}}, nil
+	})
+	intsrv.QueueSubscribeApp(accounts, "accounts").AddHandler("Owner", func(_ *mongo.Database, req *intsrv.Request) (*intsrv.Response, error) {
+		resp := &intsrv.Response{}
+		err := intsrv.NewClient(accounts).RequestReply(&intsrv.Request{
+			Service:   "users",
+			Function:  "Get",
+			Arguments: map[string]interface{}{"id": "42"},
+			RequestID: req.RequestID,
+		}, resp)
+		return resp, err
+	})
+
+	resp := &intsrv.Response{}
+	err := intsrv.NewClient(users).RequestReply(&intsrv.Request{Service: "accounts", Function: "Owner"}, resp, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v, expected nil", err)
+	}
+
+	body, _ := resp.Body.(map[string]interface{})
+	if body["id"] != "42" {
+		t.Errorf("Unexpected body: %+v", resp.Body)
+	}
+}
@@ -0,0 +1,104 @@
+// Package transport is the messaging layer used by the internal & external
+// services. NATS is the production transport, Memory is an in-process one for
+// tests.
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/vavas/go_services/gnats"
+)
+
+// Transport sends and receives JSON encoded messages.
+type Transport interface {
+	// QueueSubscribe subscribes handler to subject. Only one subscriber of
+	// a non-empty queue group receives each message.
+	QueueSubscribe(subject string, queue string, handler nats.MsgHandler) error
+	// Publish sends v to subject without waiting for a reply.
+	Publish(subject string, v interface{}) error
+	// Request sends v to subject and decodes the reply into resp.
+	Request(subject string, v interface{}, resp interface{}, timeout time.Duration) error
+	// Flush makes sure published messages have been sent.
+	Flush() error
+}
+
+// NATS is the transport using a gnats connection.
+type NATS struct {
+	Conn *gnats.Conn
+}
+
+// NewNATS returns a transport using conn.
+func NewNATS(conn *gnats.Conn) *NATS {
+	return &NATS{Conn: conn}
+}
+
+// QueueSubscribe subscribes handler to subject. The subscription is made again
+// each time the connection becomes active without it, e.g. after Connect.
+func (t *NATS) QueueSubscribe(subject string, queue string, handler nats.MsgHandler) error {
+	name := subject + " subscriber"
+	var mu sync.Mutex
+	var current *nats.Subscription
+	subscriber := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		// kept by nats.go on reconnect
+		if current != nil && current.IsValid() {
+			return nil
+		}
+
+		enc, err := t.Conn.JSONConn()
+		if err != nil {
+			return err
+		}
+
+		t.Conn.Log().Sugar().Infof(`subscribe to subject="%s" queue="%s"`, subject, queue)
+
+		sub, err := enc.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+			handler(msg)
+		})
+		if err != nil {
+			return err
+		}
+		current = sub
+
+		return sub.SetPendingLimits(10*nats.DefaultSubPendingMsgsLimit, 10*nats.DefaultSubPendingBytesLimit)
+	}
+
+	t.Conn.AddOnActiveHandler(name, subscriber)
+
+	if t.Conn.IsConnected() {
+		return subscriber()
+	}
+
+	return nil
+}
+
+// Publish sends v to subject.
+func (t *NATS) Publish(subject string, v interface{}) error {
+	enc, err := t.Conn.JSONConn()
+	if err != nil {
+		return err
+	}
+	return enc.Publish(subject, v)
+}
+
+// Request sends v to subject and waits for the reply.
+func (t *NATS) Request(subject string, v interface{}, resp interface{}, timeout time.Duration) error {
+	enc, err := t.Conn.JSONConn()
+	if err != nil {
+		return err
+	}
+	return enc.Request(subject, v, resp, timeout)
+}
+
+// Flush flushes the connection.
+func (t *NATS) Flush() error {
+	enc, err := t.Conn.JSONConn()
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}